@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials reads the connecting process's credentials with
+// LOCAL_PEERCRED and LOCAL_PEERPID
+func peerCredentials(conn *net.UnixConn) (peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+	var cred peerCred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		var xucred *unix.Xucred
+		xucred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		if credErr != nil {
+			return
+		}
+		cred.UID = int(xucred.Uid)
+		cred.PID, _ = unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+	}); err != nil {
+		return peerCred{}, err
+	}
+	return cred, credErr
+}
+
+func fileOwner(fi os.FileInfo) (int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// peerCredentials reads the connecting process's credentials with SO_PEERCRED
+func peerCredentials(conn *net.UnixConn) (peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return peerCred{}, err
+	}
+	if credErr != nil {
+		return peerCred{}, credErr
+	}
+	return peerCred{UID: int(ucred.Uid), PID: int(ucred.Pid)}, nil
+}
+
+func fileOwner(fi os.FileInfo) (int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// peerCredentials is unsupported here, so every admin connection is refused
+func peerCredentials(conn *net.UnixConn) (peerCred, error) {
+	return peerCred{}, errors.New("peer credentials are not supported on this platform")
+}
+
+func fileOwner(fi os.FileInfo) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// adminMethods is the admin socket API. Methods that change state record
+// themselves in the audit log with actor "admin_socket".
+func adminMethods() map[string]adminMethod {
+	return map[string]adminMethod{
+		"server.status":    adminServerStatus,
+		"sessions.list":    adminSessionsList,
+		"sessions.close":   adminSessionsClose,
+		"devices.list":     adminDevicesList,
+		"devices.revoke":   adminDevicesRevoke,
+		"metrics.get":      adminMetricsGet,
+		"config.get":       adminConfigGet,
+		"config.reload":    adminConfigReload,
+		"keys.fingerprint": adminKeysFingerprint,
+		"keys.rotate":      adminKeysRotate,
+		"models.list":      adminModelsList,
+		"models.pull":      adminModelsPull,
+		"models.loaded":    adminModelsLoaded,
+		"models.load":      adminModelsLoad,
+		"models.unload":    adminModelsUnload,
+		"audit.query":      adminAuditQuery,
+		"audit.verify":     adminAuditVerify,
+		"pairing.start":    adminPairingStart,
+		"pairing.wait":     adminPairingWait,
+		"apikeys.list":     adminAPIKeysList,
+		"apikeys.issue":    adminAPIKeysIssue,
+		"apikeys.revoke":   adminAPIKeysRevoke,
+	}
+}
+
+// decodeParams unmarshals params, treating missing params as empty
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return invalidParams("invalid params: %v", err)
+	}
+	return nil
+}
+
+var serverStartedAt = time.Now()
+
+func adminServerStatus(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{
+		"pid":          os.Getpid(),
+		"uptime":       time.Since(serverStartedAt).Round(time.Second).String(),
+		"listen":       cfg().Listen,
+		"sessions":     len(sessions.List()),
+		"strict_local": strictLocalMode(),
+		"draining":     sessions.Draining(),
+	}, nil
+}
+
+func adminSessionsList(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	list := sessions.List()
+	out := make([]SessionInfo, 0, len(list))
+	for _, s := range list {
+		out = append(out, s.Info())
+	}
+	return out, nil
+}
+
+func adminSessionsClose(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		ID string `json:"id"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	s := sessions.Get(p.ID)
+	if s == nil {
+		return nil, invalidParams("unknown session %q", p.ID)
+	}
+	s.Send(ServerMsg{Op: "error", Code: codeClosed, Error: "session closed by administrator"})
+	sessions.end(s)
+	auditLog.Record(auditSessionClosed, map[string]string{"session": p.ID, "actor": "admin_socket"})
+	logger.Info("session closed by administrator", logKeySession, p.ID)
+	return map[string]string{"id": p.ID, "status": "closed"}, nil
+}
+
+func adminDevicesList(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	return deviceRegistry.List(), nil
+}
+
+func adminDevicesRevoke(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		ID string `json:"id"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.ID == "" {
+		return nil, invalidParams("id is required")
+	}
+	if err := revokeDevice(p.ID, "admin_socket"); err != nil {
+		if errors.Is(err, ErrUnknownDevice) {
+			return nil, invalidParams("%s: %v", p.ID, err)
+		}
+		return nil, err
+	}
+	return map[string]string{"id": p.ID, "status": "revoked"}, nil
+}
+
+func adminAPIKeysList(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	return apiKeys.List(), nil
+}
+
+// adminAPIKeysIssue creates a key; the socket is how the first admin key is
+// made, since /admin/keys itself needs one
+func adminAPIKeysIssue(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		Models    []string `json:"allowed_models"`
+		ExpiresIn string   `json:"expires_in"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	var ttl time.Duration
+	if p.ExpiresIn != "" {
+		d, err := time.ParseDuration(p.ExpiresIn)
+		if err != nil || d < 0 {
+			return nil, invalidParams("invalid expires_in %q", p.ExpiresIn)
+		}
+		ttl = d
+	}
+	k, secret, err := apiKeys.Issue(p.Name, p.Scopes, p.Models, ttl)
+	if errors.Is(err, ErrUnknownScope) {
+		return nil, invalidParams("%v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	auditLog.Record(auditAPIKeyIssued, map[string]string{
+		"key_id": k.ID,
+		"name":   k.Name,
+		"scopes": strings.Join(k.Scopes, ","),
+		"actor":  "admin_socket",
+	})
+	k.SecretHash = ""
+	return map[string]interface{}{"key": k, "api_key": secret}, nil
+}
+
+func adminAPIKeysRevoke(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		ID string `json:"id"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.ID == "" {
+		return nil, invalidParams("id is required")
+	}
+	if err := apiKeys.Revoke(p.ID); err != nil {
+		if errors.Is(err, ErrUnknownAPIKey) {
+			return nil, invalidParams("%s: %v", p.ID, err)
+		}
+		return nil, err
+	}
+	auditLog.Record(auditAPIKeyRevoked, map[string]string{"key_id": p.ID, "actor": "admin_socket"})
+	return map[string]string{"id": p.ID, "status": "revoked"}, nil
+}
+
+func adminMetricsGet(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	p50, p90, count := ttftMetrics.GetStats()
+	return map[string]interface{}{
+		"ttft":      map[string]interface{}{"p50_ms": p50, "p90_ms": p90, "count": count},
+		"usage":     usageTracker.Report(),
+		"ice":       iceTelemetry.Aggregate(),
+		"netpolicy": netPolicy.Stats(),
+		"egress":    egressGuard.Stats(),
+		"noise":     noiseManager.GetSessionStats(),
+		"sessions":  len(sessions.List()),
+		"buffers":   bufferStats(),
+	}, nil
+}
+
+func adminConfigGet(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{"path": settingsPath, "config": cfg().Redacted()}, nil
+}
+
+// adminConfigReload is the same as SIGHUP; on error the current settings stay
+func adminConfigReload(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	if err := reloadConfig("admin_socket"); err != nil {
+		return nil, err
+	}
+	return map[string]string{"path": settingsPath, "status": "reloaded"}, nil
+}
+
+func adminKeysFingerprint(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{
+		"noise":           noiseManager.RotationState(),
+		"tls_mode":        tlsState.Mode,
+		"tls_spki_sha256": tlsState.Fingerprint,
+	}, nil
+}
+
+// adminKeysRotate rotates the Noise static key and announces the new one to
+// connected devices. grace overrides noise.rotation_grace.
+func adminKeysRotate(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Grace string `json:"grace"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	grace := cfg().rotationGrace()
+	if p.Grace != "" {
+		d, err := time.ParseDuration(p.Grace)
+		if err != nil || d <= 0 {
+			return nil, invalidParams("grace must be a positive duration, got %q", p.Grace)
+		}
+		grace = d
+	}
+	previous := noiseManager.Fingerprint()
+	kr, err := noiseManager.Rotate(grace)
+	if err != nil {
+		return nil, err
+	}
+	announced := announceKeyRotation(kr)
+	auditLog.Record(auditKeyRotated, map[string]string{
+		"key":         "noise_static",
+		"previous":    previous,
+		"current":     noiseManager.Fingerprint(),
+		"grace_until": kr.GraceUntil.Format(time.RFC3339),
+		"announced":   fmt.Sprint(announced),
+		"actor":       "admin_socket",
+	})
+	logger.Info("noise static key rotated", "previous", previous, "key_id", noiseManager.Fingerprint(), "announced", announced)
+	return map[string]interface{}{
+		"noise":     noiseManager.RotationState(),
+		"announced": announced,
+	}, nil
+}
+
+func adminModelsList(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", cfg().Ollama.URL+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newEgressClient(10 * time.Second).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ollama unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama returned %s", resp.Status)
+	}
+	var tags struct {
+		Models []map[string]interface{} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, err
+	}
+	return tags.Models, nil
+}
+
+// adminModelsPull blocks until Ollama has finished downloading the model
+func adminModelsPull(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" {
+		return nil, invalidParams("name is required")
+	}
+	body, _ := json.Marshal(map[string]interface{}{"name": p.Name, "stream": false})
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg().Ollama.URL+"/api/pull", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := newEgressClient(0).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ollama unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.Error != "" {
+		if result.Error == "" {
+			result.Error = resp.Status
+		}
+		return nil, fmt.Errorf("pull %s: %s", p.Name, result.Error)
+	}
+	auditLog.Record(auditModelPulled, map[string]string{"model": p.Name, "actor": "admin_socket"})
+	logger.Info("model pulled", "model", p.Name)
+	return map[string]string{"name": p.Name, "status": result.Status}, nil
+}
+
+// adminModelsLoaded reports model residency: what Ollama holds in memory and
+// what this server keeps warm
+func adminModelsLoaded(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	loaded, err := globalOllamaManager().Loaded(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ollama unreachable: %w", err)
+	}
+	return map[string]interface{}{
+		"loaded":  loaded,
+		"managed": globalOllamaManager().Managed(),
+	}, nil
+}
+
+// adminModelsLoad loads a model and pins it in memory
+func adminModelsLoad(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" {
+		return nil, invalidParams("name is required")
+	}
+	if err := globalOllamaManager().Pin(p.Name); err != nil {
+		return nil, err
+	}
+	auditLog.Record(auditModelLoaded, map[string]string{"model": p.Name, "actor": "admin_socket"})
+	logger.Info("model pinned", logKeyModel, p.Name)
+	return map[string]string{"name": p.Name, "status": "loaded"}, nil
+}
+
+func adminModelsUnload(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Name string `json:"name"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Name == "" {
+		return nil, invalidParams("name is required")
+	}
+	if err := globalOllamaManager().Unload(ctx, p.Name); err != nil {
+		return nil, err
+	}
+	auditLog.Record(auditModelUnloaded, map[string]string{"model": p.Name, "actor": "admin_socket"})
+	logger.Info("model unloaded", logKeyModel, p.Name)
+	return map[string]string{"name": p.Name, "status": "unloaded"}, nil
+}
+
+func adminAuditQuery(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Event string    `json:"event"`
+		Since time.Time `json:"since"`
+		Until time.Time `json:"until"`
+		Limit int       `json:"limit"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Limit == 0 {
+		p.Limit = 100
+	}
+	return auditLog.Query(AuditQuery{Event: p.Event, Since: p.Since, Until: p.Until, Limit: p.Limit})
+}
+
+func adminAuditVerify(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	checked, err := auditLog.Verify()
+	result := map[string]interface{}{"entries": checked, "valid": err == nil}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	return result, nil
+}
+
+func adminPairingStart(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	p := currentPairingPayload(cfg().Listen)
+	p.PairCode, p.PairCodeExpires = signalingAuth.NewPairCode()
+	return p, nil
+}
+
+// adminPairingWait blocks until the code is redeemed by a phone or expires
+func adminPairingWait(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Code string `json:"code"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Code == "" {
+		return nil, invalidParams("code is required")
+	}
+	ch := signalingAuth.WaitPaired(p.Code)
+	if ch == nil {
+		return nil, invalidParams("unknown pairing code")
+	}
+	select {
+	case d := <-ch:
+		return d, nil
+	case <-time.After(pairCodeTTL):
+		return nil, ErrBadPairCode
+	case <-ctx.Done():
+		return nil, errors.New("server is shutting down")
+	}
+}
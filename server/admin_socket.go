@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The admin socket is a Unix domain socket in the data directory speaking
+// newline-delimited JSON-RPC 2.0. The CLI uses it to manage a running server;
+// it is never reachable over the network and is separate from the HTTP mux.
+//
+// Access is checked twice: the socket is created 0600 in a directory only
+// its owner can write to, and every connection's peer credentials must match
+// the server's user (or root).
+const adminSocketName = "admin.sock"
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+func invalidParams(format string, args ...any) error {
+	return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+// adminMethod handles one RPC method. ctx is cancelled when the server stops.
+type adminMethod func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// peerCred identifies the process on the other end of an admin connection
+type peerCred struct {
+	UID int
+	PID int
+}
+
+type AdminServer struct {
+	path    string
+	methods map[string]adminMethod
+	ln      net.Listener
+	// uid is the only non-root user allowed to connect
+	uid int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewAdminServer(path string, methods map[string]adminMethod) *AdminServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &AdminServer{path: path, methods: methods, uid: os.Geteuid(), ctx: ctx, cancel: cancel}
+}
+
+func adminSocketPath() string {
+	return filepath.Join(dataDir(), adminSocketName)
+}
+
+// Listen creates the socket with owner-only permissions. A socket left
+// behind by a crashed server is replaced; a live one is an error.
+func (s *AdminServer) Listen() error {
+	if err := s.checkDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	if conn, err := net.Dial("unix", s.path); err == nil {
+		conn.Close()
+		return fmt.Errorf("another server is already listening on %s", s.path)
+	}
+	if fi, err := os.Lstat(s.path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", s.path)
+		}
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+	s.ln = ln
+	return nil
+}
+
+// checkDir refuses a socket directory that another user could write to,
+// since they could replace the socket with their own
+func (s *AdminServer) checkDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if owner, ok := fileOwner(fi); ok && owner != s.uid {
+		return fmt.Errorf("%s is owned by uid %d, not %d", dir, owner, s.uid)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by other users (%v)", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// authorize checks the peer credentials of a new connection
+func (s *AdminServer) authorize(conn net.Conn) bool {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+	cred, err := peerCredentials(uc)
+	if err == nil && (cred.UID == s.uid || cred.UID == 0) {
+		return true
+	}
+	reason := "uid mismatch"
+	if err != nil {
+		reason = err.Error()
+	}
+	logger.Warn("admin connection refused", "uid", cred.UID, "pid", cred.PID, "reason", reason)
+	auditLog.Record(auditAdminDenied, map[string]string{
+		"uid":    fmt.Sprint(cred.UID),
+		"pid":    fmt.Sprint(cred.PID),
+		"reason": reason,
+	})
+	return false
+}
+
+func (s *AdminServer) Serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				logger.Error("admin socket accept failed", "error", err)
+			}
+			return
+		}
+		if !s.authorize(conn) {
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops the listener, cancels running methods and removes the socket
+func (s *AdminServer) Close() {
+	s.cancel()
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.wg.Wait()
+	os.Remove(s.path)
+}
+
+func (s *AdminServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req rpcRequest
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) && s.ctx.Err() == nil {
+				var syntax *json.SyntaxError
+				if errors.As(err, &syntax) {
+					enc.Encode(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+				}
+			}
+			return
+		}
+		resp := s.call(&req)
+		if req.ID == nil {
+			// Notification; no response
+			continue
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *AdminServer) call(req *rpcRequest) rpcResponse {
+	resp := rpcResponse{JSONRPC: "2.0", ID: req.ID}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		resp.Error = &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}
+		return resp
+	}
+	m, ok := s.methods[req.Method]
+	if !ok {
+		resp.Error = &rpcError{Code: rpcMethodNotFound, Message: "unknown method " + req.Method}
+		return resp
+	}
+	result, err := m(s.ctx, req.Params)
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		var re *rpcError
+		if !errors.As(err, &re) {
+			re = &rpcError{Code: rpcInternalError, Message: err.Error()}
+		}
+		resp.Error = re
+		resp.Result = nil
+	}
+	logger.Debug("admin call", "method", req.Method, "error", resp.Error != nil)
+	return resp
+}
+
+// AdminClient calls methods on a running server's admin socket
+type AdminClient struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+	next int
+}
+
+func DialAdmin(path string) (*AdminClient, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("no running server at %s: %w", path, err)
+	}
+	return &AdminClient{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}, nil
+}
+
+// Call invokes method and decodes its result into result, if non-nil
+func (c *AdminClient) Call(method string, params, result interface{}) error {
+	c.next++
+	req := map[string]interface{}{"jsonrpc": "2.0", "id": c.next, "method": method}
+	if params != nil {
+		req["params"] = params
+	}
+	if err := c.enc.Encode(req); err != nil {
+		return err
+	}
+	var resp rpcResponse
+	if err := c.dec.Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil && resp.Result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+func (c *AdminClient) Close() error {
+	return c.conn.Close()
+}
+
+var adminServer *AdminServer
+
+// initAdminSocket starts the admin socket; the server runs without one if it
+// cannot be created
+func initAdminSocket() {
+	adminServer = NewAdminServer(adminSocketPath(), adminMethods())
+	if err := adminServer.Listen(); err != nil {
+		logger.Error("admin socket unavailable", "path", adminServer.path, "error", err)
+		adminServer = nil
+		return
+	}
+	go adminServer.Serve()
+	logger.Info("admin socket listening", "path", adminServer.path)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminSocketRPC(t *testing.T) {
+	dir, err := os.MkdirTemp("", "qp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, adminSocketName)
+
+	s := NewAdminServer(path, map[string]adminMethod{
+		"echo": func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			var p map[string]string
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, invalidParams("bad params")
+			}
+			return p, nil
+		},
+	})
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want 0600", fi.Mode().Perm())
+	}
+	if err := NewAdminServer(path, nil).Listen(); err == nil {
+		t.Error("second server replaced a live socket")
+	}
+
+	c, err := DialAdmin(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]string
+	if err := c.Call("echo", map[string]string{"a": "b"}, &out); err != nil || out["a"] != "b" {
+		t.Errorf("echo = %v, %v", out, err)
+	}
+	var re *rpcError
+	if err := c.Call("missing", nil, nil); !errors.As(err, &re) || re.Code != rpcMethodNotFound {
+		t.Errorf("unknown method error = %v", err)
+	}
+	if err := c.Call("echo", []int{1}, nil); !errors.As(err, &re) || re.Code != rpcInvalidParams {
+		t.Errorf("invalid params error = %v", err)
+	}
+	c.Close()
+
+	s.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("socket not removed on close")
+	}
+}
+
+func TestDoctorKeyStorePermissions(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if r := doctorKeyStore(dir); r[0].Status != doctorFail {
+		t.Errorf("group-readable key store: %+v", r)
+	}
+	os.Chmod(dir, 0700)
+	os.WriteFile(filepath.Join(dir, tlsKeyName), []byte("k"), 0644)
+	r := doctorKeyStore(dir)
+	if r[0].Status != doctorOK || len(r) != 3 || r[1].Status != doctorFail || r[2].Status != doctorWarn {
+		t.Errorf("key store results: %+v", r)
+	}
+}
+
+func TestICEURLHost(t *testing.T) {
+	for u, want := range map[string]string{
+		"stun:stun.l.google.com:19302":        "stun.l.google.com",
+		"turn:192.168.1.2:3478?transport=udp": "192.168.1.2",
+		"turns:[fd7a::1]:5349":                "fd7a::1",
+		"stun:mac.local":                      "mac.local",
+	} {
+		if got := iceURLHost(u); got != want {
+			t.Errorf("iceURLHost(%q) = %q, want %q", u, got, want)
+		}
+	}
+}
+
+func TestAdminSocketRefusesSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewAdminServer(filepath.Join(dir, adminSocketName), nil).Listen(); err == nil {
+		t.Error("listened in a world-writable directory")
+	}
+
+	os.Chmod(dir, 0700)
+	path := filepath.Join(dir, adminSocketName)
+	os.WriteFile(path, []byte("not a socket"), 0600)
+	if err := NewAdminServer(path, nil).Listen(); err == nil {
+		t.Error("replaced a regular file")
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API key scopes
+const (
+	scopeChat   = "chat"
+	scopeModels = "models"
+	scopeAdmin  = "admin"
+)
+
+const (
+	apiKeyPrefix = "qpk_"
+	// apiKeyFlushInterval is how often usage counters are written to disk
+	apiKeyFlushInterval = 30 * time.Second
+)
+
+var (
+	ErrBadAPIKey     = errors.New("invalid API key")
+	ErrAPIKeyExpired = errors.New("API key expired")
+	ErrAPIKeyRevoked = errors.New("API key revoked")
+	ErrScopeDenied   = errors.New("API key lacks required scope")
+	ErrModelDenied   = errors.New("model not allowed for this API key")
+	ErrUnknownScope  = errors.New("unknown scope")
+	ErrUnknownAPIKey = errors.New("unknown API key")
+)
+
+// APIKeyUsage is accumulated per key on every authenticated request
+type APIKeyUsage struct {
+	Requests         int       `json:"requests"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	LastUsed         time.Time `json:"last_used,omitempty"`
+}
+
+// APIKey is the stored form of a key. Only a SHA-256 of the secret is kept;
+// the secret itself is shown once when the key is issued.
+type APIKey struct {
+	ID            string      `json:"id"`
+	Name          string      `json:"name"`
+	SecretHash    string      `json:"secret_hash"`
+	Scopes        []string    `json:"scopes"`
+	AllowedModels []string    `json:"allowed_models,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	ExpiresAt     time.Time   `json:"expires_at,omitempty"`
+	Revoked       bool        `json:"revoked,omitempty"`
+	Usage         APIKeyUsage `json:"usage"`
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsModel reports whether the key may use model; an empty list allows all
+func (k *APIKey) AllowsModel(model string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	for _, m := range k.AllowedModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyStore persists API keys in a JSON file in the data directory. Keys
+// are written when they change; usage counters are kept in memory and
+// written by Flush.
+type APIKeyStore struct {
+	mu   sync.Mutex
+	path string
+	keys map[string]*APIKey
+	// dirty is set when usage has changed since the last save
+	dirty bool
+}
+
+func OpenAPIKeyStore(path string) (*APIKeyStore, error) {
+	s := &APIKeyStore{path: path, keys: make(map[string]*APIKey)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*APIKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, k := range list {
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+// save must be called with mu held
+func (s *APIKeyStore) save() error {
+	list := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Flush writes usage recorded since the last save
+func (s *APIKeyStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// flushLoop flushes usage every interval until stop is closed
+func (s *APIKeyStore) flushLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := s.Flush(); err != nil {
+			logger.Warn("failed to persist API key usage", "error", err)
+		}
+	}
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a key and returns it with its secret. A zero ttl never expires.
+func (s *APIKeyStore) Issue(name string, scopes, models []string, ttl time.Duration) (*APIKey, string, error) {
+	if len(scopes) == 0 {
+		scopes = []string{scopeChat}
+	}
+	for _, sc := range scopes {
+		if sc != scopeChat && sc != scopeModels && sc != scopeAdmin {
+			return nil, "", ErrUnknownScope
+		}
+	}
+
+	id := make([]byte, 6)
+	rand.Read(id)
+	secretBytes := make([]byte, 24)
+	rand.Read(secretBytes)
+
+	k := &APIKey{
+		ID:            hex.EncodeToString(id),
+		Name:          name,
+		Scopes:        scopes,
+		AllowedModels: models,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if ttl > 0 {
+		k.ExpiresAt = k.CreatedAt.Add(ttl)
+	}
+	secret := apiKeyPrefix + k.ID + "_" + hex.EncodeToString(secretBytes)
+	k.SecretHash = hashSecret(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.ID)
+		return nil, "", err
+	}
+	c := *k
+	return &c, secret, nil
+}
+
+// Verify returns the key for a presented secret
+func (s *APIKeyStore) Verify(secret string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(secret, apiKeyPrefix)
+	if !ok {
+		return nil, ErrBadAPIKey
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, ErrBadAPIKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(k.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrBadAPIKey
+	}
+	if k.Revoked {
+		return nil, ErrAPIKeyRevoked
+	}
+	if !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt) {
+		return nil, ErrAPIKeyExpired
+	}
+	c := *k
+	return &c, nil
+}
+
+func (s *APIKeyStore) List() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		c := *k
+		c.SecretHash = ""
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+func (s *APIKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return ErrUnknownAPIKey
+	}
+	k.Revoked = true
+	return s.save()
+}
+
+// RecordRequest counts an authenticated request against the key
+func (s *APIKeyStore) RecordRequest(id string) {
+	s.record(id, func(k *APIKey) {
+		k.Usage.Requests++
+		k.Usage.LastUsed = time.Now().UTC()
+	})
+}
+
+// RecordTokens adds a generation's token counts to the key
+func (s *APIKeyStore) RecordTokens(id string, u *UsageStats) {
+	if u == nil {
+		return
+	}
+	s.record(id, func(k *APIKey) {
+		k.Usage.PromptTokens += u.PromptTokens
+		k.Usage.CompletionTokens += u.CompletionTokens
+	})
+}
+
+func (s *APIKeyStore) record(id string, fn func(*APIKey)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return
+	}
+	fn(k)
+	s.dirty = true
+}
+
+var (
+	apiKeys         *APIKeyStore
+	apiKeyFlushStop = make(chan struct{})
+)
+
+func initAPIKeys() {
+	var err error
+	apiKeys, err = OpenAPIKeyStore(filepath.Join(dataDir(), "api_keys.json"))
+	if err != nil {
+		fatal("failed to open API key store", "error", err)
+	}
+	go apiKeys.flushLoop(apiKeyFlushInterval, apiKeyFlushStop)
+}
+
+// closeAPIKeys stops the flush loop and writes outstanding usage
+func closeAPIKeys() {
+	close(apiKeyFlushStop)
+	if err := apiKeys.Flush(); err != nil {
+		logger.Warn("failed to persist API key usage", "error", err)
+	}
+}
+
+type (
+	apiKeyContextKey struct{}
+	deviceContextKey struct{}
+)
+
+// apiKeyFromContext returns the key that authenticated the request, if any
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return k
+}
+
+// deviceFromContext returns the paired device that authenticated the
+// request with its signaling token, if any
+func deviceFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(deviceContextKey{}).(string)
+	return id
+}
+
+// requireAPIKey authenticates "Authorization: Bearer qpk_..." and checks
+// scope. Paired devices may use their signaling token (qp1...) instead for
+// everything but admin; revoking the device revokes the token.
+func requireAPIKey(scope string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			if allowUnpaired() {
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="quicpair"`)
+			http.Error(w, "Unauthorized: API key required", http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(secret, tokenPrefix+".") && scope != scopeAdmin {
+			deviceID, err := signalingAuth.verifyToken(secret)
+			if err == nil {
+				_, err = deviceRegistry.Active(deviceID)
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="quicpair", error="invalid_token"`)
+				http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			deviceRegistry.Touch(deviceID)
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), deviceContextKey{}, deviceID)))
+			return
+		}
+		k, err := apiKeys.Verify(secret)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="quicpair", error="invalid_token"`)
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !k.HasScope(scope) {
+			http.Error(w, "Forbidden: "+ErrScopeDenied.Error(), http.StatusForbidden)
+			return
+		}
+		apiKeys.RecordRequest(k.ID)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k)))
+	})
+}
+
+// adminAccess requires an admin-scoped API key, from loopback too: any
+// local process or browser page can reach loopback. Without a key, use the
+// admin socket (quicpair-server apikeys issue -scopes admin).
+func adminAccess(h http.Handler) http.Handler {
+	return requireAPIKey(scopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// requireAPIKey lets keyless requests through in dev mode
+		if r.Method != http.MethodOptions && apiKeyFromContext(r.Context()) == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="quicpair"`)
+			http.Error(w, "Unauthorized: API key required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// handleAPIKeys lists (GET), issues (POST) or revokes (DELETE ?id=) API keys
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(apiKeys.List())
+	case http.MethodPost:
+		var req struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			Models    []string `json:"allowed_models"`
+			ExpiresIn string   `json:"expires_in"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid expires_in", http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		k, secret, err := apiKeys.Issue(req.Name, req.Scopes, req.Models, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		auditLog.Record(auditAPIKeyIssued, map[string]string{
+			"key_id": k.ID,
+			"name":   k.Name,
+			"scopes": strings.Join(k.Scopes, ","),
+		})
+		k.SecretHash = ""
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"key": k, "api_key": secret})
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if err := apiKeys.Revoke(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		auditLog.Record(auditAPIKeyRevoked, map[string]string{"key_id": id})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	store, err := OpenAPIKeyStore(filepath.Join(t.TempDir(), "api_keys.json"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	k, secret, err := store.Issue("shortcuts", []string{scopeChat}, []string{"qwen3:1.7b"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to issue key: %v", err)
+	}
+
+	got, err := store.Verify(secret)
+	if err != nil || got.ID != k.ID {
+		t.Fatalf("Expected key to verify, got %v", err)
+	}
+	if !got.HasScope(scopeChat) || got.HasScope(scopeAdmin) {
+		t.Fatalf("Unexpected scopes: %v", got.Scopes)
+	}
+	if !got.AllowsModel("qwen3:1.7b") || got.AllowsModel("qwen3:4b") {
+		t.Fatal("Allowed-model list not enforced")
+	}
+
+	if _, err := store.Verify(secret + "0"); err != ErrBadAPIKey {
+		t.Fatalf("Expected ErrBadAPIKey, got %v", err)
+	}
+
+	store.RecordRequest(k.ID)
+	store.RecordTokens(k.ID, &UsageStats{PromptTokens: 3, CompletionTokens: 7})
+	if u := store.List()[0].Usage; u.Requests != 1 || u.CompletionTokens != 7 {
+		t.Fatalf("Unexpected usage: %+v", u)
+	}
+	if store.List()[0].SecretHash != "" {
+		t.Fatal("List must not expose secret hashes")
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if reopened, _ := OpenAPIKeyStore(store.path); reopened.List()[0].Usage.Requests != 1 {
+		t.Fatal("Flushed usage was not written")
+	}
+
+	// Usage and revocation survive a reload
+	store.Revoke(k.ID)
+	store, _ = OpenAPIKeyStore(store.path)
+	if _, err := store.Verify(secret); err != ErrAPIKeyRevoked {
+		t.Fatalf("Expected ErrAPIKeyRevoked, got %v", err)
+	}
+
+	if _, _, err := store.Issue("bad", []string{"root"}, nil, 0); err != ErrUnknownScope {
+		t.Fatalf("Expected ErrUnknownScope, got %v", err)
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	store, _ := OpenAPIKeyStore(filepath.Join(t.TempDir(), "api_keys.json"))
+	apiKeys = store
+	defer func() { apiKeys = nil }()
+
+	_, chatSecret, _ := store.Issue("chat", []string{scopeChat}, nil, 0)
+	_, expiredSecret, _ := store.Issue("old", []string{scopeChat}, nil, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	h := requireAPIKey(scopeChat, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiKeyFromContext(r.Context()) == nil {
+			t.Error("Expected key in request context")
+		}
+	}))
+	admin := requireAPIKey(scopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		handler http.Handler
+		auth    string
+		want    int
+	}{
+		{h, "", http.StatusUnauthorized},
+		{h, "Bearer " + chatSecret, http.StatusOK},
+		{h, "Bearer " + expiredSecret, http.StatusUnauthorized},
+		{admin, "Bearer " + chatSecret, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("POST", "/api/chat", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		tc.handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("auth %q: expected %d, got %d", tc.auth, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestDeviceTokenAndAdminAccess(t *testing.T) {
+	store, _ := OpenAPIKeyStore(filepath.Join(t.TempDir(), "api_keys.json"))
+	sa, devices := newTestSignalingAuth(t)
+	apiKeys, signalingAuth, deviceRegistry = store, sa, devices
+	defer func() { apiKeys, signalingAuth, deviceRegistry = nil, nil, nil }()
+
+	device, _ := devices.Pair("iPhone", nil)
+	token := sa.IssueToken(device.ID)
+	_, adminSecret, _ := store.Issue("ops", []string{scopeAdmin}, nil, 0)
+
+	chat := requireAPIKey(scopeChat, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deviceFromContext(r.Context()) != device.ID {
+			t.Error("Expected device in request context")
+		}
+	}))
+	admin := adminAccess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name    string
+		handler http.Handler
+		auth    string
+		want    int
+	}{
+		{"device on chat", chat, "Bearer " + token, http.StatusOK},
+		{"device on admin", admin, "Bearer " + token, http.StatusUnauthorized},
+		{"loopback without key", admin, "", http.StatusUnauthorized},
+		{"admin key", admin, "Bearer " + adminSecret, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/admin/devices", nil)
+		req.RemoteAddr = "127.0.0.1:5000"
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		tc.handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, rec.Code)
+		}
+	}
+
+	devices.Revoke(device.ID)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/chat", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	chat.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Revoked device token: expected 401, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Images for a chat come inline in its images field when the whole message
+// fits in one DataChannel frame (maxMessageSize). Larger ones are sent first
+// as attach messages of one chunk each, then named in the chat's
+// attachments field. The control channel is ordered, so chunks arrive in
+// order.
+const (
+	codeBadAttachment = "bad_attachment"
+	// maxImageBytes caps one decoded image
+	maxImageBytes = 20 << 20
+	// maxChatImages caps the images of one chat, inline and attached
+	maxChatImages = 4
+	// maxPendingAttachments caps attachments being assembled per session
+	maxPendingAttachments = 8
+	// attachmentTTL drops attachments no chat has claimed
+	attachmentTTL = 2 * time.Minute
+)
+
+var ErrBadAttachment = errors.New("bad attachment")
+
+// AttachmentChunk is one part of an image sent with the attach op
+type AttachmentChunk struct {
+	ID string `json:"id"`
+	// Part counts from 0 to Parts-1
+	Part  int    `json:"part"`
+	Parts int    `json:"parts"`
+	Data  []byte `json:"data"`
+}
+
+// attachment is an image being assembled or waiting for its chat
+type attachment struct {
+	data    []byte
+	next    int
+	parts   int
+	started time.Time
+}
+
+func (a *attachment) complete() bool { return a.next == a.parts }
+
+// AddChunk appends a chunk to its attachment, starting one on part 0
+func (s *Session) AddChunk(c AttachmentChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attachments == nil {
+		s.attachments = make(map[string]*attachment)
+	}
+	for id, a := range s.attachments {
+		if time.Since(a.started) > attachmentTTL {
+			delete(s.attachments, id)
+		}
+	}
+	if c.ID == "" || c.Parts < 1 || c.Part < 0 || c.Part >= c.Parts {
+		return fmt.Errorf("%w: invalid chunk %d/%d of %q", ErrBadAttachment, c.Part, c.Parts, c.ID)
+	}
+	a := s.attachments[c.ID]
+	if c.Part == 0 {
+		if a != nil {
+			return fmt.Errorf("%w: %q already sent", ErrBadAttachment, c.ID)
+		}
+		if len(s.attachments) >= maxPendingAttachments {
+			return fmt.Errorf("%w: more than %d pending attachments", ErrBadAttachment, maxPendingAttachments)
+		}
+		a = &attachment{parts: c.Parts, started: time.Now()}
+		s.attachments[c.ID] = a
+	}
+	if a == nil || a.complete() || c.Part != a.next || c.Parts != a.parts {
+		delete(s.attachments, c.ID)
+		return fmt.Errorf("%w: chunk %d/%d of %q out of order", ErrBadAttachment, c.Part, c.Parts, c.ID)
+	}
+	if len(a.data)+len(c.Data) > maxImageBytes {
+		delete(s.attachments, c.ID)
+		return fmt.Errorf("%w: %q is larger than %d bytes", ErrBadAttachment, c.ID, maxImageBytes)
+	}
+	a.data = append(a.data, c.Data...)
+	a.next++
+	return nil
+}
+
+// ChatImages collects a chat's inline images and its completed attachments,
+// which are released. Every image must be a JPEG, PNG or WebP.
+func (s *Session) ChatImages(inline [][]byte, ids []string) ([][]byte, error) {
+	if n := len(inline) + len(ids); n > maxChatImages {
+		return nil, fmt.Errorf("%w: %d images, at most %d", ErrBadAttachment, n, maxChatImages)
+	}
+	images := append([][]byte(nil), inline...)
+	s.mu.Lock()
+	for _, id := range ids {
+		a := s.attachments[id]
+		if a == nil || !a.complete() {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("%w: %q is missing or incomplete", ErrBadAttachment, id)
+		}
+		images = append(images, a.data)
+	}
+	for _, id := range ids {
+		delete(s.attachments, id)
+	}
+	s.mu.Unlock()
+	for i, img := range images {
+		switch http.DetectContentType(img) {
+		case "image/jpeg", "image/png", "image/webp":
+		default:
+			return nil, fmt.Errorf("%w: image %d is not a JPEG, PNG or WebP", ErrBadAttachment, i)
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestAttachmentChunks(t *testing.T) {
+	s := NewSession("s1", "dev-1", nil, nil)
+	img := append(append([]byte(nil), pngHeader...), make([]byte, 100)...)
+	for i, part := range [][]byte{img[:40], img[40:80], img[80:]} {
+		if err := s.AddChunk(AttachmentChunk{ID: "a1", Part: i, Parts: 3, Data: part}); err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+	}
+	if err := s.AddChunk(AttachmentChunk{ID: "a2", Part: 1, Parts: 2, Data: img}); !errors.Is(err, ErrBadAttachment) {
+		t.Errorf("chunk without part 0 accepted: %v", err)
+	}
+
+	images, err := s.ChatImages([][]byte{pngHeader}, []string{"a1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || string(images[1]) != string(img) {
+		t.Errorf("images not assembled: %d", len(images))
+	}
+	if _, err := s.ChatImages(nil, []string{"a1"}); err == nil {
+		t.Error("attachment claimed twice")
+	}
+	if _, err := s.ChatImages([][]byte{[]byte("#!/bin/sh")}, nil); err == nil {
+		t.Error("non-image accepted")
+	}
+}
+
+func TestVisionModelRouting(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Model string }
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Model {
+		case "llava":
+			json.NewEncoder(w).Encode(map[string]interface{}{"capabilities": []string{"completion", "vision"}})
+		case "qwen3:4b":
+			json.NewEncoder(w).Encode(map[string]interface{}{"capabilities": []string{"completion"}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	mc := NewModelCapabilities(srv.URL)
+	ctx := context.Background()
+
+	if _, err := mc.VisionModel(ctx, "qwen3:4b", RoutingConfig{}); err == nil {
+		t.Error("text-only model accepted images")
+	}
+	rc := RoutingConfig{VisionModel: "missing", DefaultModel: "qwen3:4b", Tiers: []RouteTier{{Model: "llava"}}}
+	if m, err := mc.VisionModel(ctx, "", rc); err != nil || m != "llava" {
+		t.Errorf("routed to %q, %v", m, err)
+	}
+	if _, err := mc.VisionModel(ctx, "", RoutingConfig{DefaultModel: "qwen3:4b"}); !errors.Is(err, ErrNoVisionModel) {
+		t.Errorf("expected ErrNoVisionModel, got %v", err)
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	auditDevicePaired        = "device.paired"
+	auditDeviceRevoked       = "device.revoked"
+	auditHandshakeFailed     = "noise.handshake_failed"
+	auditSignalingAuthFailed = "signaling.auth_failed"
+	auditRejectedNonLocal    = "conn.rejected_nonlocal"
+	auditModelPulled         = "model.pulled"
+	auditModelLoaded         = "model.loaded"
+	auditModelUnloaded       = "model.unloaded"
+	auditSessionClosed       = "session.closed"
+	auditConfigChanged       = "config.changed"
+	auditAPIKeyIssued        = "apikey.issued"
+	auditAPIKeyRevoked       = "apikey.revoked"
+	auditServerStarted       = "server.started"
+	auditServerStopped       = "server.stopped"
+	auditKeyRotated          = "key.rotated"
+	auditAdminDenied         = "admin.denied"
+	auditPruned              = "audit.pruned"
+)
+
+const (
+	auditFileName     = "audit.log"
+	auditMaxFileBytes = 10 << 20
+	auditMaxFiles     = 10
+	auditGenesisHash  = "0000000000000000000000000000000000000000000000000000000000000000"
+	// auditCheckpointName holds the last entry pruned by rotation
+	auditCheckpointName = "audit-checkpoint.json"
+	// auditLimitInterval spaces out entries written with RecordLimited
+	auditLimitInterval = time.Minute
+)
+
+// AuditEntry is one line of the audit log. It carries metadata only; Fields
+// with payload or key names are dropped before the entry is written.
+type AuditEntry struct {
+	Seq      uint64            `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Event    string            `json:"event"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// computeHash hashes the entry with its Hash field cleared. encoding/json
+// sorts map keys, so the encoding is stable.
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog is an append-only, hash-chained log of security-relevant events.
+// Each entry commits to the previous one so any edit or deletion breaks the
+// chain from that point on. The chain continues across rotated files.
+type AuditLog struct {
+	mu       sync.Mutex
+	dir      string
+	file     *os.File
+	size     int64
+	seq      uint64
+	lastHash string
+	limits   map[string]auditLimit
+}
+
+// auditLimit tracks an event kind written with RecordLimited
+type auditLimit struct {
+	last       time.Time
+	suppressed int
+}
+
+// auditCheckpoint is the last entry of the newest pruned file. The first
+// retained entry must continue from it. Each prune is also recorded in the
+// chain as an audit.pruned entry, so the file cannot be rewritten to hide
+// further deletions.
+type auditCheckpoint struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// OpenAuditLog opens (or creates) the audit log in dir and restores the chain
+// head from the last entry on disk
+func OpenAuditLog(dir string) (*AuditLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	al := &AuditLog{dir: dir, lastHash: auditGenesisHash, limits: make(map[string]auditLimit)}
+
+	if err := trimTornEntry(filepath.Join(dir, auditFileName)); err != nil {
+		return nil, err
+	}
+	files, err := al.files()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastAuditEntry(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			al.seq = last.Seq
+			al.lastHash = last.Hash
+			break
+		}
+	}
+
+	if err := al.openCurrent(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AuditLog) openCurrent() error {
+	f, err := os.OpenFile(filepath.Join(al.dir, auditFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.file = f
+	al.size = info.Size()
+	return nil
+}
+
+// Record appends an event. Errors are logged rather than returned so callers
+// on hot paths do not need to handle them.
+func (al *AuditLog) Record(event string, fields map[string]string) {
+	if al == nil {
+		return
+	}
+
+	clean := make(map[string]string, len(fields))
+	for k, v := range fields {
+		if isSensitiveKey(k) {
+			continue
+		}
+		clean[k] = v
+	}
+	if len(clean) == 0 {
+		clean = nil
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.appendLocked(event, clean)
+}
+
+// RecordLimited records at most one event of its kind per
+// auditLimitInterval, for events outsiders can trigger at will such as
+// rejected connections. The next entry written carries the number
+// suppressed in between.
+func (al *AuditLog) RecordLimited(event string, fields map[string]string) {
+	if al == nil {
+		return
+	}
+	al.mu.Lock()
+	lim := al.limits[event]
+	if time.Since(lim.last) < auditLimitInterval {
+		lim.suppressed++
+		al.limits[event] = lim
+		al.mu.Unlock()
+		return
+	}
+	al.limits[event] = auditLimit{last: time.Now()}
+	al.mu.Unlock()
+
+	if lim.suppressed > 0 {
+		withCount := map[string]string{"suppressed": strconv.Itoa(lim.suppressed)}
+		for k, v := range fields {
+			withCount[k] = v
+		}
+		fields = withCount
+	}
+	al.Record(event, fields)
+}
+
+// appendLocked chains and writes one entry, rotating first if the file is
+// full. It must be called with mu held.
+func (al *AuditLog) appendLocked(event string, fields map[string]string) {
+	e := AuditEntry{
+		Seq:      al.seq + 1,
+		Time:     time.Now().UTC(),
+		Event:    event,
+		Fields:   fields,
+		PrevHash: al.lastHash,
+	}
+	e.Hash = e.computeHash()
+
+	line, _ := json.Marshal(e)
+	line = append(line, '\n')
+
+	if al.size > 0 && al.size+int64(len(line)) > auditMaxFileBytes {
+		if err := al.rotateAnchored(); err != nil {
+			logger.Error("audit log rotation failed", "error", err)
+		} else {
+			al.appendLocked(event, fields)
+			return
+		}
+	}
+
+	n, err := al.file.Write(line)
+	if err != nil {
+		logger.Error("audit log write failed", "event", event, "error", err)
+		return
+	}
+	al.size += int64(n)
+	al.seq = e.Seq
+	al.lastHash = e.Hash
+}
+
+// rotateAnchored rotates and chains an audit.pruned entry if files were
+// pruned. It must be called with mu held.
+func (al *AuditLog) rotateAnchored() error {
+	cp, err := al.rotate()
+	if err != nil {
+		return err
+	}
+	if cp != nil {
+		al.appendLocked(auditPruned, map[string]string{
+			"through_seq":  strconv.FormatUint(cp.Seq, 10),
+			"through_hash": cp.Hash,
+		})
+	}
+	return nil
+}
+
+// rotate renames the current file and prunes the oldest rotated files. It
+// returns the new checkpoint when files were pruned.
+func (al *AuditLog) rotate() (*auditCheckpoint, error) {
+	al.file.Close()
+	rotated := filepath.Join(al.dir, fmt.Sprintf("audit-%020d.log", al.seq))
+	if err := os.Rename(filepath.Join(al.dir, auditFileName), rotated); err != nil {
+		return nil, err
+	}
+
+	var cp *auditCheckpoint
+	files, err := al.files()
+	if err == nil && len(files) > auditMaxFiles {
+		pruned := files[:len(files)-auditMaxFiles]
+		// Files are only removed once the checkpoint is on disk
+		last, err := lastAuditEntry(pruned[len(pruned)-1])
+		if err == nil && last != nil {
+			cp = &auditCheckpoint{Seq: last.Seq, Hash: last.Hash}
+			if err := al.saveCheckpoint(*cp); err != nil {
+				logger.Error("audit checkpoint write failed, not pruning", "error", err)
+				cp = nil
+			} else {
+				for _, old := range pruned {
+					os.Remove(old)
+				}
+			}
+		}
+	}
+	return cp, al.openCurrent()
+}
+
+func (al *AuditLog) saveCheckpoint(cp auditCheckpoint) error {
+	b, _ := json.Marshal(cp)
+	p := filepath.Join(al.dir, auditCheckpointName)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// loadCheckpoint returns nil if nothing has been pruned yet
+func (al *AuditLog) loadCheckpoint() (*auditCheckpoint, error) {
+	b, err := os.ReadFile(filepath.Join(al.dir, auditCheckpointName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp auditCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("%s: %v", auditCheckpointName, err)
+	}
+	return &cp, nil
+}
+
+// files lists rotated files oldest first, followed by the current file
+func (al *AuditLog) files() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(al.dir, "audit-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	if _, err := os.Stat(filepath.Join(al.dir, auditFileName)); err == nil {
+		matches = append(matches, filepath.Join(al.dir, auditFileName))
+	}
+	return matches, nil
+}
+
+// AuditQuery filters entries returned by Query
+type AuditQuery struct {
+	Event string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// Query returns matching entries, newest last
+func (al *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	al.mu.Lock()
+	files, err := al.files()
+	al.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []AuditEntry
+	for _, path := range files {
+		err := readAuditFile(path, func(e AuditEntry) bool {
+			if q.Event != "" && e.Event != q.Event && !strings.HasPrefix(e.Event, q.Event+".") {
+				return true
+			}
+			if !q.Since.IsZero() && e.Time.Before(q.Since) {
+				return true
+			}
+			if !q.Until.IsZero() && e.Time.After(q.Until) {
+				return true
+			}
+			out = append(out, e)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if q.Limit > 0 && len(out) > q.Limit {
+		out = out[len(out)-q.Limit:]
+	}
+	return out, nil
+}
+
+// Verify walks the chain and returns the number of entries checked. After
+// pruning the oldest retained entry must continue from the checkpoint, and
+// the checkpoint must match the last audit.pruned entry in the chain.
+func (al *AuditLog) Verify() (int, error) {
+	al.mu.Lock()
+	files, err := al.files()
+	al.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	start, err := al.loadCheckpoint()
+	if err != nil {
+		return 0, err
+	}
+	if start == nil {
+		start = &auditCheckpoint{Seq: 0, Hash: auditGenesisHash}
+	}
+
+	checked := 0
+	var prev *AuditEntry
+	var anchor *auditCheckpoint
+	var verr error
+	for _, path := range files {
+		err := readAuditFile(path, func(e AuditEntry) bool {
+			if e.computeHash() != e.Hash {
+				verr = fmt.Errorf("entry %d: hash mismatch", e.Seq)
+				return false
+			}
+			if prev == nil && (e.PrevHash != start.Hash || e.Seq != start.Seq+1) {
+				verr = fmt.Errorf("entry %d: log truncated, expected it to follow entry %d", e.Seq, start.Seq)
+				return false
+			}
+			if prev != nil && (e.PrevHash != prev.Hash || e.Seq != prev.Seq+1) {
+				verr = fmt.Errorf("entry %d: chain broken after entry %d", e.Seq, prev.Seq)
+				return false
+			}
+			if e.Event == auditPruned {
+				seq, _ := strconv.ParseUint(e.Fields["through_seq"], 10, 64)
+				anchor = &auditCheckpoint{Seq: seq, Hash: e.Fields["through_hash"]}
+			}
+			entry := e
+			prev = &entry
+			checked++
+			return true
+		})
+		if err != nil {
+			return checked, err
+		}
+		if verr != nil {
+			return checked, verr
+		}
+	}
+	if anchor != nil && *anchor != *start {
+		return checked, fmt.Errorf("%s does not match the last %s entry", auditCheckpointName, auditPruned)
+	}
+	return checked, nil
+}
+
+func (al *AuditLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.file.Close()
+}
+
+// readAuditFile calls fn for each entry. An unparseable final line is a
+// write cut short by a crash and is skipped; anywhere else it is an error.
+func readAuditFile(path string, fn func(AuditEntry) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	var malformed error
+	for scanner.Scan() {
+		if malformed != nil {
+			return malformed
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			malformed = fmt.Errorf("%s: malformed entry: %v", filepath.Base(path), err)
+			continue
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// trimTornEntry cuts a partial last line left by a crash mid-write, so new
+// entries start on a line of their own
+func trimTornEntry(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) || len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keep := bytes.LastIndexByte(data, '\n') + 1
+	logger.Warn("truncating partial audit entry", "file", path, "bytes", len(data)-keep)
+	return os.Truncate(path, int64(keep))
+}
+
+func lastAuditEntry(path string) (*AuditEntry, error) {
+	var last *AuditEntry
+	err := readAuditFile(path, func(e AuditEntry) bool {
+		entry := e
+		last = &entry
+		return true
+	})
+	return last, err
+}
+
+var auditLog *AuditLog
+
+func initAuditLog() {
+	var err error
+	auditLog, err = OpenAuditLog(filepath.Join(dataDir(), "audit"))
+	if err != nil {
+		fatal("failed to open audit log", "error", err)
+	}
+}
+
+// handleAuditQuery serves /admin/audit?event=&since=&until=&limit=
+func handleAuditQuery(w http.ResponseWriter, r *http.Request) {
+	q := AuditQuery{Event: r.URL.Query().Get("event"), Limit: 100}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+	for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := r.URL.Query().Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+
+	entries, err := auditLog.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	checked, err := auditLog.Verify()
+	result := map[string]interface{}{"entries": checked, "valid": err == nil}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
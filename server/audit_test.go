@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogChain(t *testing.T) {
+	dir := t.TempDir()
+	al, err := OpenAuditLog(dir)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+
+	al.Record(auditDevicePaired, map[string]string{"device": "iphone-1", "prompt": "must not be stored"})
+	al.Record(auditHandshakeFailed, map[string]string{"session": "peer-1"})
+	al.Close()
+
+	// Reopening continues the chain
+	al, err = OpenAuditLog(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	al.Record(auditDeviceRevoked, map[string]string{"device": "iphone-1"})
+
+	entries, err := al.Query(AuditQuery{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(entries) != 3 || entries[2].Seq != 3 || entries[2].PrevHash != entries[1].Hash {
+		t.Fatalf("Unexpected chain: %+v", entries)
+	}
+	if _, ok := entries[0].Fields["prompt"]; ok {
+		t.Fatal("Payload field was written to the audit log")
+	}
+
+	devices, _ := al.Query(AuditQuery{Event: "device"})
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 device events, got %d", len(devices))
+	}
+
+	if n, err := al.Verify(); err != nil || n != 3 {
+		t.Fatalf("Expected valid chain of 3, got %d: %v", n, err)
+	}
+	al.Close()
+
+	// Tamper with the first entry
+	path := filepath.Join(dir, auditFileName)
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(data), "iphone-1", "iphone-2", 1)), 0600)
+
+	al, _ = OpenAuditLog(dir)
+	defer al.Close()
+	if _, err := al.Verify(); err == nil {
+		t.Fatal("Expected tampering to be detected")
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	al, err := OpenAuditLog(dir)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer al.Close()
+
+	al.Record(auditServerStarted, nil)
+	al.mu.Lock()
+	if _, err := al.rotate(); err != nil {
+		t.Fatalf("Rotation failed: %v", err)
+	}
+	al.mu.Unlock()
+	al.Record(auditConfigChanged, map[string]string{"key": "secret", "setting": "strict_local"})
+
+	files, _ := al.files()
+	if len(files) != 2 {
+		t.Fatalf("Expected rotated and current file, got %v", files)
+	}
+	if n, err := al.Verify(); err != nil || n != 2 {
+		t.Fatalf("Expected chain to span rotated files, got %d: %v", n, err)
+	}
+}
+
+func TestAuditLogPruneAnchored(t *testing.T) {
+	dir := t.TempDir()
+	al, err := OpenAuditLog(dir)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer al.Close()
+
+	for i := 0; i < auditMaxFiles+3; i++ {
+		al.Record(auditServerStarted, nil)
+		al.mu.Lock()
+		if err := al.rotateAnchored(); err != nil {
+			t.Fatalf("Rotation failed: %v", err)
+		}
+		al.mu.Unlock()
+	}
+	files, _ := al.files()
+	if len(files) != auditMaxFiles+1 {
+		t.Fatalf("Expected %d files after pruning, got %d", auditMaxFiles+1, len(files))
+	}
+	pruned, _ := al.Query(AuditQuery{Event: auditPruned})
+	if len(pruned) == 0 {
+		t.Fatal("Expected pruning to be recorded in the chain")
+	}
+	if _, err := al.Verify(); err != nil {
+		t.Fatalf("Expected pruned log to verify: %v", err)
+	}
+
+	// Deleting more history must not go unnoticed
+	os.Remove(files[0])
+	if _, err := al.Verify(); err == nil {
+		t.Fatal("Expected truncation to be detected")
+	}
+	os.Remove(filepath.Join(dir, auditCheckpointName))
+	if _, err := al.Verify(); err == nil {
+		t.Fatal("Expected truncation without checkpoint to be detected")
+	}
+}
+
+func TestAuditRecordLimited(t *testing.T) {
+	al, err := OpenAuditLog(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer al.Close()
+
+	for i := 0; i < 100; i++ {
+		al.RecordLimited(auditRejectedNonLocal, map[string]string{"remote": "8.8.8.8:1234"})
+	}
+	// Let the next one through as if the interval had passed
+	al.mu.Lock()
+	lim := al.limits[auditRejectedNonLocal]
+	lim.last = lim.last.Add(-auditLimitInterval)
+	al.limits[auditRejectedNonLocal] = lim
+	al.mu.Unlock()
+	al.RecordLimited(auditRejectedNonLocal, map[string]string{"remote": "8.8.8.8:1234"})
+
+	entries, _ := al.Query(AuditQuery{Event: auditRejectedNonLocal})
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 rejection entries, got %d", len(entries))
+	}
+	if entries[1].Fields["suppressed"] != "99" {
+		t.Fatalf("Expected 99 suppressed, got %q", entries[1].Fields["suppressed"])
+	}
+}
+
+func TestAuditLogTornEntry(t *testing.T) {
+	dir := t.TempDir()
+	al, err := OpenAuditLog(dir)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	al.Record(auditServerStarted, nil)
+	al.Record(auditDevicePaired, map[string]string{"device": "iphone-1"})
+	al.Close()
+
+	// Simulate a crash halfway through writing an entry
+	f, _ := os.OpenFile(filepath.Join(dir, auditFileName), os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"seq":3,"event":"dev`)
+	f.Close()
+
+	al, err = OpenAuditLog(dir)
+	if err != nil {
+		t.Fatalf("Torn entry should not stop the log opening: %v", err)
+	}
+	defer al.Close()
+	al.Record(auditDeviceRevoked, map[string]string{"device": "iphone-1"})
+	if n, err := al.Verify(); err != nil || n != 3 {
+		t.Fatalf("Expected valid chain of 3, got %d: %v", n, err)
+	}
+}
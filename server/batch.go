@@ -0,0 +1,86 @@
+package main
+
+import "time"
+
+// maxBatchWindow bounds how long a client may ask deltas to be held
+const maxBatchWindow = 250 * time.Millisecond
+
+// BatchOptions controls how deltas after the first token are coalesced.
+// The defaults come from the stream config; clients may change them for
+// their session with the stream_options op.
+type BatchOptions struct {
+	WindowMs int `json:"window_ms"`
+	MaxBytes int `json:"max_bytes"`
+}
+
+func (o BatchOptions) window() time.Duration {
+	return time.Duration(o.WindowMs) * time.Millisecond
+}
+
+// negotiate applies a client request on top of def, clamped to the server
+// limits. A zero MaxBytes keeps the default.
+func (o BatchOptions) negotiate(def BatchOptions) BatchOptions {
+	out := def
+	out.WindowMs = o.WindowMs
+	if out.WindowMs < 0 {
+		out.WindowMs = 0
+	}
+	if max := int(maxBatchWindow / time.Millisecond); out.WindowMs > max {
+		out.WindowMs = max
+	}
+	if o.MaxBytes > 0 {
+		out.MaxBytes = o.MaxBytes
+	}
+	if out.MaxBytes > maxCoalescedBytes {
+		out.MaxBytes = maxCoalescedBytes
+	}
+	return out
+}
+
+// SetBatch changes the batching for streams started after it; nil only
+// reports the current options
+func (s *Session) SetBatch(req *BatchOptions) BatchOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req != nil {
+		o := req.negotiate(cfg().batchOptions())
+		s.batch = &o
+	}
+	if s.batch != nil {
+		return *s.batch
+	}
+	return cfg().batchOptions()
+}
+
+func (s *Session) batchOptions() BatchOptions {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.batch != nil {
+		return *s.batch
+	}
+	return cfg().batchOptions()
+}
+
+// armLocked schedules a flush at the end of the batch window. It must be
+// called with sendMu held.
+func (rs *RequestStream) armLocked() {
+	if rs.timer != nil {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(rs.batch.window(), func() {
+		rs.s.sendMu.Lock()
+		defer rs.s.sendMu.Unlock()
+		if rs.timer != t {
+			return
+		}
+		rs.timer = nil
+		// A congested channel flushes when it drains
+		if congested(rs.channel()) {
+			rs.s.held[rs] = struct{}{}
+			return
+		}
+		rs.flushLocked()
+	})
+	rs.timer = t
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sentDeltas returns the delta content emitted so far for requestID
+func sentDeltas(s *Session, requestID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []string
+	if r := s.pending.requests[requestID]; r != nil {
+		for _, m := range r.msgs {
+			if m.Op == "delta" {
+				out = append(out, m.Content)
+			}
+		}
+	}
+	return out
+}
+
+func TestDeltaBatching(t *testing.T) {
+	s := NewSession("s1", "dev-1", nil, nil)
+	s.SetBatch(&BatchOptions{WindowMs: 20, MaxBytes: 8})
+	rs := s.NewStream(context.Background(), "r1")
+
+	rs.Send(ServerMsg{Op: "delta", Content: "Hi"})
+	if got := sentDeltas(s, "r1"); len(got) != 1 {
+		t.Fatalf("first token held: %q", got)
+	}
+	rs.Send(ServerMsg{Op: "delta", Content: " th"})
+	rs.Send(ServerMsg{Op: "delta", Content: "ere"})
+	if got := sentDeltas(s, "r1"); len(got) != 1 {
+		t.Fatalf("batch sent before its window: %q", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := sentDeltas(s, "r1"); len(got) != 2 || got[1] != " there" {
+		t.Fatalf("window flush: %q", got)
+	}
+
+	// The byte budget flushes early, and done flushes the rest
+	rs.Send(ServerMsg{Op: "delta", Content: "12345678"})
+	rs.Send(ServerMsg{Op: "delta", Content: "9"})
+	rs.Send(ServerMsg{Op: "done"})
+	if got := sentDeltas(s, "r1"); strings.Join(got[2:], "|") != "12345678|9" {
+		t.Errorf("budget and done flush: %q", got)
+	}
+}
+
+func TestBatchNegotiation(t *testing.T) {
+	def := BatchOptions{WindowMs: 15, MaxBytes: 512}
+	for _, c := range []struct{ req, want BatchOptions }{
+		{BatchOptions{WindowMs: 40}, BatchOptions{WindowMs: 40, MaxBytes: 512}},
+		{BatchOptions{WindowMs: -1, MaxBytes: 64}, BatchOptions{WindowMs: 0, MaxBytes: 64}},
+		{BatchOptions{WindowMs: 10000, MaxBytes: 1 << 30}, BatchOptions{WindowMs: 250, MaxBytes: maxCoalescedBytes}},
+	} {
+		if got := c.req.negotiate(def); got != c.want {
+			t.Errorf("negotiate(%+v) = %+v, want %+v", c.req, got, c.want)
+		}
+	}
+}
+
+// BenchmarkDeltaBatching streams tokens at a steady rate through the
+// batching stage and reports messages per second and how long tokens wait
+// before being sent. Run with -benchtime=3x.
+func BenchmarkDeltaBatching(b *testing.B) {
+	const tokens, interval = 200, 2 * time.Millisecond
+	token := "tok_  "
+	for _, window := range []int{0, 5, 15, 50} {
+		b.Run(fmt.Sprintf("window=%dms", window), func(b *testing.B) {
+			var waited, worst, first, elapsed time.Duration
+			msgs := 0
+			for i := 0; i < b.N; i++ {
+				s := NewSession("bench", "dev", nil, nil)
+				s.SetBatch(&BatchOptions{WindowMs: window, MaxBytes: maxCoalescedBytes})
+				rs := s.NewStream(context.Background(), "r")
+
+				arrived := make([]time.Time, tokens)
+				sentAt := make([]time.Time, tokens)
+				stop := make(chan struct{})
+				polled := make(chan struct{})
+				// Watch for emitted deltas; tokens have a fixed width
+				go func() {
+					defer close(polled)
+					seen := 0
+					for {
+						n := len(strings.Join(sentDeltas(s, "r"), "")) / len(token)
+						for ; seen < n; seen++ {
+							sentAt[seen] = time.Now()
+						}
+						select {
+						case <-stop:
+							return
+						case <-time.After(100 * time.Microsecond):
+						}
+					}
+				}()
+
+				start := time.Now()
+				for k := 0; k < tokens; k++ {
+					arrived[k] = time.Now()
+					rs.Send(ServerMsg{Op: "delta", Content: token})
+					time.Sleep(interval)
+				}
+				rs.Send(ServerMsg{Op: "done"})
+				time.Sleep(time.Millisecond)
+				close(stop)
+				<-polled
+				elapsed += time.Since(start)
+
+				msgs += len(sentDeltas(s, "r"))
+				first += sentAt[0].Sub(arrived[0])
+				for k := range arrived {
+					d := sentAt[k].Sub(arrived[k])
+					waited += d
+					if d > worst {
+						worst = d
+					}
+				}
+			}
+			n := float64(b.N)
+			b.ReportMetric(float64(msgs)/elapsed.Seconds(), "msgs/s")
+			b.ReportMetric(float64(msgs)/n/tokens, "msgs/token")
+			b.ReportMetric(float64(first.Microseconds())/n/1000, "first-token-ms")
+			b.ReportMetric(float64(waited.Microseconds())/n/tokens/1000, "avg-wait-ms")
+			b.ReportMetric(float64(worst.Microseconds())/1000, "max-wait-ms")
+		})
+	}
+}
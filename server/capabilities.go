@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// capabilityVision is reported by /api/show for models that take images
+const capabilityVision = "vision"
+
+// capabilitiesTTL bounds how long a lookup is trusted; a model can be
+// re-pulled under the same name
+const capabilitiesTTL = 10 * time.Minute
+
+var ErrNoVisionModel = errors.New("no vision model available")
+
+// ModelCapabilities caches what Ollama's /api/show reports each model can do
+type ModelCapabilities struct {
+	baseURL string
+	client  *http.Client
+
+	mu    sync.Mutex
+	cache map[string]capabilitiesEntry
+}
+
+type capabilitiesEntry struct {
+	caps    []string
+	fetched time.Time
+}
+
+func NewModelCapabilities(baseURL string) *ModelCapabilities {
+	return &ModelCapabilities{
+		baseURL: baseURL,
+		client:  newEgressClient(10 * time.Second),
+		cache:   make(map[string]capabilitiesEntry),
+	}
+}
+
+// Supports reports whether model has capability. Ollama versions that do
+// not report capabilities count as supporting nothing.
+func (mc *ModelCapabilities) Supports(ctx context.Context, model, capability string) (bool, error) {
+	mc.mu.Lock()
+	e, ok := mc.cache[model]
+	mc.mu.Unlock()
+	if !ok || time.Since(e.fetched) > capabilitiesTTL {
+		caps, err := mc.fetch(ctx, model)
+		if err != nil {
+			return false, err
+		}
+		e = capabilitiesEntry{caps: caps, fetched: time.Now()}
+		mc.mu.Lock()
+		mc.cache[model] = e
+		mc.mu.Unlock()
+	}
+	return slices.Contains(e.caps, capability), nil
+}
+
+func (mc *ModelCapabilities) fetch(ctx context.Context, model string) ([]string, error) {
+	body, _ := json.Marshal(map[string]string{"model": model})
+	req, err := http.NewRequestWithContext(ctx, "POST", mc.baseURL+"/api/show", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := mc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama returned status %d for %s", resp.StatusCode, model)
+	}
+	var show struct {
+		Capabilities []string `json:"capabilities"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&show); err != nil {
+		return nil, err
+	}
+	return show.Capabilities, nil
+}
+
+// VisionModel picks the model for a chat with images. A model the client
+// named must support vision itself; otherwise the first vision model among
+// the routing's vision model, default model and tiers is used.
+func (mc *ModelCapabilities) VisionModel(ctx context.Context, requested string, rc RoutingConfig) (string, error) {
+	if requested != "" {
+		ok, err := mc.Supports(ctx, requested, capabilityVision)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("model %s does not accept images", requested)
+		}
+		return requested, nil
+	}
+	candidates := []string{rc.VisionModel, rc.DefaultModel}
+	for _, t := range rc.Tiers {
+		candidates = append(candidates, t.Model)
+	}
+	for _, m := range candidates {
+		if m == "" {
+			continue
+		}
+		// Models that are not installed are skipped, not fatal
+		if ok, err := mc.Supports(ctx, m, capabilityVision); err == nil && ok {
+			return m, nil
+		}
+	}
+	return "", ErrNoVisionModel
+}
+
+// activeModelCaps is replaced when a reload changes the Ollama URL
+var activeModelCaps atomic.Pointer[ModelCapabilities]
+
+func modelCaps() *ModelCapabilities { return activeModelCaps.Load() }
+
+func initModelCapabilities() {
+	activeModelCaps.Store(NewModelCapabilities(cfg().Ollama.URL))
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// A session uses one reliable, ordered control channel for the handshake,
+// hello, cancel, heartbeats and errors, and a small pool of stream channels
+// for generation output, so a long answer does not hold up pings and
+// cancels. Every channel is encrypted with the session's Noise keys. Output
+// goes to the control channel until a stream channel has opened.
+const (
+	controlChannelLabel = "control"
+	streamChannelLabel  = "stream"
+	streamChannelPool   = 2
+)
+
+const (
+	// codeCancelled ends a generation the client cancelled
+	codeCancelled = "cancelled"
+	// codeDuplicateRequest rejects a chat whose request_id is still running
+	codeDuplicateRequest = "duplicate_request"
+)
+
+var (
+	errRequestCancelled = errors.New("request cancelled by client")
+	ErrDuplicateRequest = errors.New("request_id is already in flight")
+)
+
+// addStreamChannelLocked must be called with mu held
+func (s *Session) addStreamChannelLocked(dc *webrtc.DataChannel) {
+	s.pool = append(s.pool, dc)
+	s.watchLocked(dc)
+}
+
+// AddStreamChannel adds an open stream channel of pc to the pool, unless
+// the session has since moved to another PeerConnection
+func (s *Session) AddStreamChannel(pc *webrtc.PeerConnection, dc *webrtc.DataChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pc == pc && !s.closed {
+		s.addStreamChannelLocked(dc)
+	}
+}
+
+// RemoveStreamChannel drops a closed stream channel; its requests move to
+// another one
+func (s *Session) RemoveStreamChannel(dc *webrtc.DataChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sc := range s.pool {
+		if sc == dc {
+			s.pool = append(s.pool[:i], s.pool[i+1:]...)
+			close(s.writable[dc])
+			delete(s.writable, dc)
+			return
+		}
+	}
+}
+
+// streamChannelLocked maps a request's slot to a channel of the current pool
+func (s *Session) streamChannelLocked(slot int) *webrtc.DataChannel {
+	if len(s.pool) == 0 {
+		return s.dc
+	}
+	return s.pool[slot%len(s.pool)]
+}
+
+// channelForLocked returns the channel request id sends on. A request keeps
+// its channel while that stays open, so its output arrives in order as the
+// pool grows; it is placed again by slot only when the channel closes or a
+// resume replaces the channels. It must be called with mu held for writing.
+func (s *Session) channelForLocked(id string, slot int) *webrtc.DataChannel {
+	if dc, ok := s.pinned[id]; ok && s.openLocked(dc) {
+		return dc
+	}
+	dc := s.streamChannelLocked(slot)
+	if dc != nil {
+		s.pinned[id] = dc
+	}
+	return dc
+}
+
+// openLocked reports whether dc is still one of the session's channels
+func (s *Session) openLocked(dc *webrtc.DataChannel) bool {
+	if dc == s.dc {
+		return true
+	}
+	for _, sc := range s.pool {
+		if sc == dc {
+			return true
+		}
+	}
+	return false
+}
+
+// channel returns the DataChannel the stream currently sends on
+func (rs *RequestStream) channel() *webrtc.DataChannel {
+	rs.s.mu.Lock()
+	defer rs.s.mu.Unlock()
+	return rs.s.channelForLocked(rs.id, rs.slot)
+}
+
+// sendOn encrypts like Send but on one of the session's other channels
+func (s *Session) sendOn(dc *webrtc.DataChannel, msg ServerMsg) error {
+	s.mu.RLock()
+	e2e, enc := s.e2e, s.enc
+	s.mu.RUnlock()
+	if dc == nil {
+		return nil
+	}
+	err := sendMessage(dc, s.ID, msg, e2e, enc)
+	if err != nil {
+		logger.Debug("send failed", logKeySession, s.ID, "op", msg.Op, "error", err)
+	}
+	return err
+}
+
+// TrackRequest derives a context the client can cancel by request ID. The
+// returned func releases it when the generation ends. A request ID may only
+// be in flight once, since cancels and resume buffers are keyed by it.
+func (s *Session) TrackRequest(ctx context.Context, requestID string) (context.Context, func(), error) {
+	s.mu.Lock()
+	if _, running := s.cancels[requestID]; running {
+		s.mu.Unlock()
+		return nil, nil, ErrDuplicateRequest
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	s.cancels[requestID] = cancel
+	s.mu.Unlock()
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.cancels, requestID)
+		s.mu.Unlock()
+		cancel(nil)
+	}, nil
+}
+
+// CancelRequest stops a running generation; false if there is none
+func (s *Session) CancelRequest(requestID string) bool {
+	s.mu.Lock()
+	cancel, ok := s.cancels[requestID]
+	s.mu.Unlock()
+	if ok {
+		cancel(errRequestCancelled)
+	}
+	return ok
+}
+
+// Who creates a session's DataChannels, chosen by the client in its offer.
+// The offer needs an application m-line in every mode.
+const (
+	// channelsServer: the server creates control and the stream pool
+	channelsServer = "server"
+	// channelsClient: the client creates them; the server accepts them
+	// through OnDataChannel
+	channelsClient = "client"
+	// channelsNegotiated: both sides create them with pre-agreed IDs,
+	// control on negotiatedControlID and streams on the IDs after it
+	channelsNegotiated = "negotiated"
+)
+
+const (
+	negotiatedControlID = 0
+	// legacyChannelLabel is accepted as the control channel from clients
+	// that predate the split
+	legacyChannelLabel = "llm"
+	// maxStreamChannels bounds the stream channels a client may open
+	maxStreamChannels = 8
+)
+
+var ErrUnexpectedChannel = errors.New("unexpected data channel")
+
+// offerChannelMode validates the channel mode and that the offer can carry
+// DataChannels at all. Offers without a mode come from clients that predate
+// it, which open their own "llm" channel, so they get client mode.
+func offerChannelMode(off Offer) (string, error) {
+	mode := off.Channels
+	switch mode {
+	case "":
+		mode = channelsClient
+	case channelsServer, channelsClient, channelsNegotiated:
+	default:
+		return "", fmt.Errorf("unknown channels mode %q", off.Channels)
+	}
+	if !strings.Contains(off.SDP, "m=application") {
+		return "", errors.New("offer has no application m-line; create a data channel before the offer")
+	}
+	return mode, nil
+}
+
+// channelSet checks the channels a client opens on one PeerConnection
+type channelSet struct {
+	mu      sync.Mutex
+	mode    string
+	control bool
+	streams int
+}
+
+// accept returns the role of a client-created channel, controlChannelLabel
+// or streamChannelLabel
+func (cs *channelSet) accept(label string, ordered, reliable bool) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.mode != channelsClient {
+		return "", fmt.Errorf("%w %q: channels are %s-created", ErrUnexpectedChannel, label, cs.mode)
+	}
+	if !ordered || !reliable {
+		return "", fmt.Errorf("%w %q: must be reliable and ordered", ErrUnexpectedChannel, label)
+	}
+	switch label {
+	case controlChannelLabel, legacyChannelLabel:
+		if cs.control {
+			return "", fmt.Errorf("%w %q: control channel already open", ErrUnexpectedChannel, label)
+		}
+		cs.control = true
+		return controlChannelLabel, nil
+	case streamChannelLabel:
+		if cs.streams >= maxStreamChannels {
+			return "", fmt.Errorf("%w %q: more than %d stream channels", ErrUnexpectedChannel, label, maxStreamChannels)
+		}
+		cs.streams++
+		return streamChannelLabel, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnexpectedChannel, label)
+}
+
+// openChannels sets up the session's channels for mode. Channels the client
+// opens go through a channelSet and are closed if they are not expected.
+func openChannels(pc *webrtc.PeerConnection, mode string, onControl, onStream func(*webrtc.DataChannel), log *slog.Logger) error {
+	set := &channelSet{mode: mode}
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		reliable := dc.MaxRetransmits() == nil && dc.MaxPacketLifeTime() == nil
+		role, err := set.accept(dc.Label(), dc.Ordered(), reliable)
+		if err != nil {
+			log.Warn("refusing data channel", "error", err)
+			dc.Close()
+			return
+		}
+		if role == controlChannelLabel {
+			onControl(dc)
+		} else {
+			onStream(dc)
+		}
+	})
+	if mode == channelsClient {
+		return nil
+	}
+
+	init := func(id uint16) *webrtc.DataChannelInit {
+		if mode != channelsNegotiated {
+			return nil
+		}
+		negotiated := true
+		return &webrtc.DataChannelInit{Negotiated: &negotiated, ID: &id}
+	}
+	dc, err := pc.CreateDataChannel(controlChannelLabel, init(negotiatedControlID))
+	if err != nil {
+		return err
+	}
+	onControl(dc)
+	for i := 0; i < streamChannelPool; i++ {
+		sc, err := pc.CreateDataChannel(streamChannelLabel, init(negotiatedControlID+1+uint16(i)))
+		if err != nil {
+			return err
+		}
+		onStream(sc)
+	}
+	return nil
+}
+
+// SetControl makes dc the control channel, unless the session has since
+// moved to another PeerConnection
+func (s *Session) SetControl(pc *webrtc.PeerConnection, dc *webrtc.DataChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pc == pc && !s.closed {
+		s.dc = dc
+		s.watchLocked(dc)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestCancelRequest(t *testing.T) {
+	s := NewSession("s1", "dev-1", nil, nil)
+	ctx, release, err := s.TrackRequest(context.Background(), "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.TrackRequest(context.Background(), "r1"); err != ErrDuplicateRequest {
+		t.Fatalf("Expected ErrDuplicateRequest for a running request ID, got %v", err)
+	}
+	if !s.CancelRequest("r1") || ctx.Err() == nil {
+		t.Fatal("request not cancelled")
+	}
+	if shutdownCode(ctx) != codeCancelled {
+		t.Errorf("code = %q, want %q", shutdownCode(ctx), codeCancelled)
+	}
+	release()
+	if s.CancelRequest("r1") {
+		t.Error("released request still cancellable")
+	}
+	if _, release, err := s.TrackRequest(context.Background(), "r1"); err != nil {
+		t.Errorf("Request ID should be reusable once released: %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestStreamChannelSlots(t *testing.T) {
+	s := NewSession("s1", "dev-1", nil, nil)
+	control, a, b := &webrtc.DataChannel{}, &webrtc.DataChannel{}, &webrtc.DataChannel{}
+	s.dc = control
+	if got := s.streamChannelLocked(3); got != control {
+		t.Error("output should use the control channel until a stream channel opens")
+	}
+	s.pool = []*webrtc.DataChannel{a, b}
+	if s.streamChannelLocked(0) != a || s.streamChannelLocked(1) != b || s.streamChannelLocked(2) != a {
+		t.Error("requests not spread over the pool")
+	}
+	s.pool = s.pool[1:]
+	if s.streamChannelLocked(0) != b {
+		t.Error("request not moved off a closed channel")
+	}
+}
+
+func TestStreamChannelPinned(t *testing.T) {
+	s := NewSession("s1", "dev-1", nil, nil)
+	control, a, b := &webrtc.DataChannel{}, &webrtc.DataChannel{}, &webrtc.DataChannel{}
+	s.dc = control
+	s.pool = []*webrtc.DataChannel{a}
+	if s.channelForLocked("r1", 1) != a {
+		t.Fatal("request not placed on the only stream channel")
+	}
+	// A second channel opening must not move a running request
+	s.pool = append(s.pool, b)
+	if s.channelForLocked("r1", 1) != a {
+		t.Error("request moved mid-stream when the pool grew")
+	}
+	s.pool = s.pool[1:]
+	if s.channelForLocked("r1", 1) != b {
+		t.Error("request not moved off a closed channel")
+	}
+}
+
+func TestOfferChannelMode(t *testing.T) {
+	sdp := "v=0\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n"
+	for _, tc := range []struct {
+		off  Offer
+		want string
+		ok   bool
+	}{
+		{Offer{SDP: sdp}, channelsClient, true},
+		{Offer{SDP: sdp, Channels: "server"}, channelsServer, true},
+		{Offer{SDP: sdp, Channels: "client"}, channelsClient, true},
+		{Offer{SDP: sdp, Channels: "negotiated"}, channelsNegotiated, true},
+		{Offer{SDP: sdp, Channels: "both"}, "", false},
+		{Offer{SDP: "v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\n"}, "", false},
+	} {
+		got, err := offerChannelMode(tc.off)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("offerChannelMode(%q) = %q, %v", tc.off.Channels, got, err)
+		}
+	}
+}
+
+func TestChannelSetAccept(t *testing.T) {
+	server := &channelSet{mode: channelsServer}
+	if _, err := server.accept(controlChannelLabel, true, true); !errors.Is(err, ErrUnexpectedChannel) {
+		t.Errorf("server mode accepted a client channel: %v", err)
+	}
+
+	cs := &channelSet{mode: channelsClient}
+	if role, err := cs.accept(legacyChannelLabel, true, true); err != nil || role != controlChannelLabel {
+		t.Fatalf("legacy label: %q, %v", role, err)
+	}
+	if _, err := cs.accept(controlChannelLabel, true, true); err == nil {
+		t.Error("second control channel accepted")
+	}
+	if _, err := cs.accept(streamChannelLabel, false, true); err == nil {
+		t.Error("unordered channel accepted")
+	}
+	if _, err := cs.accept("debug", true, true); err == nil {
+		t.Error("unknown label accepted")
+	}
+	for i := 0; i < maxStreamChannels; i++ {
+		if role, err := cs.accept(streamChannelLabel, true, true); err != nil || role != streamChannelLabel {
+			t.Fatalf("stream %d: %q, %v", i, role, err)
+		}
+	}
+	if _, err := cs.accept(streamChannelLabel, true, true); err == nil {
+		t.Error("stream channel over the limit accepted")
+	}
+}
+
+// TestLegacyClientOffer does what the iOS app does: one ordered "llm"
+// channel created before the offer, and a body with only the SDP
+func TestLegacyClientOffer(t *testing.T) {
+	var off Offer
+	body := `{"sdp": "v=0\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n"}`
+	if err := json.Unmarshal([]byte(body), &off); err != nil {
+		t.Fatal(err)
+	}
+	mode, err := offerChannelMode(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &channelSet{mode: mode}
+	if role, err := cs.accept(legacyChannelLabel, true, true); err != nil || role != controlChannelLabel {
+		t.Errorf("llm channel: %q, %v", role, err)
+	}
+}
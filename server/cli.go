@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const cliUsage = `usage: quicpair-server <command> [flags]
+
+commands:
+  serve                       run the server (default when no command is given)
+  pair                        print a pairing QR code and wait for a phone
+  devices list                list paired devices
+  devices revoke <id>         revoke a paired device
+  keys show-fingerprint       print the Noise and TLS key fingerprints
+  keys rotate [-grace 168h]   rotate the Noise static key, announcing it to devices
+  apikeys list                list API keys and their usage
+  apikeys issue [flags]       issue an API key; the secret is printed once
+  apikeys revoke <id>         revoke an API key
+  models list                 list models installed in Ollama
+  models pull <name>          download a model into Ollama
+  doctor                      check Ollama, ICE, strict local mode and the key store
+  config check                validate the configuration file
+  admin <method> [json]       call an admin socket method, e.g. sessions.list
+
+Every command accepts -config and the configuration override flags. pair,
+devices, keys, apikeys and models talk to the running server over its admin
+socket.
+`
+
+// runCLI dispatches to a subcommand and returns the exit code. Running the
+// binary with no command, or with only flags, starts the server as before.
+func runCLI(args []string) int {
+	cmd, rest := "serve", args
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, rest = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		return serve(rest)
+	case "config":
+		return runConfigCommand(rest)
+	case "pair":
+		return runPairCommand(rest)
+	case "devices":
+		return runDevicesCommand(rest)
+	case "keys":
+		return runKeysCommand(rest)
+	case "apikeys":
+		return runAPIKeysCommand(rest)
+	case "models":
+		return runModelsCommand(rest)
+	case "doctor":
+		return runDoctorCommand(rest)
+	case "admin":
+		return runAdminCommand(rest)
+	case "help":
+		fmt.Print(cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, cliUsage)
+		return 2
+	}
+}
+
+// loadCLIConfig parses configuration flags for a client command, loads the
+// configuration so the data directory and admin socket can be found, and
+// returns the remaining positional arguments
+func loadCLIConfig(fs *flag.FlagSet, args []string) ([]string, bool) {
+	path, flags := parseConfigFlags(fs, args)
+	c, err := LoadConfig(path, flags)
+	if err != nil {
+		printConfigError(path, err)
+		return nil, false
+	}
+	settings.Store(c)
+	settingsPath = path
+	return fs.Args(), true
+}
+
+// adminCall runs one method on the running server's admin socket
+func adminCall(method string, params, result interface{}) error {
+	c, err := DialAdmin(adminSocketPath())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Call(method, params, result)
+}
+
+func cliError(err error) int {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	return 1
+}
+
+// splitAction takes the action word from "devices list" style commands
+func splitAction(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", args
+	}
+	return args[0], args[1:]
+}
+
+func runPairCommand(args []string) int {
+	if _, ok := loadCLIConfig(flag.NewFlagSet("pair", flag.ExitOnError), args); !ok {
+		return 1
+	}
+	c, err := DialAdmin(adminSocketPath())
+	if err != nil {
+		return cliError(err)
+	}
+	defer c.Close()
+
+	var p PairingPayload
+	if err := c.Call("pairing.start", nil, &p); err != nil {
+		return cliError(err)
+	}
+	data, _ := json.Marshal(p)
+	qr, err := qrcode.New(string(data), qrcode.Low)
+	if err != nil {
+		return cliError(err)
+	}
+	fmt.Print(qr.ToSmallString(false))
+	fmt.Printf("Scan with the QuicPair app. Code expires at %s.\n", p.PairCodeExpires.Local().Format("15:04:05"))
+	if p.TLSFingerprint != "" {
+		fmt.Printf("TLS fingerprint: %s\n", p.TLSFingerprint)
+	}
+	fmt.Println("Waiting for a device to pair...")
+
+	var d Device
+	if err := c.Call("pairing.wait", map[string]string{"code": p.PairCode}, &d); err != nil {
+		return cliError(err)
+	}
+	fmt.Printf("Paired %q (%s)\n", d.Name, d.ID)
+	return 0
+}
+
+func runDevicesCommand(args []string) int {
+	action, rest := splitAction(args)
+	rest, ok := loadCLIConfig(flag.NewFlagSet("devices "+action, flag.ExitOnError), rest)
+	if !ok {
+		return 1
+	}
+	switch action {
+	case "list":
+		var list []Device
+		if err := adminCall("devices.list", nil, &list); err != nil {
+			return cliError(err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPAIRED\tLAST SEEN\tSTATUS")
+		for _, d := range list {
+			status := "active"
+			if d.Revoked {
+				status = "revoked"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.ID, d.Name, formatCLITime(d.PairedAt), formatCLITime(d.LastSeen), status)
+		}
+		tw.Flush()
+		return 0
+	case "revoke":
+		if len(rest) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: quicpair-server devices revoke <id>")
+			return 2
+		}
+		if err := adminCall("devices.revoke", map[string]string{"id": rest[0]}, nil); err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("revoked %s\n", rest[0])
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, "usage: quicpair-server devices list|revoke <id>")
+		return 2
+	}
+}
+
+func runAPIKeysCommand(args []string) int {
+	action, rest := splitAction(args)
+	fs := flag.NewFlagSet("apikeys "+action, flag.ExitOnError)
+	name := fs.String("name", "", "label for the key")
+	scopes := fs.String("scopes", scopeChat, "comma-separated scopes: chat, models, admin")
+	models := fs.String("models", "", "comma-separated models the key may use (default all)")
+	expires := fs.String("expires", "", "lifetime such as 720h (default never)")
+	rest, ok := loadCLIConfig(fs, rest)
+	if !ok {
+		return 1
+	}
+	switch action {
+	case "list":
+		var list []APIKey
+		if err := adminCall("apikeys.list", nil, &list); err != nil {
+			return cliError(err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tEXPIRES\tREQUESTS\tSTATUS")
+		for _, k := range list {
+			status := "active"
+			if k.Revoked {
+				status = "revoked"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", k.ID, k.Name, strings.Join(k.Scopes, ","), formatCLITime(k.ExpiresAt), k.Usage.Requests, status)
+		}
+		tw.Flush()
+		return 0
+	case "issue":
+		params := map[string]interface{}{
+			"name":       *name,
+			"scopes":     splitList(*scopes),
+			"expires_in": *expires,
+		}
+		if *models != "" {
+			params["allowed_models"] = splitList(*models)
+		}
+		var res struct {
+			Key    APIKey `json:"key"`
+			Secret string `json:"api_key"`
+		}
+		if err := adminCall("apikeys.issue", params, &res); err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("issued %s (%s)\n%s\n", res.Key.ID, strings.Join(res.Key.Scopes, ","), res.Secret)
+		return 0
+	case "revoke":
+		if len(rest) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: quicpair-server apikeys revoke <id>")
+			return 2
+		}
+		if err := adminCall("apikeys.revoke", map[string]string{"id": rest[0]}, nil); err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("revoked %s\n", rest[0])
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, "usage: quicpair-server apikeys list|issue [-name n -scopes chat,models -models m -expires 720h]|revoke <id>")
+		return 2
+	}
+}
+
+func runKeysCommand(args []string) int {
+	action, rest := splitAction(args)
+	fs := flag.NewFlagSet("keys "+action, flag.ExitOnError)
+	grace := fs.String("grace", "", "keep accepting the old key for this long (default noise.rotation_grace)")
+	if _, ok := loadCLIConfig(fs, rest); !ok {
+		return 1
+	}
+	var res struct {
+		Noise struct {
+			PublicKey     string    `json:"public_key"`
+			KeyID         string    `json:"key_id"`
+			SigningKey    string    `json:"signing_key"`
+			NextKeyID     string    `json:"next_key_id"`
+			State         string    `json:"state"`
+			PreviousKeyID string    `json:"previous_key_id"`
+			PreviousUntil time.Time `json:"previous_valid_until"`
+		} `json:"noise"`
+		TLSMode        string `json:"tls_mode"`
+		TLSFingerprint string `json:"tls_spki_sha256"`
+		Announced      int    `json:"announced"`
+	}
+	switch action {
+	case "show-fingerprint":
+		if err := adminCall("keys.fingerprint", nil, &res); err != nil {
+			return cliError(err)
+		}
+	case "rotate":
+		if err := adminCall("keys.rotate", map[string]string{"grace": *grace}, &res); err != nil {
+			return cliError(err)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: quicpair-server keys rotate [-grace 168h]|show-fingerprint")
+		return 2
+	}
+	n := res.Noise
+	fmt.Printf("noise public key:  %s\n", n.PublicKey)
+	fmt.Printf("noise key id:      %s (next %s)\n", n.KeyID, n.NextKeyID)
+	fmt.Printf("noise signing key: %s\n", n.SigningKey)
+	if n.State == "grace" {
+		fmt.Printf("previous key %s accepted until %s\n", n.PreviousKeyID, formatCLITime(n.PreviousUntil))
+	}
+	if res.TLSFingerprint != "" {
+		fmt.Printf("tls spki sha256:   %s (%s)\n", res.TLSFingerprint, res.TLSMode)
+	}
+	if action == "rotate" {
+		fmt.Printf("announced to %d connected devices; others pick up the new key before the grace period ends or re-pair\n", res.Announced)
+	}
+	return 0
+}
+
+func runModelsCommand(args []string) int {
+	action, rest := splitAction(args)
+	rest, ok := loadCLIConfig(flag.NewFlagSet("models "+action, flag.ExitOnError), rest)
+	if !ok {
+		return 1
+	}
+	switch action {
+	case "list":
+		var models []struct {
+			Name       string    `json:"name"`
+			Size       int64     `json:"size"`
+			ModifiedAt time.Time `json:"modified_at"`
+		}
+		if err := adminCall("models.list", nil, &models); err != nil {
+			return cliError(err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSIZE\tMODIFIED")
+		for _, m := range models {
+			fmt.Fprintf(tw, "%s\t%.1f GB\t%s\n", m.Name, float64(m.Size)/1e9, formatCLITime(m.ModifiedAt))
+		}
+		tw.Flush()
+		return 0
+	case "pull":
+		if len(rest) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: quicpair-server models pull <name>")
+			return 2
+		}
+		fmt.Printf("pulling %s...\n", rest[0])
+		var res map[string]string
+		if err := adminCall("models.pull", map[string]string{"name": rest[0]}, &res); err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("%s: %s\n", rest[0], res["status"])
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, "usage: quicpair-server models list|pull <name>")
+		return 2
+	}
+}
+
+// runAdminCommand calls any admin socket method and prints the JSON result
+func runAdminCommand(args []string) int {
+	rest, ok := loadCLIConfig(flag.NewFlagSet("admin", flag.ExitOnError), args)
+	if !ok {
+		return 1
+	}
+	if len(rest) == 0 || len(rest) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: quicpair-server admin <method> ['{\"param\": ...}']")
+		return 2
+	}
+	var params interface{}
+	if len(rest) == 2 {
+		params = json.RawMessage(rest[1])
+		if !json.Valid(params.(json.RawMessage)) {
+			fmt.Fprintln(os.Stderr, "params must be a JSON object")
+			return 2
+		}
+	}
+	var result json.RawMessage
+	if err := adminCall(rest[0], params, &result); err != nil {
+		return cliError(err)
+	}
+	var out bytes.Buffer
+	json.Indent(&out, result, "", "  ")
+	fmt.Println(out.String())
+	return 0
+}
+
+func formatCLITime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// Doctor check results
+const (
+	doctorOK   = "ok"
+	doctorWarn = "warn"
+	doctorFail = "FAIL"
+)
+
+type doctorResult struct {
+	Check  string
+	Status string
+	Detail string
+}
+
+// runDoctorCommand checks the local installation without needing the server
+// to be running, and exits non-zero if any check fails
+func runDoctorCommand(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	path, flags := parseConfigFlags(fs, args)
+	c, err := LoadConfig(path, flags)
+	if err != nil {
+		printConfigError(path, err)
+		fmt.Printf("%-4s  config: %s is invalid\n", doctorFail, path)
+		return 1
+	}
+	settings.Store(c)
+
+	results := append([]doctorResult{{"config", doctorOK, path}}, runDoctor(c)...)
+	code := 0
+	for _, r := range results {
+		fmt.Printf("%-4s  %s: %s\n", r.Status, r.Check, r.Detail)
+		if r.Status == doctorFail {
+			code = 1
+		}
+	}
+	return code
+}
+
+func runDoctor(c *Config) []doctorResult {
+	var out []doctorResult
+	out = append(out, doctorOllama(c))
+	out = append(out, doctorICE(c)...)
+	out = append(out, doctorStrictLocal(c))
+	out = append(out, doctorKeyStore(filepath.Join(c.DataDir, "keys"))...)
+	out = append(out, doctorServer(filepath.Join(c.DataDir, adminSocketName)))
+	return out
+}
+
+func doctorOllama(c *Config) doctorResult {
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Get(c.Ollama.URL + "/api/tags")
+	if err != nil {
+		return doctorResult{"ollama", doctorFail, fmt.Sprintf("%s unreachable: %v", c.Ollama.URL, err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return doctorResult{"ollama", doctorFail, fmt.Sprintf("%s returned %s", c.Ollama.URL, resp.Status)}
+	}
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&tags); err != nil {
+		return doctorResult{"ollama", doctorFail, "unexpected response from /api/tags: " + err.Error()}
+	}
+	want := c.Ollama.Routing.DefaultModel
+	for _, m := range tags.Models {
+		if m.Name == want || strings.TrimSuffix(m.Name, ":latest") == want {
+			return doctorResult{"ollama", doctorOK, fmt.Sprintf("%s, %d models, default %s installed", c.Ollama.URL, len(tags.Models), want)}
+		}
+	}
+	return doctorResult{"ollama", doctorWarn, fmt.Sprintf("%s reachable but default model %s is not installed (run: models pull %s)", c.Ollama.URL, want, want)}
+}
+
+func doctorICE(c *Config) []doctorResult {
+	urls := append(append([]string{}, c.ICE.STUNURLs...), c.ICE.TURN.URLs...)
+	if len(urls) == 0 {
+		return []doctorResult{{"ice", doctorOK, "no STUN/TURN servers; host candidates only (LAN or Tailscale)"}}
+	}
+	policy, err := NewNetPolicy(append(append([]string{}, defaultAllowCIDRs...), c.StrictLocal.AllowCIDRs...), c.StrictLocal.DenyCIDRs, false)
+	if err != nil {
+		return []doctorResult{{"ice", doctorFail, err.Error()}}
+	}
+	guard := NewEgressGuard(c.StrictLocal.EgressAllowHosts)
+	var out []doctorResult
+	for _, u := range urls {
+		host := iceURLHost(u)
+		ip := net.ParseIP(host)
+		if ip == nil && c.StrictLocal.Enabled && !guard.isLocalName(host) {
+			// Don't leak a lookup the server itself would refuse
+			out = append(out, doctorResult{"ice", doctorWarn, fmt.Sprintf("%s is an external name; ICE servers are contacted outside the egress guard", u)})
+			continue
+		}
+		if ip == nil {
+			addrs, err := net.LookupIP(host)
+			if err != nil {
+				out = append(out, doctorResult{"ice", doctorFail, fmt.Sprintf("%s: cannot resolve %s: %v", u, host, err)})
+				continue
+			}
+			ip = addrs[0]
+		}
+		if c.StrictLocal.Enabled && !policy.Allowed(ip) {
+			out = append(out, doctorResult{"ice", doctorWarn, fmt.Sprintf("%s (%s) is outside the strict local ranges", u, ip)})
+		} else {
+			out = append(out, doctorResult{"ice", doctorOK, fmt.Sprintf("%s (%s)", u, ip)})
+		}
+	}
+	return out
+}
+
+// iceURLHost extracts the host from stun:host:port or turn:host?transport=udp
+func iceURLHost(u string) string {
+	rest := u
+	if i := strings.Index(rest, ":"); i >= 0 {
+		rest = rest[i+1:]
+	}
+	rest = strings.TrimPrefix(rest, "//")
+	if i := strings.IndexAny(rest, "?"); i >= 0 {
+		rest = rest[:i]
+	}
+	if h, _, err := net.SplitHostPort(rest); err == nil {
+		return h
+	}
+	return strings.Trim(rest, "[]")
+}
+
+func doctorStrictLocal(c *Config) doctorResult {
+	sl := c.StrictLocal
+	switch {
+	case !sl.Enabled:
+		return doctorResult{"strict_local", doctorWarn, "disabled; peers and outbound connections are not restricted"}
+	case sl.DryRun:
+		return doctorResult{"strict_local", doctorWarn, "dry-run; violations are logged but allowed"}
+	}
+	u, _ := url.Parse(c.Ollama.URL)
+	return doctorResult{"strict_local", doctorOK, fmt.Sprintf("enforced, %d extra allow and %d deny ranges, ollama at %s",
+		len(sl.AllowCIDRs), len(sl.DenyCIDRs), u.Host)}
+}
+
+// doctorKeyStore checks the key directory is owner-only and reports keys
+// that will be created on first start
+func doctorKeyStore(dir string) []doctorResult {
+	fi, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []doctorResult{{"keystore", doctorWarn, dir + " does not exist yet; it is created on first start"}}
+	}
+	if err != nil {
+		return []doctorResult{{"keystore", doctorFail, err.Error()}}
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return []doctorResult{{"keystore", doctorFail, fmt.Sprintf("%s is %v; must be 0700", dir, fi.Mode().Perm())}}
+	}
+	out := []doctorResult{{"keystore", doctorOK, dir}}
+	for _, name := range []string{tlsKeyName, tokenKeyName} {
+		p := filepath.Join(dir, name)
+		fi, err := os.Stat(p)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			out = append(out, doctorResult{"keystore", doctorWarn, name + " missing; it is created on first start"})
+		case err != nil:
+			out = append(out, doctorResult{"keystore", doctorFail, err.Error()})
+		case fi.Mode().Perm()&0077 != 0:
+			out = append(out, doctorResult{"keystore", doctorFail, fmt.Sprintf("%s is %v; must be 0600", p, fi.Mode().Perm())})
+		}
+	}
+	return out
+}
+
+func doctorServer(socket string) doctorResult {
+	c, err := DialAdmin(socket)
+	if err != nil {
+		return doctorResult{"server", doctorWarn, "not running (no admin socket at " + socket + ")"}
+	}
+	defer c.Close()
+	var st map[string]interface{}
+	if err := c.Call("server.status", nil, &st); err != nil {
+		return doctorResult{"server", doctorFail, err.Error()}
+	}
+	return doctorResult{"server", doctorOK, fmt.Sprintf("running, pid %v, up %v, %v sessions", st["pid"], st["uptime"], st["sessions"])}
+}
@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration. Values are layered: built-in
+// defaults, then the YAML file, then environment variables, then flags.
+type Config struct {
+	Listen          string `yaml:"listen" json:"listen"`
+	DataDir         string `yaml:"data_dir" json:"data_dir"`
+	ShutdownTimeout string `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+
+	Dev         DevConfig         `yaml:"dev" json:"dev"`
+	StrictLocal StrictLocalConfig `yaml:"strict_local" json:"strict_local"`
+	TLS         TLSConfig         `yaml:"tls" json:"tls"`
+	Ollama      OllamaConfig      `yaml:"ollama" json:"ollama"`
+	ICE         ICEConfig         `yaml:"ice" json:"ice"`
+	CORS        CORSConfig        `yaml:"cors" json:"cors"`
+	Log         LogConfig         `yaml:"log" json:"log"`
+	Noise       NoiseConfig       `yaml:"noise" json:"noise"`
+	Stream      StreamConfig      `yaml:"stream" json:"stream"`
+	Tools       ToolsConfig       `yaml:"tools" json:"tools"`
+}
+
+type DevConfig struct {
+	Enabled        bool `yaml:"enabled" json:"enabled"`
+	AllowPlaintext bool `yaml:"allow_plaintext" json:"allow_plaintext"`
+	AllowUnpaired  bool `yaml:"allow_unpaired" json:"allow_unpaired"`
+}
+
+type StrictLocalConfig struct {
+	Enabled          bool     `yaml:"enabled" json:"enabled"`
+	AllowCIDRs       []string `yaml:"allow_cidrs" json:"allow_cidrs"`
+	DenyCIDRs        []string `yaml:"deny_cidrs" json:"deny_cidrs"`
+	DryRun           bool     `yaml:"dry_run" json:"dry_run"`
+	EgressAllowHosts []string `yaml:"egress_allow_hosts" json:"egress_allow_hosts"`
+}
+
+type TLSConfig struct {
+	Mode        string   `yaml:"mode" json:"mode"`
+	CertFile    string   `yaml:"cert_file" json:"cert_file"`
+	KeyFile     string   `yaml:"key_file" json:"key_file"`
+	ACMEDomains []string `yaml:"acme_domains" json:"acme_domains"`
+	ACMEEmail   string   `yaml:"acme_email" json:"acme_email"`
+	// ACMEChallengeListen answers TLS-ALPN-01 challenges; the CA connects
+	// to port 443 of each domain
+	ACMEChallengeListen string `yaml:"acme_challenge_listen" json:"acme_challenge_listen"`
+}
+
+type OllamaConfig struct {
+	URL          string        `yaml:"url" json:"url"`
+	WarmupModels []string      `yaml:"warmup_models" json:"warmup_models"`
+	Routing      RoutingConfig `yaml:"routing" json:"routing"`
+}
+
+type ICEConfig struct {
+	STUNURLs []string   `yaml:"stun_urls" json:"stun_urls"`
+	TURN     TURNConfig `yaml:"turn" json:"turn"`
+}
+
+type TURNConfig struct {
+	URLs     []string `yaml:"urls" json:"urls"`
+	Username string   `yaml:"username" json:"username"`
+	Password string   `yaml:"password" json:"password"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins  []string `yaml:"allowed_origins" json:"allowed_origins"`
+	AllowLocal      bool     `yaml:"allow_local" json:"allow_local"`
+	AllowNullOrigin bool     `yaml:"allow_null_origin" json:"allow_null_origin"`
+}
+
+type NoiseConfig struct {
+	// RotationGrace is how long the previous static key is still accepted
+	// after a rotation
+	RotationGrace string `yaml:"rotation_grace" json:"rotation_grace"`
+}
+
+// StreamConfig sets the default delta batching; clients may change it per
+// session with the stream_options op
+type StreamConfig struct {
+	// BatchWindow is how long deltas after the first are held to be sent
+	// together; 0 sends every token on its own
+	BatchWindow string `yaml:"batch_window" json:"batch_window"`
+	// BatchBytes sends a batch early once it holds this much content
+	BatchBytes int `yaml:"batch_bytes" json:"batch_bytes"`
+}
+
+// ToolsConfig sets up the tools a chat may offer the model
+type ToolsConfig struct {
+	// MaxRounds bounds the model/tool round trips of one chat
+	MaxRounds int `yaml:"max_rounds" json:"max_rounds"`
+	// FileSearchRoots enables file_search over these directories
+	FileSearchRoots []string         `yaml:"file_search_roots" json:"file_search_roots"`
+	HTTP            []HTTPToolConfig `yaml:"http" json:"http"`
+}
+
+// HTTPToolConfig is a tool served by a local HTTP endpoint, which receives
+// the call's arguments as a JSON POST
+type HTTPToolConfig struct {
+	Name        string                 `yaml:"name" json:"name"`
+	Description string                 `yaml:"description" json:"description"`
+	URL         string                 `yaml:"url" json:"url"`
+	Parameters  map[string]interface{} `yaml:"parameters" json:"parameters"`
+	// Sensitive tools need approval on the device for every call
+	Sensitive bool `yaml:"sensitive" json:"sensitive"`
+}
+
+type LogConfig struct {
+	Level    string `yaml:"level" json:"level"`
+	JSONPath string `yaml:"json_path" json:"json_path"`
+}
+
+// RouteTier routes prompts up to MaxPromptLen characters to Model. A zero
+// MaxPromptLen matches any length and belongs last.
+type RouteTier struct {
+	MaxPromptLen int    `yaml:"max_prompt_len" json:"max_prompt_len"`
+	Model        string `yaml:"model" json:"model"`
+}
+
+// RoutingConfig picks the model for a chat when the client leaves it open
+type RoutingConfig struct {
+	DefaultModel string      `yaml:"default_model" json:"default_model"`
+	Tiers        []RouteTier `yaml:"tiers" json:"tiers"`
+	// VisionModel is tried first for chats with images
+	VisionModel string `yaml:"vision_model" json:"vision_model"`
+}
+
+// ModelFor returns the tier model for a prompt length
+func (rc RoutingConfig) ModelFor(promptLen int) string {
+	for _, t := range rc.Tiers {
+		if t.MaxPromptLen == 0 || promptLen < t.MaxPromptLen {
+			return t.Model
+		}
+	}
+	return rc.DefaultModel
+}
+
+var defaultRouteTiers = []RouteTier{
+	{MaxPromptLen: 20, Model: "smollm2:135m"}, // very short prompts
+	{MaxPromptLen: 50, Model: "gemma3:270m"},
+	{MaxPromptLen: 100, Model: "qwen3:1.7b"},
+	{Model: "qwen3:4b"}, // longer prompts need better context handling
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:          ":8443",
+		DataDir:         defaultDataDir(),
+		ShutdownTimeout: "30s",
+		StrictLocal:     StrictLocalConfig{Enabled: true},
+		TLS:             TLSConfig{Mode: tlsModeOff, ACMEChallengeListen: ":443"},
+		Ollama: OllamaConfig{
+			URL:          "http://127.0.0.1:11434",
+			WarmupModels: []string{"smollm2:135m", "gemma3:270m", "qwen3:1.7b", "qwen3:4b"},
+			Routing: RoutingConfig{
+				DefaultModel: "qwen2.5:3b",
+				Tiers:        append([]RouteTier(nil), defaultRouteTiers...),
+				VisionModel:  "gemma3:4b",
+			},
+		},
+		ICE:    ICEConfig{STUNURLs: []string{"stun:stun.l.google.com:19302"}},
+		CORS:   CORSConfig{AllowLocal: true},
+		Log:    LogConfig{Level: "info"},
+		Noise:  NoiseConfig{RotationGrace: "168h"},
+		Stream: StreamConfig{BatchWindow: "15ms", BatchBytes: 512},
+		Tools:  ToolsConfig{MaxRounds: 4},
+	}
+}
+
+func defaultDataDir() string {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "QuicPair")
+}
+
+// defaultConfigPath is used when neither -config nor QUICPAIR_CONFIG is set.
+// A missing file there is not an error.
+func defaultConfigPath() string {
+	return filepath.Join(defaultDataDir(), "config.yaml")
+}
+
+// ConfigError is a validation problem, with the file line when known
+type ConfigError struct {
+	Line  int
+	Field string
+	Msg   string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Msg)
+	}
+	return e.Field + ": " + e.Msg
+}
+
+// ConfigErrors collects every problem found so they can be fixed in one go
+type ConfigErrors []ConfigError
+
+func (es ConfigErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+var yamlLineRe = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// LoadConfig reads the file at path (if any) and applies environment and
+// flag overrides. flags maps flag names to values, as set on the command line.
+func LoadConfig(path string, flags map[string]string) (*Config, error) {
+	c := defaultConfig()
+	var root *yaml.Node
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) && path == defaultConfigPath() {
+			data = nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			dec := yaml.NewDecoder(bytes.NewReader(data))
+			dec.KnownFields(true)
+			if err := dec.Decode(c); err != nil {
+				return nil, yamlConfigErrors(err)
+			}
+			var doc yaml.Node
+			if err := yaml.Unmarshal(data, &doc); err == nil && len(doc.Content) > 0 {
+				root = doc.Content[0]
+			}
+		}
+	}
+
+	applyConfigEnv(c)
+	if err := applyConfigFlags(c, flags); err != nil {
+		return nil, err
+	}
+	if errs := c.validate(root); len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// yamlConfigErrors turns yaml.v3 errors into ConfigErrors with line numbers
+func yamlConfigErrors(err error) error {
+	var lines []string
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		lines = te.Errors
+	} else {
+		lines = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	var errs ConfigErrors
+	for _, l := range lines {
+		if m := yamlLineRe.FindStringSubmatch(l); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			errs = append(errs, ConfigError{Line: n, Field: "yaml", Msg: m[2]})
+		} else {
+			errs = append(errs, ConfigError{Field: "yaml", Msg: l})
+		}
+	}
+	return errs
+}
+
+// applyConfigEnv applies the environment variables the server has always
+// honoured, so existing setups keep working without a file
+func applyConfigEnv(c *Config) {
+	str := func(k string, dst *string) {
+		if v := os.Getenv(k); v != "" {
+			*dst = v
+		}
+	}
+	list := func(k string, dst *[]string) {
+		if v := os.Getenv(k); v != "" {
+			*dst = splitList(v)
+		}
+	}
+	flag := func(k string, dst *bool) {
+		switch os.Getenv(k) {
+		case "1", "true":
+			*dst = true
+		case "0", "false":
+			*dst = false
+		}
+	}
+
+	str("QUICPAIR_LISTEN", &c.Listen)
+	str("QUICPAIR_DATA_DIR", &c.DataDir)
+	str("SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	flag("DEV_MODE", &c.Dev.Enabled)
+	flag("DEV_ALLOW_PLAINTEXT", &c.Dev.AllowPlaintext)
+	flag("DEV_ALLOW_UNPAIRED", &c.Dev.AllowUnpaired)
+	if os.Getenv("DISABLE_STRICT_LOCAL") == "1" {
+		c.StrictLocal.Enabled = false
+	}
+	list("NET_ALLOW_CIDRS", &c.StrictLocal.AllowCIDRs)
+	list("NET_DENY_CIDRS", &c.StrictLocal.DenyCIDRs)
+	flag("NET_POLICY_DRY_RUN", &c.StrictLocal.DryRun)
+	list("EGRESS_ALLOW_HOSTS", &c.StrictLocal.EgressAllowHosts)
+	str("TLS_MODE", &c.TLS.Mode)
+	str("TLS_CERT_FILE", &c.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.TLS.KeyFile)
+	list("ACME_DOMAINS", &c.TLS.ACMEDomains)
+	str("ACME_EMAIL", &c.TLS.ACMEEmail)
+	str("OLLAMA_URL", &c.Ollama.URL)
+	str("OLLAMA_MODEL", &c.Ollama.Routing.DefaultModel)
+	list("STUN_URL", &c.ICE.STUNURLs)
+	list("TURN_URLS", &c.ICE.TURN.URLs)
+	str("TURN_USER", &c.ICE.TURN.Username)
+	str("TURN_PASS", &c.ICE.TURN.Password)
+	list("CORS_ALLOWED_ORIGINS", &c.CORS.AllowedOrigins)
+	flag("CORS_ALLOW_LOCAL", &c.CORS.AllowLocal)
+	flag("CORS_ALLOW_NULL_ORIGIN", &c.CORS.AllowNullOrigin)
+	str("LOG_LEVEL", &c.Log.Level)
+	str("LOG_JSON_PATH", &c.Log.JSONPath)
+	str("NOISE_ROTATION_GRACE", &c.Noise.RotationGrace)
+	str("STREAM_BATCH_WINDOW", &c.Stream.BatchWindow)
+}
+
+// configFlags are the command-line overrides; they win over file and env
+var configFlags = []struct {
+	name, usage string
+	set         func(c *Config, v string) error
+}{
+	{"listen", "listen address, e.g. :8443", func(c *Config, v string) error { c.Listen = v; return nil }},
+	{"data-dir", "directory for keys, devices and the audit log", func(c *Config, v string) error { c.DataDir = v; return nil }},
+	{"ollama-url", "Ollama base URL", func(c *Config, v string) error { c.Ollama.URL = v; return nil }},
+	{"model", "default model", func(c *Config, v string) error { c.Ollama.Routing.DefaultModel = v; return nil }},
+	{"tls", "TLS mode: self-signed, files, acme or off", func(c *Config, v string) error { c.TLS.Mode = v; return nil }},
+	{"log-level", "debug, info, warn or error", func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{"dev", "enable development mode (true/false)", func(c *Config, v string) (err error) {
+		c.Dev.Enabled, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"strict-local", "enable Strict Local Mode (true/false)", func(c *Config, v string) (err error) {
+		c.StrictLocal.Enabled, err = strconv.ParseBool(v)
+		return err
+	}},
+}
+
+func applyConfigFlags(c *Config, flags map[string]string) error {
+	for _, f := range configFlags {
+		v, ok := flags[f.name]
+		if !ok {
+			continue
+		}
+		if err := f.set(c, v); err != nil {
+			return fmt.Errorf("-%s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// parseConfigFlags registers -config and the override flags on fs and parses
+// args. It returns the config path and the overrides that were set.
+func parseConfigFlags(fs *flag.FlagSet, args []string) (string, map[string]string) {
+	path := fs.String("config", "", "config file (default $QUICPAIR_CONFIG or "+defaultConfigPath()+")")
+	for _, f := range configFlags {
+		fs.String(f.name, "", f.usage)
+	}
+	fs.Parse(args)
+
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			set[f.Name] = f.Value.String()
+		}
+	})
+	if *path == "" {
+		*path = env("QUICPAIR_CONFIG", defaultConfigPath())
+	}
+	return *path, set
+}
+
+// runConfigCommand implements "config check", which validates the effective
+// configuration and reports problems as file:line
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: quicpair-server config check [-config file] [overrides]")
+		return 2
+	}
+	path, flags := parseConfigFlags(flag.NewFlagSet("config check", flag.ExitOnError), args[1:])
+	if _, err := LoadConfig(path, flags); err != nil {
+		printConfigError(path, err)
+		return 1
+	}
+	fmt.Printf("%s: ok\n", path)
+	return 0
+}
+
+// printConfigError reports configuration errors as file:line on stderr
+func printConfigError(path string, err error) {
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return
+	}
+	for _, e := range errs {
+		if e.Line > 0 {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s: %s\n", path, e.Line, e.Field, e.Msg)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", path, e.Field, e.Msg)
+		}
+	}
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// nodeLine finds the line of a dotted key path in the YAML document, or 0
+// if the value did not come from the file
+func nodeLine(root *yaml.Node, path string) int {
+	n := root
+	for _, key := range strings.Split(path, ".") {
+		if n == nil || n.Kind != yaml.MappingNode {
+			return 0
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == key {
+				next = n.Content[i+1]
+				break
+			}
+		}
+		n = next
+	}
+	if n == nil {
+		return 0
+	}
+	return n.Line
+}
+
+func (c *Config) validate(root *yaml.Node) ConfigErrors {
+	var errs ConfigErrors
+	bad := func(field, format string, args ...interface{}) {
+		errs = append(errs, ConfigError{Line: nodeLine(root, field), Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		bad("listen", "must be host:port, got %q", c.Listen)
+	}
+	if c.DataDir == "" {
+		bad("data_dir", "must not be empty")
+	}
+	if d, err := time.ParseDuration(c.ShutdownTimeout); err != nil || d <= 0 {
+		bad("shutdown_timeout", "must be a positive duration such as 30s, got %q", c.ShutdownTimeout)
+	}
+	if d, err := time.ParseDuration(c.Noise.RotationGrace); err != nil || d <= 0 {
+		bad("noise.rotation_grace", "must be a positive duration such as 168h, got %q", c.Noise.RotationGrace)
+	}
+	if d, err := time.ParseDuration(c.Stream.BatchWindow); err != nil || d < 0 || d > maxBatchWindow {
+		bad("stream.batch_window", "must be a duration between 0 and %s, got %q", maxBatchWindow, c.Stream.BatchWindow)
+	}
+	if c.Stream.BatchBytes < 1 || c.Stream.BatchBytes > maxCoalescedBytes {
+		bad("stream.batch_bytes", "must be between 1 and %d, got %d", maxCoalescedBytes, c.Stream.BatchBytes)
+	}
+	if c.Tools.MaxRounds < 1 {
+		bad("tools.max_rounds", "must be at least 1, got %d", c.Tools.MaxRounds)
+	}
+	for _, root := range c.Tools.FileSearchRoots {
+		if !filepath.IsAbs(root) {
+			bad("tools.file_search_roots", "%q is not an absolute path", root)
+		}
+	}
+	toolNames := map[string]bool{"time": true, "calculator": true, "file_search": true}
+	for i, t := range c.Tools.HTTP {
+		if t.Name == "" || toolNames[t.Name] {
+			bad("tools.http", "tool %d: name %q is empty or already taken", i+1, t.Name)
+		}
+		toolNames[t.Name] = true
+		if u, err := url.Parse(t.URL); err != nil || u.Scheme != "http" || !isLoopbackHost(u.Hostname()) {
+			bad("tools.http", "tool %q: url must be http on localhost, got %q", t.Name, t.URL)
+		}
+	}
+
+	if (c.Dev.AllowPlaintext || c.Dev.AllowUnpaired) && !c.Dev.Enabled {
+		bad("dev", "allow_plaintext and allow_unpaired require dev.enabled")
+	}
+
+	if _, err := parsePrefixes(c.StrictLocal.AllowCIDRs); err != nil {
+		bad("strict_local.allow_cidrs", "%v", err)
+	}
+	if _, err := parsePrefixes(c.StrictLocal.DenyCIDRs); err != nil {
+		bad("strict_local.deny_cidrs", "%v", err)
+	}
+
+	switch c.TLS.Mode {
+	case tlsModeSelfSigned, tlsModeOff:
+	case tlsModeFiles:
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			bad("tls", "mode files requires cert_file and key_file")
+		}
+	case tlsModeACME:
+		if len(c.TLS.ACMEDomains) == 0 {
+			bad("tls.acme_domains", "mode acme requires at least one domain")
+		}
+		_, port, err := net.SplitHostPort(c.TLS.ACMEChallengeListen)
+		_, listenPort, _ := net.SplitHostPort(c.Listen)
+		switch {
+		case err != nil:
+			bad("tls.acme_challenge_listen", "must be host:port, got %q", c.TLS.ACMEChallengeListen)
+		case port == listenPort:
+			bad("tls.acme_challenge_listen", "must differ from the listen port; challenges get their own listener")
+		}
+	default:
+		bad("tls.mode", "must be one of self-signed, files, acme, off; got %q", c.TLS.Mode)
+	}
+
+	if u, err := url.Parse(c.Ollama.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		bad("ollama.url", "must be an http(s) URL, got %q", c.Ollama.URL)
+	} else if c.StrictLocal.Enabled && !c.localHost(u.Hostname()) {
+		bad("ollama.url", "%s is not local; disable strict_local or use a local address", u.Host)
+	}
+	if c.Ollama.Routing.DefaultModel == "" {
+		bad("ollama.routing.default_model", "must not be empty")
+	}
+	for i, t := range c.Ollama.Routing.Tiers {
+		if t.Model == "" {
+			bad("ollama.routing.tiers", "tier %d has no model", i+1)
+		}
+		if t.MaxPromptLen == 0 && i != len(c.Ollama.Routing.Tiers)-1 {
+			bad("ollama.routing.tiers", "tier %d has no max_prompt_len but is not last", i+1)
+		}
+		if i > 0 && t.MaxPromptLen != 0 && t.MaxPromptLen <= c.Ollama.Routing.Tiers[i-1].MaxPromptLen {
+			bad("ollama.routing.tiers", "tier %d max_prompt_len must be larger than the previous tier", i+1)
+		}
+	}
+
+	for _, u := range c.ICE.STUNURLs {
+		if !strings.HasPrefix(u, "stun:") && !strings.HasPrefix(u, "stuns:") {
+			bad("ice.stun_urls", "%q is not a stun: URL", u)
+		}
+	}
+	for _, u := range c.ICE.TURN.URLs {
+		if !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+			bad("ice.turn.urls", "%q is not a turn: URL", u)
+		}
+	}
+	if len(c.ICE.TURN.URLs) > 0 && (c.ICE.TURN.Username == "" || c.ICE.TURN.Password == "") {
+		bad("ice.turn", "urls require username and password")
+	}
+
+	for _, o := range c.CORS.AllowedOrigins {
+		if _, ok := normalizeOrigin(o); !ok {
+			bad("cors.allowed_origins", "%q is not a valid http(s) origin", o)
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		bad("log.level", "must be debug, info, warn or error; got %q", c.Log.Level)
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return errs
+}
+
+// isLoopbackHost accepts localhost and loopback addresses only
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// localHost applies this configuration's strict-local rules, which may
+// differ from the running policy when a new file is being checked
+func (c *Config) localHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		allow := append(append([]string{}, defaultAllowCIDRs...), c.StrictLocal.AllowCIDRs...)
+		p, err := NewNetPolicy(allow, c.StrictLocal.DenyCIDRs, false)
+		return err == nil && p.Allowed(ip)
+	}
+	return NewEgressGuard(c.StrictLocal.EgressAllowHosts).isLocalName(host)
+}
+
+func (c *Config) shutdownTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.ShutdownTimeout)
+	return d
+}
+
+func (c *Config) rotationGrace() time.Duration {
+	d, _ := time.ParseDuration(c.Noise.RotationGrace)
+	return d
+}
+
+func (c *Config) batchOptions() BatchOptions {
+	d, _ := time.ParseDuration(c.Stream.BatchWindow)
+	return BatchOptions{WindowMs: int(d / time.Millisecond), MaxBytes: c.Stream.BatchBytes}
+}
+
+// Redacted returns a copy that is safe to show to an operator
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.ICE.TURN.Password != "" {
+		r.ICE.TURN.Password = "[redacted]"
+	}
+	return &r
+}
+
+// settings is the effective configuration; it is replaced on reload
+var (
+	settings      atomic.Pointer[Config]
+	settingsPath  string
+	settingsFlags map[string]string
+)
+
+func init() {
+	settings.Store(defaultConfig())
+}
+
+func cfg() *Config { return settings.Load() }
+
+// initConfig loads the configuration before anything else starts
+func initConfig(path string, flags map[string]string) {
+	c, err := LoadConfig(path, flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration %s:\n%v\n", path, err)
+		os.Exit(1)
+	}
+	settingsPath, settingsFlags = path, flags
+	settings.Store(c)
+	runtimeConfig.Store(runtimeFromConfig(c))
+}
+
+// RuntimeConfig holds the settings that can change without a restart, in
+// the form the hot paths use. It is replaced as a whole on reload, so
+// readers take one snapshot and use it.
+type RuntimeConfig struct {
+	ICEServers []webrtc.ICEServer
+	Routing    RoutingConfig
+}
+
+var runtimeConfig atomic.Pointer[RuntimeConfig]
+
+func currentConfig() *RuntimeConfig {
+	if rc := runtimeConfig.Load(); rc != nil {
+		return rc
+	}
+	return runtimeFromConfig(cfg())
+}
+
+func runtimeFromConfig(c *Config) *RuntimeConfig {
+	rc := &RuntimeConfig{Routing: c.Ollama.Routing}
+	if len(c.ICE.STUNURLs) > 0 {
+		rc.ICEServers = append(rc.ICEServers, webrtc.ICEServer{URLs: c.ICE.STUNURLs})
+	}
+	if len(c.ICE.TURN.URLs) > 0 {
+		rc.ICEServers = append(rc.ICEServers, webrtc.ICEServer{
+			URLs:       c.ICE.TURN.URLs,
+			Username:   c.ICE.TURN.Username,
+			Credential: c.ICE.TURN.Password,
+		})
+	}
+	return rc
+}
+
+// reloadConfig re-reads the config file and environment and applies what
+// can change at runtime. Live sessions keep the ICE servers they were
+// created with; new offers use the new ones.
+func reloadConfig(trigger string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	c, err := LoadConfig(settingsPath, settingsFlags)
+	if err != nil {
+		return err
+	}
+	old := cfg()
+	if c.Listen != old.Listen || c.DataDir != old.DataDir || !reflect.DeepEqual(c.TLS, old.TLS) || c.Dev != old.Dev {
+		logger.Warn("listen, data_dir, tls and dev changes take effect after a restart")
+	}
+	// These keep the values the server started with until it restarts
+	c.Listen, c.DataDir, c.TLS, c.Dev = old.Listen, old.DataDir, old.TLS, old.Dev
+
+	// Everything that can fail is checked before the new config goes live
+	if err := checkNetPolicy(c.StrictLocal); err != nil {
+		return fmt.Errorf("network policy: %w", err)
+	}
+	var logs *logSetup
+	if c.Log != old.Log {
+		if logs, err = openLogging(c.Log); err != nil {
+			return fmt.Errorf("log: %w", err)
+		}
+	}
+
+	settings.Store(c)
+	if err := reloadNetPolicy(); err != nil {
+		return fmt.Errorf("network policy: %w", err)
+	}
+	if logs != nil {
+		logs.use()
+	}
+	egressGuard.SetAllowHosts(c.StrictLocal.EgressAllowHosts)
+	initCORS()
+	runtimeConfig.Store(runtimeFromConfig(c))
+	initTools()
+	if c.Ollama.URL != old.Ollama.URL || !slices.Equal(c.Ollama.WarmupModels, old.Ollama.WarmupModels) {
+		// New clients for the new URL; the old manager's keep-alives stop
+		prev := globalOllamaManager()
+		initOllamaManager()
+		initFastOllama()
+		initModelCapabilities()
+		if prev != nil {
+			prev.Close()
+		}
+	}
+
+	auditLog.Record(auditConfigChanged, map[string]string{"trigger": trigger, "path": settingsPath})
+	logger.Info("configuration reloaded", "trigger", trigger, "path", settingsPath)
+	return nil
+}
+
+// reloadMu serializes reloads from SIGHUP and the admin socket
+var reloadMu sync.Mutex
+
+// handleAdminConfig shows the effective configuration with secrets redacted
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":   settingsPath,
+		"config": cfg().Redacted(),
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoutingModelFor(t *testing.T) {
+	rc := RoutingConfig{DefaultModel: "qwen2.5:3b", Tiers: defaultRouteTiers}
+	for n, want := range map[int]string{
+		5:   "smollm2:135m",
+		30:  "gemma3:270m",
+		99:  "qwen3:1.7b",
+		500: "qwen3:4b",
+	} {
+		if got := rc.ModelFor(n); got != want {
+			t.Errorf("len %d: expected %s, got %s", n, want, got)
+		}
+	}
+
+	rc.Tiers = []RouteTier{{MaxPromptLen: 10, Model: "tiny"}}
+	if got := rc.ModelFor(50); got != "qwen2.5:3b" {
+		t.Errorf("Expected fallback to default model, got %s", got)
+	}
+}
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	path := writeConfig(t, `
+listen: ":9443"
+ollama:
+  url: http://127.0.0.1:11500
+  routing:
+    default_model: llama3.2:3b
+ice:
+  turn:
+    urls: ["turn:relay.lan:3478"]
+    username: qp
+    password: hunter2
+`)
+	t.Setenv("OLLAMA_URL", "http://localhost:11434")
+
+	c, err := LoadConfig(path, map[string]string{"model": "qwen3:4b"})
+	if err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	if c.Listen != ":9443" {
+		t.Errorf("File value lost: listen=%s", c.Listen)
+	}
+	if c.Ollama.URL != "http://localhost:11434" {
+		t.Errorf("Env should override file: ollama.url=%s", c.Ollama.URL)
+	}
+	if c.Ollama.Routing.DefaultModel != "qwen3:4b" {
+		t.Errorf("Flag should override file: default_model=%s", c.Ollama.Routing.DefaultModel)
+	}
+	if !c.StrictLocal.Enabled || !c.CORS.AllowLocal {
+		t.Error("Defaults not in the file must be kept")
+	}
+	if c.Redacted().ICE.TURN.Password == "hunter2" || c.ICE.TURN.Password != "hunter2" {
+		t.Error("Redacted must hide the TURN password without changing the original")
+	}
+}
+
+func TestLoadConfigErrorLines(t *testing.T) {
+	path := writeConfig(t, `listen: ":8443"
+tls:
+  mode: sometimes
+ollama:
+  url: http://ollama.example.com:11434
+`)
+	_, err := LoadConfig(path, nil)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Expected two config errors, got %v", err)
+	}
+	if errs[0].Field != "tls.mode" || errs[0].Line != 3 {
+		t.Errorf("Unexpected first error: %+v", errs[0])
+	}
+	if errs[1].Field != "ollama.url" || errs[1].Line != 5 {
+		t.Errorf("Unexpected second error: %+v", errs[1])
+	}
+
+	_, err = LoadConfig(writeConfig(t, "listen: \":8443\"\nlisten_addr: x\n"), nil)
+	if !errors.As(err, &errs) || errs[0].Line != 2 {
+		t.Errorf("Expected unknown field to be reported on line 2, got %v", err)
+	}
+}
+
+func TestToolsConfigValidation(t *testing.T) {
+	path := writeConfig(t, `tools:
+  http:
+    - {name: calculator, url: "http://127.0.0.1:9000/calc"}
+    - {name: lights, url: "http://192.168.1.20/lights"}
+`)
+	_, err := LoadConfig(path, nil)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Expected two config errors, got %v", err)
+	}
+	for _, e := range errs {
+		if e.Field != "tools.http" {
+			t.Errorf("Unexpected error: %+v", e)
+		}
+	}
+}
+
+func TestACMEChallengePort(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, `listen: ":443"
+tls:
+  mode: acme
+  acme_domains: [quicpair.example.com]
+`), nil)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Field != "tls.acme_challenge_listen" {
+		t.Errorf("Expected the challenge port clash to be rejected, got %v", err)
+	}
+}
+
+func TestReloadConfigApplies(t *testing.T) {
+	defer func(p string) {
+		settingsPath = p
+		settings.Store(defaultConfig())
+		reloadNetPolicy()
+		egressGuard.SetAllowHosts(nil)
+		initTools()
+	}(settingsPath)
+	settings.Store(defaultConfig())
+
+	settingsPath = writeConfig(t, `strict_local:
+  enabled: false
+  egress_allow_hosts: [nas.example.com]
+tools:
+  file_search_roots: [/tmp]
+`)
+	if err := reloadConfig("test"); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if strictLocalMode() {
+		t.Error("strict_local.enabled not applied on reload")
+	}
+	if !egressGuard.isLocalName("nas.example.com") {
+		t.Error("egress_allow_hosts not applied on reload")
+	}
+	if _, ok := toolRegistry().Get("file_search"); !ok {
+		t.Error("tools not rebuilt on reload")
+	}
+
+	// Restart-only settings must not take effect on reload
+	settingsPath = writeConfig(t, `dev:
+  enabled: true
+  allow_unpaired: true
+`)
+	if err := reloadConfig("test"); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if allowUnpaired() || cfg().Dev.Enabled {
+		t.Error("dev settings applied without a restart")
+	}
+
+	// A reload that fails leaves the running config alone
+	before := cfg()
+	settingsPath = writeConfig(t, `strict_local:
+  enabled: false
+log:
+  json_path: `+filepath.Join(t.TempDir(), "missing", "log.json")+`
+`)
+	if err := reloadConfig("test"); err == nil {
+		t.Fatal("Expected reload with an unwritable log sink to fail")
+	}
+	if cfg() != before || !strictLocalMode() {
+		t.Error("failed reload left the new config half applied")
+	}
+}
+
+// TestReloadDuringGeneration reloads while a chat streams; run with -race
+func TestReloadDuringGeneration(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			fmt.Fprintln(w, `{"message":{"content":"x"},"done":false}`)
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+		fmt.Fprintln(w, `{"message":{"content":""},"done":true,"eval_count":5}`)
+	}))
+	defer srv.Close()
+	defer func(p string) {
+		settingsPath = p
+		settings.Store(defaultConfig())
+		reloadNetPolicy()
+		configureLogging()
+		initTools()
+	}(settingsPath)
+	settings.Store(defaultConfig())
+
+	configFor := func(url, level string) string {
+		return writeConfig(t, fmt.Sprintf("ollama:\n  url: %s\n  warmup_models: []\nlog:\n  level: %s\n", url, level))
+	}
+	settingsPath = configFor(srv.URL, "info")
+	if err := reloadConfig("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSession("s1", "dev-1", nil, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxyOllamaStream(context.Background(), s.NewStream(context.Background(), "r1"), logger.With(logKeyRequest, "r1"), "dev-1", "qwen3:1.7b", "hi", nil, nil, nil, true)
+	}()
+	urls := []string{srv.URL, "http://localhost" + srv.URL[len("http://127.0.0.1"):]}
+	for i := 0; i < 4; i++ {
+		settingsPath = configFor(urls[i%2], []string{"debug", "info"}[i%2])
+		if err := reloadConfig("test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation did not finish")
+	}
+	if m := globalOllamaManager(); m == nil || globalFastClient() == nil || modelCaps() == nil {
+		t.Error("Ollama clients missing after reload")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	corsAllowMethods = "GET, POST, DELETE, OPTIONS"
+	corsAllowHeaders = "content-type, authorization, x-request-id, x-quicpair-device, x-quicpair-timestamp, x-quicpair-signature"
+	corsMaxAge       = "600"
+)
+
+// CORSPolicy decides which browser origins may call the API. Allowed origins
+// are echoed back exactly, never as "*". Only configured origins may send
+// credentials.
+type CORSPolicy struct {
+	allowed map[string]bool
+	// AllowLocal admits origins on localhost or an address the network
+	// policy treats as local, without credentials: any device on the LAN
+	// can serve a page from such an origin
+	AllowLocal bool
+	// AllowNull admits the opaque "null" origin sent by sandboxed frames and
+	// by some browsers for file:// pages. It is never given credentials.
+	AllowNull bool
+}
+
+func NewCORSPolicy(origins []string, allowLocal, allowNull bool) *CORSPolicy {
+	p := &CORSPolicy{allowed: make(map[string]bool), AllowLocal: allowLocal, AllowNull: allowNull}
+	for _, o := range origins {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		}
+		if n, ok := normalizeOrigin(o); ok {
+			p.allowed[n] = true
+		} else {
+			logger.Warn("ignoring invalid CORS origin", "origin", o)
+		}
+	}
+	return p
+}
+
+// normalizeOrigin reduces an origin to lower-case scheme://host[:port] with
+// the default port dropped, so equivalent spellings compare equal
+func normalizeOrigin(origin string) (string, bool) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", false
+	}
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return scheme + "://" + host, true
+}
+
+// Check reports whether the origin is allowed and whether it may send
+// credentials
+func (p *CORSPolicy) Check(origin string) (allowed, credentials bool) {
+	switch {
+	case origin == "null":
+		return p.AllowNull, false
+	case strings.HasPrefix(origin, "file://"):
+		// Safari sends the literal scheme for local HTML files
+		return p.AllowNull, false
+	}
+	n, ok := normalizeOrigin(origin)
+	if !ok {
+		return false, false
+	}
+	if p.allowed[n] {
+		return true, true
+	}
+	if p.AllowLocal {
+		u, _ := url.Parse(n)
+		host := u.Hostname()
+		if host == "localhost" {
+			return true, false
+		}
+		// Allowed rather than Permit: dry-run relaxes connection checks
+		// only and must not admit more origins
+		if ip := net.ParseIP(host); ip != nil && netPolicy.Allowed(ip) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// corsPolicy is swapped as a whole on reload
+var corsPolicy atomic.Pointer[CORSPolicy]
+
+func init() {
+	corsPolicy.Store(NewCORSPolicy(nil, true, false))
+}
+
+// initCORS applies the cors section of the configuration: allowed_origins
+// (e.g. https://chat.example.ts.net), allow_local for localhost and local-IP
+// origins, and allow_null_origin for "null" and file:// without credentials
+func initCORS() {
+	c := cfg().CORS
+	corsPolicy.Store(NewCORSPolicy(c.AllowedOrigins, c.AllowLocal, c.AllowNullOrigin))
+}
+
+func cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// Not a cross-origin browser request
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, credentials := corsPolicy.Load().Check(origin)
+		if !allowed {
+			http.Error(w, "Forbidden: origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
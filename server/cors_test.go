@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPolicyCheck(t *testing.T) {
+	p := NewCORSPolicy([]string{"https://chat.example.ts.net", "http://LOCALHOST:80"}, true, false)
+	for _, tc := range []struct {
+		origin              string
+		allowed, credential bool
+	}{
+		{"https://chat.example.ts.net", true, true},
+		{"https://chat.example.ts.net:443", true, true},
+		{"https://chat.example.ts.net:8443", false, false},
+		{"http://localhost", true, true},
+		{"http://localhost:5173", true, false},
+		{"http://localhost.evil.com", false, false},
+		{"http://localhost@evil.com", false, false},
+		{"http://192.168.1.4:8080", true, false},
+		{"http://8.8.8.8", false, false},
+		{"null", false, false},
+		{"file://", false, false},
+		{"javascript://localhost", false, false},
+	} {
+		allowed, cred := p.Check(tc.origin)
+		if allowed != tc.allowed || cred != tc.credential {
+			t.Errorf("%s: expected (%v, %v), got (%v, %v)", tc.origin, tc.allowed, tc.credential, allowed, cred)
+		}
+	}
+
+	p.AllowNull = true
+	if allowed, cred := p.Check("null"); !allowed || cred {
+		t.Error("null origin must be allowed without credentials when enabled")
+	}
+
+	netPolicy.Reload(defaultAllowCIDRs, nil, true)
+	defer netPolicy.Reload(defaultAllowCIDRs, nil, false)
+	if allowed, _ := p.Check("http://8.8.8.8"); allowed {
+		t.Error("dry-run must not admit non-local origins")
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	prev := corsPolicy.Swap(NewCORSPolicy([]string{"https://ui.example"}, false, false))
+	defer corsPolicy.Store(prev)
+	h := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("OPTIONS", "/api/chat", nil)
+	req.Header.Set("Origin", "https://ui.example")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 preflight, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://ui.example" {
+		t.Errorf("Expected exact origin echo, got %q", got)
+	}
+	if rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("Expected credentials to be allowed")
+	}
+	if rec.Header().Values("Vary")[0] != "Origin" {
+		t.Errorf("Expected Vary: Origin, got %v", rec.Header().Values("Vary"))
+	}
+
+	req = httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for unlisted origin, got %d", rec.Code)
+	}
+}
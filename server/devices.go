@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownDevice = errors.New("unknown device")
+	ErrDeviceRevoked = errors.New("device revoked")
+)
+
+// Device is a paired phone. SigningKey is the device's Ed25519 static key,
+// used to sign offers; it is optional for clients that only use tokens.
+type Device struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	SigningKey string    `json:"signing_key,omitempty"`
+	PairedAt   time.Time `json:"paired_at"`
+	LastSeen   time.Time `json:"last_seen,omitempty"`
+	Revoked    bool      `json:"revoked,omitempty"`
+	RevokedAt  time.Time `json:"revoked_at,omitempty"`
+}
+
+func (d *Device) signingKey() ed25519.PublicKey {
+	b, err := base64.StdEncoding.DecodeString(d.SigningKey)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil
+	}
+	return ed25519.PublicKey(b)
+}
+
+// DeviceRegistry stores paired devices in a JSON file in the data directory
+type DeviceRegistry struct {
+	mu      sync.RWMutex
+	path    string
+	devices map[string]*Device
+}
+
+func OpenDeviceRegistry(path string) (*DeviceRegistry, error) {
+	dr := &DeviceRegistry{path: path, devices: make(map[string]*Device)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return dr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Device
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, d := range list {
+		dr.devices[d.ID] = d
+	}
+	return dr, nil
+}
+
+// save must be called with mu held
+func (dr *DeviceRegistry) save() error {
+	list := make([]*Device, 0, len(dr.devices))
+	for _, d := range dr.devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].PairedAt.Before(list[j].PairedAt) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dr.path), 0700); err != nil {
+		return err
+	}
+	tmp := dr.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dr.path)
+}
+
+// Pair registers a new device
+func (dr *DeviceRegistry) Pair(name string, signingKey []byte) (*Device, error) {
+	if signingKey != nil && len(signingKey) != ed25519.PublicKeySize {
+		return nil, errors.New("signing key must be a 32-byte Ed25519 public key")
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	d := &Device{
+		ID:       "dev-" + hex.EncodeToString(id),
+		Name:     name,
+		PairedAt: time.Now().UTC(),
+	}
+	if signingKey != nil {
+		d.SigningKey = base64.StdEncoding.EncodeToString(signingKey)
+	}
+
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.devices[d.ID] = d
+	if err := dr.save(); err != nil {
+		delete(dr.devices, d.ID)
+		return nil, err
+	}
+	c := *d
+	return &c, nil
+}
+
+// Active returns the device if it is paired and not revoked
+func (dr *DeviceRegistry) Active(id string) (*Device, error) {
+	dr.mu.RLock()
+	defer dr.mu.RUnlock()
+	d, ok := dr.devices[id]
+	if !ok {
+		return nil, ErrUnknownDevice
+	}
+	if d.Revoked {
+		return nil, ErrDeviceRevoked
+	}
+	c := *d
+	return &c, nil
+}
+
+func (dr *DeviceRegistry) List() []Device {
+	dr.mu.RLock()
+	defer dr.mu.RUnlock()
+	out := make([]Device, 0, len(dr.devices))
+	for _, d := range dr.devices {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PairedAt.Before(out[j].PairedAt) })
+	return out
+}
+
+// Revoke marks a device as revoked. The record is kept for the audit trail.
+func (dr *DeviceRegistry) Revoke(id string) error {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	d, ok := dr.devices[id]
+	if !ok {
+		return ErrUnknownDevice
+	}
+	if d.Revoked {
+		return nil
+	}
+	d.Revoked = true
+	d.RevokedAt = time.Now().UTC()
+	return dr.save()
+}
+
+// Touch updates the last-seen time in memory; it is persisted on the next save
+func (dr *DeviceRegistry) Touch(id string) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if d, ok := dr.devices[id]; ok {
+		d.LastSeen = time.Now().UTC()
+	}
+}
+
+var deviceRegistry *DeviceRegistry
+
+func initDeviceRegistry() {
+	var err error
+	deviceRegistry, err = OpenDeviceRegistry(filepath.Join(dataDir(), "devices.json"))
+	if err != nil {
+		fatal("failed to open device registry", "error", err)
+	}
+}
+
+// revokeDevice revokes a device, closes its live sessions and records it in
+// the audit log
+func revokeDevice(id, actor string) error {
+	if err := deviceRegistry.Revoke(id); err != nil {
+		return err
+	}
+	closed := sessions.CloseDevice(id)
+	auditLog.Record(auditDeviceRevoked, map[string]string{"device": id, "actor": actor})
+	logger.Info("device revoked", "device", id, "sessions_closed", closed)
+	return nil
+}
+
+// handleDevices lists paired devices (GET) or revokes one (POST {"id":...})
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deviceRegistry.List())
+	case http.MethodPost:
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := revokeDevice(req.ID, "admin_http"); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Egress violation reasons
+const (
+	egressBlockedAddress  = "blocked_address"
+	egressBlockedLookup   = "blocked_lookup"
+	egressBlockedResolver = "blocked_resolver"
+)
+
+// Names with these suffixes may be resolved in Strict Local Mode. Anything
+// else is refused before a DNS query leaves the machine.
+var (
+	// mdnsNameSuffixes are answered by the operating system itself, over
+	// multicast DNS or as loopback, and never reach a DNS server
+	mdnsNameSuffixes = []string{".local", ".localhost"}
+	// siteNameSuffixes are only known to a DNS server on the local network.
+	// They are resolved by the guard's own resolver, which asks nameservers
+	// on local addresses only, so the query cannot leak upstream.
+	siteNameSuffixes = []string{".lan", ".home.arpa", ".internal", ".ts.net"}
+)
+
+var ErrEgressBlocked = errors.New("outbound connection blocked by strict local mode")
+
+// EgressError describes a refused outbound connection
+type EgressError struct {
+	Host   string
+	Reason string
+}
+
+func (e *EgressError) Error() string {
+	return ErrEgressBlocked.Error() + ": " + e.Host + " (" + e.Reason + ")"
+}
+
+func (e *EgressError) Unwrap() error { return ErrEgressBlocked }
+
+type egressViolation struct {
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	Reason string    `json:"reason"`
+}
+
+// EgressGuard dials outbound connections for every HTTP client in the server.
+// In Strict Local Mode it refuses lookups of external names and connections
+// to any address the network policy does not allow.
+type EgressGuard struct {
+	dialer    *net.Dialer
+	transport *http.Transport
+	// resolver looks up site-local names through local nameservers only
+	resolver *net.Resolver
+
+	mu         sync.Mutex
+	allowNames []string
+	counts     map[string]int64
+	recent     []egressViolation
+}
+
+const maxEgressViolations = 50
+
+func NewEgressGuard(extraNames []string) *EgressGuard {
+	g := &EgressGuard{counts: make(map[string]int64)}
+	g.SetAllowHosts(extraNames)
+	g.dialer = &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		// Control sees the resolved address, so names that resolve to
+		// external addresses are caught as well
+		Control: g.control,
+	}
+	// The Go resolver reads the nameservers itself, so each can be checked
+	g.resolver = &net.Resolver{PreferGo: true, Dial: g.dialResolver}
+	g.transport = &http.Transport{
+		DialContext:         g.DialContext,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return g
+}
+
+// SetAllowHosts replaces the names allowed besides localhost and this host
+func (g *EgressGuard) SetAllowHosts(extraNames []string) {
+	names := []string{"localhost"}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		names = append(names, strings.ToLower(strings.TrimSuffix(h, ".local")))
+	}
+	for _, n := range extraNames {
+		if n = strings.ToLower(strings.TrimSpace(n)); n != "" {
+			names = append(names, n)
+		}
+	}
+	g.mu.Lock()
+	g.allowNames = names
+	g.mu.Unlock()
+}
+
+func normalizeHostName(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func hasNameSuffix(host string, suffixes []string) bool {
+	for _, s := range suffixes {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedName reports whether a normalized name is allowed by configuration
+func (g *EgressGuard) allowedName(host string) bool {
+	g.mu.Lock()
+	names := g.allowNames
+	g.mu.Unlock()
+	for _, n := range names {
+		if host == n || (strings.HasPrefix(n, ".") && strings.HasSuffix(host, n)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalName reports whether a host name may be resolved in strict mode
+func (g *EgressGuard) isLocalName(host string) bool {
+	host = normalizeHostName(host)
+	return g.allowedName(host) || hasNameSuffix(host, mdnsNameSuffixes) || hasNameSuffix(host, siteNameSuffixes)
+}
+
+// siteName reports whether host must be resolved by the guard's resolver:
+// a site-local name the configuration does not allow outright
+func (g *EgressGuard) siteName(host string) bool {
+	host = normalizeHostName(host)
+	return hasNameSuffix(host, siteNameSuffixes) && !g.allowedName(host)
+}
+
+func (g *EgressGuard) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if strictLocalMode() {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			if g.siteName(host) {
+				return g.dialSiteName(ctx, network, host, port)
+			}
+			if !g.isLocalName(host) && !g.violation(host, egressBlockedLookup) {
+				return nil, &EgressError{Host: host, Reason: egressBlockedLookup}
+			}
+		}
+	}
+	return g.dialer.DialContext(ctx, network, address)
+}
+
+// dialSiteName resolves host with the local-only resolver and dials the
+// first address that answers
+func (g *EgressGuard) dialSiteName(ctx context.Context, network, host, port string) (net.Conn, error) {
+	addrs, err := g.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	lastErr := error(&net.DNSError{Err: "no such host", Name: host, IsNotFound: true})
+	for _, a := range addrs {
+		conn, err := g.dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dialResolver connects the resolver to a nameserver from the system
+// configuration, refusing any that is not on a local address
+func (g *EgressGuard) dialResolver(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if !isLocalIP(net.ParseIP(host)) && !g.violation(host, egressBlockedResolver) {
+		return nil, &EgressError{Host: host, Reason: egressBlockedResolver}
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (g *EgressGuard) control(network, address string, _ syscall.RawConn) error {
+	if !strictLocalMode() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if isLocalIP(net.ParseIP(host)) || g.violation(host, egressBlockedAddress) {
+		return nil
+	}
+	return &EgressError{Host: host, Reason: egressBlockedAddress}
+}
+
+// violation records a refused connection and reports whether the network
+// policy's dry-run mode lets it through anyway
+func (g *EgressGuard) violation(host, reason string) bool {
+	g.mu.Lock()
+	g.counts[reason]++
+	g.recent = append(g.recent, egressViolation{Time: time.Now().UTC(), Host: host, Reason: reason})
+	if len(g.recent) > maxEgressViolations {
+		g.recent = g.recent[len(g.recent)-maxEgressViolations:]
+	}
+	g.mu.Unlock()
+
+	if netPolicy.DryRun() {
+		logger.Warn("egress would be blocked", "host", host, "reason", reason)
+		return true
+	}
+	logger.Warn("egress blocked", "host", host, "reason", reason)
+	return false
+}
+
+// Transport returns the shared HTTP transport that dials through the guard
+func (g *EgressGuard) Transport() *http.Transport {
+	return g.transport
+}
+
+func (g *EgressGuard) Stats() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	counts := make(map[string]int64, len(g.counts))
+	var total int64
+	for k, v := range g.counts {
+		counts[k] = v
+		total += v
+	}
+	return map[string]interface{}{
+		"strict_local": strictLocalMode(),
+		"violations":   total,
+		"by_reason":    counts,
+		"recent":       append([]egressViolation(nil), g.recent...),
+	}
+}
+
+var egressGuard = NewEgressGuard(nil)
+
+// initEgressGuard applies strict_local.egress_allow_hosts (names, or
+// suffixes starting with ".") and routes http.DefaultTransport through the
+// guard so clients without their own transport are covered too
+func initEgressGuard() {
+	egressGuard = NewEgressGuard(cfg().StrictLocal.EgressAllowHosts)
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.DialContext = egressGuard.DialContext
+	}
+}
+
+// newEgressClient returns an HTTP client whose connections pass the guard
+func newEgressClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: egressGuard.Transport(), Timeout: timeout}
+}
+
+func handleEgressMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(egressGuard.Stats())
+}
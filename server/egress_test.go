@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEgressGuardBlocksExternalLookups(t *testing.T) {
+	g := NewEgressGuard([]string{"ollama.box", ".corp.example"})
+	for host, want := range map[string]bool{
+		"localhost":            true,
+		"mac-mini.local":       true,
+		"gpu.tailnet.ts.net":   true,
+		"ollama.box":           true,
+		"a.corp.example":       true,
+		"api.openai.com":       false,
+		"localhost.evil.com":   false,
+		"corp.example.evil.io": false,
+	} {
+		if got := g.isLocalName(host); got != want {
+			t.Errorf("%s: expected %v, got %v", host, want, got)
+		}
+	}
+
+	_, err := g.DialContext(context.Background(), "tcp", "api.openai.com:443")
+	if !errors.Is(err, ErrEgressBlocked) {
+		t.Fatalf("Expected lookup to be blocked, got %v", err)
+	}
+	if g.Stats()["by_reason"].(map[string]int64)[egressBlockedLookup] != 1 {
+		t.Errorf("Expected violation to be counted: %v", g.Stats())
+	}
+}
+
+func TestEgressGuardSiteNames(t *testing.T) {
+	g := NewEgressGuard([]string{"nas.lan"})
+	for host, want := range map[string]bool{
+		"printer.lan":     true,
+		"ollama.internal": true,
+		"nas.lan":         false, // allowed outright
+		"mac-mini.local":  false,
+		"api.openai.com":  false,
+	} {
+		if got := g.siteName(host); got != want {
+			t.Errorf("%s: expected %v, got %v", host, want, got)
+		}
+	}
+	// Site-local names never go to a public nameserver
+	if _, err := g.dialResolver(context.Background(), "udp", "8.8.8.8:53"); !errors.Is(err, ErrEgressBlocked) {
+		t.Errorf("Expected public nameserver to be refused, got %v", err)
+	}
+	conn, err := g.dialResolver(context.Background(), "udp", "127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("Expected local nameserver to be allowed, got %v", err)
+	}
+	conn.Close()
+}
+
+func TestEgressGuardChecksResolvedAddress(t *testing.T) {
+	g := NewEgressGuard(nil)
+	if err := g.control("tcp", "93.184.216.34:80", nil); !errors.Is(err, ErrEgressBlocked) {
+		t.Errorf("Expected external address to be blocked, got %v", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	client := &http.Client{Transport: g.Transport()}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Expected loopback request to pass, got %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestIsLocalURL(t *testing.T) {
+	for u, want := range map[string]bool{
+		"http://127.0.0.1:11434":        true,
+		"http://localhost:11434":        true,
+		"http://[::1]:11434":            true,
+		"http://192.168.1.5:11434/":     true,
+		"http://localhost.evil.com":     false,
+		"http://8.8.8.8:11434":          false,
+		"http://user@8.8.8.8/127.0.0.1": false,
+	} {
+		if got := isLocalURL(u); got != want {
+			t.Errorf("%s: expected %v, got %v", u, want, got)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// bufferedLowThreshold is where OnBufferedAmountLow fires; above it the
+	// channel counts as congested and deltas are coalesced
+	bufferedLowThreshold = 256 << 10
+	// maxBufferedAmount pauses the backend reader until the channel drains
+	maxBufferedAmount = 1 << 20
+	// maxCoalescedBytes caps a coalesced delta frame
+	maxCoalescedBytes = 16 << 10
+)
+
+// flowStats counts flow control events for a session
+type flowStats struct {
+	coalesced atomic.Int64
+	pauses    atomic.Int64
+}
+
+// attachLocked moves the session onto a transport (nil when detached): the
+// control channel dc and the open stream channels. Readers waiting on the
+// old channels are woken. It must be called with mu held.
+func (s *Session) attachLocked(pc *webrtc.PeerConnection, dc *webrtc.DataChannel, pool []*webrtc.DataChannel) {
+	for _, w := range s.writable {
+		close(w)
+	}
+	s.writable = make(map[*webrtc.DataChannel]chan struct{})
+	s.pc, s.dc, s.pool = pc, dc, nil
+	if dc != nil {
+		s.watchLocked(dc)
+	}
+	for _, sc := range pool {
+		s.addStreamChannelLocked(sc)
+	}
+}
+
+// watchLocked sets up flow control for one of the session's channels
+func (s *Session) watchLocked(dc *webrtc.DataChannel) {
+	s.writable[dc] = make(chan struct{})
+	dc.SetBufferedAmountLowThreshold(bufferedLowThreshold)
+	dc.OnBufferedAmountLow(func() { s.bufferedLow(dc) })
+}
+
+// bufferedLow wakes readers paused on dc and sends output coalesced for it
+func (s *Session) bufferedLow(dc *webrtc.DataChannel) {
+	s.mu.Lock()
+	w, ok := s.writable[dc]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	close(w)
+	s.writable[dc] = make(chan struct{})
+	s.mu.Unlock()
+
+	// Not on the SCTP callback goroutine, which a blocked Send may need
+	go func() {
+		s.sendMu.Lock()
+		defer s.sendMu.Unlock()
+		for rs := range s.held {
+			if rs.channel() == dc {
+				rs.flushLocked()
+			}
+		}
+	}()
+}
+
+// congested reports whether dc is above the low threshold
+func congested(dc *webrtc.DataChannel) bool {
+	return dc != nil && dc.BufferedAmount() > bufferedLowThreshold
+}
+
+// waitWritable blocks while the stream's channel holds more than
+// maxBufferedAmount, which in turn stops reading from the backend
+func (rs *RequestStream) waitWritable() {
+	s := rs.s
+	paused := false
+	for {
+		s.mu.Lock()
+		dc := s.channelForLocked(rs.id, rs.slot)
+		writable := s.writable[dc]
+		s.mu.Unlock()
+		if dc == nil || dc.BufferedAmount() <= maxBufferedAmount {
+			return
+		}
+		if !paused {
+			paused = true
+			s.flow.pauses.Add(1)
+		}
+		select {
+		case <-writable:
+		case <-rs.ctx.Done():
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// bufferStats reports per-session buffer memory: bytes queued in the
+// DataChannel and bytes kept for resumption
+func bufferStats() map[string]interface{} {
+	var buffered uint64
+	var resume int
+	list := []map[string]interface{}{}
+	for _, s := range sessions.List() {
+		info := s.Info()
+		buffered += info.BufferedBytes
+		resume += info.ResumeBytes
+		list = append(list, map[string]interface{}{
+			"id":             info.ID,
+			"buffered_bytes": info.BufferedBytes,
+			"resume_bytes":   info.ResumeBytes,
+			"coalesced":      info.Coalesced,
+			"pauses":         info.Pauses,
+		})
+	}
+	return map[string]interface{}{
+		"sessions":             list,
+		"total_buffered_bytes": buffered,
+		"total_resume_bytes":   resume,
+	}
+}
+
+func handleBufferMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bufferStats())
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestStreamCoalescesWhenCongested(t *testing.T) {
+	s := NewSession("s1", "dev-1", nil, nil)
+	rs := s.NewStream(context.Background(), "r1")
+	rs.started = true
+	rs.batch = BatchOptions{MaxBytes: maxCoalescedBytes}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	rs.sendLocked(ServerMsg{Op: "delta", Content: "a"}, true)
+	rs.sendLocked(ServerMsg{Op: "delta", Content: "b"}, true)
+	if s.pending.requests["r1"] != nil || len(s.held) != 1 {
+		t.Fatal("deltas sent while congested")
+	}
+	rs.sendLocked(ServerMsg{Op: "delta", Content: "c"}, false)
+	msgs := s.pending.requests["r1"].msgs
+	if len(msgs) != 1 || msgs[0].Content != "abc" || msgs[0].Seq != 1 || len(s.held) != 0 {
+		t.Fatalf("coalesced frame: %+v", msgs)
+	}
+	if n := s.flow.coalesced.Load(); n != 2 {
+		t.Errorf("coalesced = %d, want 2", n)
+	}
+
+	// A full frame goes out even while congested, and done flushes
+	rs.sendLocked(ServerMsg{Op: "delta", Content: strings.Repeat("x", maxCoalescedBytes)}, true)
+	rs.sendLocked(ServerMsg{Op: "delta", Content: "d"}, true)
+	rs.sendLocked(ServerMsg{Op: "done"}, true)
+	msgs = s.pending.requests["r1"].msgs
+	if len(msgs) != 4 || msgs[2].Content != "d" || msgs[3].Op != "done" || msgs[3].Seq != 4 {
+		t.Errorf("frames after congestion: %d", len(msgs))
+	}
+}
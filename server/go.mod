@@ -4,9 +4,15 @@ go 1.22
 
 require (
 	github.com/flynn/noise v1.0.0
+	github.com/fxamacker/cbor/v2 v2.9.2
 	github.com/keybase/go-keychain v0.0.1
 	github.com/montanaflynn/stats v0.7.1
 	github.com/pion/webrtc/v3 v3.2.35
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.32.0
+	golang.org/x/sys v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -29,8 +35,7 @@ require (
 	github.com/pion/turn/v2 v2.1.3 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
-	golang.org/x/crypto v0.32.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/net v0.22.0 // indirect
-	golang.org/x/sys v0.29.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
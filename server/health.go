@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// heartbeatInterval is how often the server pings each DataChannel
+	heartbeatInterval = 5 * time.Second
+	// heartbeatMisses unanswered pings count as a lost connection
+	heartbeatMisses = 3
+	// iceRestartTimeout bounds a restart from the new offer to reconnecting
+	iceRestartTimeout = 20 * time.Second
+)
+
+// restartPollTimeout is how long GET /signaling/restart waits for an offer
+var restartPollTimeout = 25 * time.Second
+
+var (
+	ErrNoRestart      = errors.New("no ICE restart in progress")
+	ErrRestartTimeout = errors.New("ICE restart timed out")
+)
+
+// PeerHealth watches one PeerConnection. When ICE drops or heartbeats go
+// unanswered it restarts ICE, offering new credentials over the DataChannel
+// and /signaling/restart, and closes the PeerConnection only if that fails.
+type PeerHealth struct {
+	PeerID   string
+	DeviceID string
+	pc       *webrtc.PeerConnection
+	// session returns the session the PeerConnection currently carries
+	session func() *Session
+	log     *slog.Logger
+
+	mu sync.Mutex
+	// up is set once ICE has connected; a connection that never came up
+	// has nothing to restart
+	up       bool
+	lastPong time.Time
+	// pongSeen is set once the client has answered a heartbeat; clients
+	// that never do are not timed out
+	pongSeen   bool
+	restarting bool
+	offer      string
+	// changed is closed and replaced whenever a restart offer is published
+	changed   chan struct{}
+	recovered chan struct{}
+	stop      chan struct{}
+	stopped   bool
+}
+
+// PeerHealthRegistry finds monitors by peer ID for the signaling endpoint
+type PeerHealthRegistry struct {
+	mu    sync.Mutex
+	peers map[string]*PeerHealth
+}
+
+func NewPeerHealthRegistry() *PeerHealthRegistry {
+	return &PeerHealthRegistry{peers: make(map[string]*PeerHealth)}
+}
+
+var peerHealth = NewPeerHealthRegistry()
+
+// Watch starts monitoring pc. Stop must be called when it closes.
+func (hr *PeerHealthRegistry) Watch(peerID, deviceID string, pc *webrtc.PeerConnection, session func() *Session, log *slog.Logger) *PeerHealth {
+	h := &PeerHealth{
+		PeerID:   peerID,
+		DeviceID: deviceID,
+		pc:       pc,
+		session:  session,
+		log:      log,
+		changed:  make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+	hr.mu.Lock()
+	hr.peers[peerID] = h
+	hr.mu.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Debug("peer connection state", "state", state.String())
+		if state == webrtc.PeerConnectionStateFailed && !h.Lost("connection failed") {
+			pc.Close()
+		}
+	})
+	return h
+}
+
+func (hr *PeerHealthRegistry) Get(peerID string) *PeerHealth {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	return hr.peers[peerID]
+}
+
+// Stop ends monitoring once the PeerConnection has closed
+func (h *PeerHealth) Stop() {
+	h.mu.Lock()
+	if !h.stopped {
+		h.stopped = true
+		close(h.stop)
+	}
+	h.mu.Unlock()
+
+	peerHealth.mu.Lock()
+	if peerHealth.peers[h.PeerID] == h {
+		delete(peerHealth.peers, h.PeerID)
+	}
+	peerHealth.mu.Unlock()
+}
+
+// Connected is called when ICE reaches connected or completed
+func (h *PeerHealth) Connected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.up = true
+	h.lastPong = time.Now()
+	if h.restarting {
+		h.restarting, h.offer = false, ""
+		close(h.recovered)
+		iceTelemetry.Restarted(h.PeerID)
+		h.log.Info("ice restart succeeded")
+	}
+}
+
+// Lost is called when ICE, the PeerConnection or the heartbeat reports the
+// connection gone. It starts an ICE restart unless one is running; false
+// means there is nothing to restart and the caller should close.
+func (h *PeerHealth) Lost(reason string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.restarting {
+		return true
+	}
+	if !h.up || h.stopped || sessions.Draining() {
+		return false
+	}
+	h.restarting = true
+	h.recovered = make(chan struct{})
+	go h.restart(reason, h.recovered)
+	return true
+}
+
+func (h *PeerHealth) restart(reason string, recovered chan struct{}) {
+	h.log.Warn("connection lost, restarting ice", "reason", reason)
+	iceTelemetry.Restart(h.PeerID)
+
+	offer, err := h.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err == nil {
+		gathered := webrtc.GatheringCompletePromise(h.pc)
+		if err = h.pc.SetLocalDescription(offer); err == nil {
+			<-gathered
+		}
+	}
+	if err != nil {
+		h.fail(err)
+		return
+	}
+
+	sdp := h.pc.LocalDescription().SDP
+	h.mu.Lock()
+	h.offer = sdp
+	close(h.changed)
+	h.changed = make(chan struct{})
+	h.mu.Unlock()
+
+	// Best effort: the DataChannel may still get through if only one
+	// path went down
+	if s := h.session(); s != nil {
+		s.Send(ServerMsg{Op: "ice_restart", PeerID: h.PeerID, SDP: sdp})
+	}
+
+	select {
+	case <-recovered:
+	case <-h.stop:
+	case <-time.After(iceRestartTimeout):
+		h.fail(ErrRestartTimeout)
+	}
+}
+
+// fail gives up on the PeerConnection. Closing it ends the session, or
+// detaches it for resumption.
+func (h *PeerHealth) fail(err error) {
+	h.mu.Lock()
+	if !h.restarting {
+		h.mu.Unlock()
+		return
+	}
+	h.restarting, h.offer = false, ""
+	h.mu.Unlock()
+
+	h.log.Warn("ice restart failed", "error", err)
+	iceTelemetry.Failed(h.PeerID, iceFailRestart)
+	h.pc.Close()
+}
+
+// Offer waits up to timeout for a restart offer
+func (h *PeerHealth) Offer(timeout time.Duration, cancel <-chan struct{}) (string, bool) {
+	deadline := time.After(timeout)
+	for {
+		h.mu.Lock()
+		offer, changed := h.offer, h.changed
+		h.mu.Unlock()
+		if offer != "" {
+			return offer, true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return "", false
+		case <-cancel:
+			return "", false
+		case <-h.stop:
+			return "", false
+		}
+	}
+}
+
+// Answer applies the client's answer to the restart offer
+func (h *PeerHealth) Answer(sdp string) error {
+	h.mu.Lock()
+	pending := h.restarting && h.offer != ""
+	h.mu.Unlock()
+	if !pending {
+		return ErrNoRestart
+	}
+	return h.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp})
+}
+
+// Pong records a heartbeat reply
+func (h *PeerHealth) Pong() {
+	h.mu.Lock()
+	h.lastPong = time.Now()
+	h.pongSeen = true
+	h.mu.Unlock()
+}
+
+// missed reports whether the client has stopped answering heartbeats
+func (h *PeerHealth) missed(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pongSeen && !h.restarting && now.Sub(h.lastPong) > heartbeatMisses*heartbeatInterval
+}
+
+// Heartbeat pings the client until the PeerConnection closes. It is
+// started when the DataChannel opens.
+func (h *PeerHealth) Heartbeat() {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-t.C:
+			if h.missed(now) {
+				if !h.Lost("heartbeat timeout") {
+					h.pc.Close()
+				}
+				continue
+			}
+			if s := h.session(); s != nil {
+				s.Send(ServerMsg{Op: "ping"})
+			}
+		}
+	}
+}
+
+// RestartAnswer is posted to /signaling/restart
+type RestartAnswer struct {
+	PeerID string `json:"peer_id"`
+	SDP    string `json:"sdp"`
+}
+
+// handleICERestart is the signaling side of ICE restarts. GET ?peer=<id>
+// long-polls for a restart offer (the signature covers the peer ID); POST
+// takes the answer (the signature covers the SDP).
+func handleICERestart(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		peerID := r.URL.Query().Get("peer")
+		deviceID, ok := authenticateSignaling(w, r, peerID)
+		if !ok {
+			return
+		}
+		h := peerHealth.Get(peerID)
+		if h == nil || h.DeviceID != deviceID {
+			http.Error(w, "Unknown peer", http.StatusNotFound)
+			return
+		}
+		offer, ok := h.Offer(restartPollTimeout, r.Context().Done())
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"peer_id": peerID, "sdp": offer})
+
+	case http.MethodPost:
+		var ans RestartAnswer
+		r.Body = http.MaxBytesReader(w, r.Body, maxSignalingBody)
+		if err := json.NewDecoder(r.Body).Decode(&ans); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		deviceID, ok := authenticateSignaling(w, r, ans.SDP)
+		if !ok {
+			return
+		}
+		h := peerHealth.Get(ans.PeerID)
+		if h == nil || h.DeviceID != deviceID {
+			http.Error(w, "Unknown peer", http.StatusNotFound)
+			return
+		}
+		if err := h.Answer(ans.SDP); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrNoRestart) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatMissed(t *testing.T) {
+	h := &PeerHealth{}
+	now := time.Now()
+	h.lastPong = now.Add(-time.Hour)
+	if h.missed(now) {
+		t.Error("client that never answered a heartbeat timed out")
+	}
+
+	h.Pong()
+	if h.missed(time.Now().Add(heartbeatInterval)) {
+		t.Error("timed out after one interval")
+	}
+	if !h.missed(time.Now().Add((heartbeatMisses + 1) * heartbeatInterval)) {
+		t.Error("missed heartbeats not detected")
+	}
+
+	// A restart in progress has its own deadline
+	h.restarting = true
+	if h.missed(time.Now().Add(time.Hour)) {
+		t.Error("heartbeat timeout during restart")
+	}
+}
+
+func TestRestartOfferAndAnswer(t *testing.T) {
+	h := &PeerHealth{changed: make(chan struct{}), stop: make(chan struct{})}
+	if err := h.Answer("v=0"); !errors.Is(err, ErrNoRestart) {
+		t.Errorf("answer without restart: %v", err)
+	}
+	if _, ok := h.Offer(10*time.Millisecond, nil); ok {
+		t.Error("offer returned without restart")
+	}
+
+	// A waiting poll gets the offer as soon as it is published
+	got := make(chan string, 1)
+	go func() {
+		offer, _ := h.Offer(time.Second, nil)
+		got <- offer
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.mu.Lock()
+	h.restarting, h.offer = true, "offer-sdp"
+	close(h.changed)
+	h.changed = make(chan struct{})
+	h.mu.Unlock()
+	if offer := <-got; offer != "offer-sdp" {
+		t.Errorf("polled offer = %q", offer)
+	}
+}
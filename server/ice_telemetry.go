@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ICE failure reasons reported in telemetry
+const (
+	iceFailBadOffer       = "bad_offer"
+	iceFailUnauthorized   = "unauthorized"
+	iceFailPeerConnection = "peer_connection"
+	iceFailNegotiation    = "negotiation"
+	iceFailICE            = "ice_failed"
+	iceFailClosedEarly    = "closed_before_connected"
+	iceFailRestart        = "ice_restart_failed"
+)
+
+const maxICESessions = 100
+
+// ICESessionInfo is the per-session debug view. It carries candidate types
+// and timings only, never addresses.
+type ICESessionInfo struct {
+	PeerID          string    `json:"peer_id"`
+	StartedAt       time.Time `json:"started_at"`
+	State           string    `json:"state"`
+	GatheringMs     int64     `json:"gathering_ms"`
+	ConnectMs       int64     `json:"connect_ms,omitempty"`
+	LocalCandidate  string    `json:"local_candidate,omitempty"`
+	RemoteCandidate string    `json:"remote_candidate,omitempty"`
+	RTTMs           float64   `json:"rtt_ms,omitempty"`
+	FailureReason   string    `json:"failure_reason,omitempty"`
+	Restarts        int       `json:"restarts,omitempty"`
+	connected       bool
+}
+
+// PairType classifies the selected pair by its least direct candidate
+func (s *ICESessionInfo) PairType() string {
+	if s.LocalCandidate == "relay" || s.RemoteCandidate == "relay" {
+		return "relay"
+	}
+	if s.LocalCandidate == "prflx" || s.RemoteCandidate == "prflx" {
+		return "prflx"
+	}
+	if s.LocalCandidate == "srflx" || s.RemoteCandidate == "srflx" {
+		return "srflx"
+	}
+	return s.LocalCandidate
+}
+
+// ICETelemetry collects anonymized connection metrics
+type ICETelemetry struct {
+	mu        sync.Mutex
+	sessions  map[string]*ICESessionInfo
+	order     []string
+	pairTypes map[string]int
+	failures  map[string]int
+	attempts  int
+	connected int
+	restarts  int
+	restarted int
+
+	// TTFTMetrics doubles as a generic millisecond percentile recorder
+	gathering *TTFTMetrics
+	connect   *TTFTMetrics
+	rtt       *TTFTMetrics
+}
+
+func NewICETelemetry() *ICETelemetry {
+	return &ICETelemetry{
+		sessions:  make(map[string]*ICESessionInfo),
+		pairTypes: make(map[string]int),
+		failures:  make(map[string]int),
+		gathering: &TTFTMetrics{},
+		connect:   &TTFTMetrics{},
+		rtt:       &TTFTMetrics{},
+	}
+}
+
+// Start registers a new signaling attempt
+func (it *ICETelemetry) Start(peerID string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.attempts++
+	it.sessions[peerID] = &ICESessionInfo{
+		PeerID:    peerID,
+		StartedAt: time.Now(),
+		State:     "new",
+	}
+	it.order = append(it.order, peerID)
+
+	// Keep only the most recent sessions for the debug view
+	if len(it.order) > maxICESessions {
+		delete(it.sessions, it.order[0])
+		it.order = it.order[1:]
+	}
+}
+
+func (it *ICETelemetry) Gathered(peerID string, d time.Duration) {
+	it.gathering.Record(d)
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if s, ok := it.sessions[peerID]; ok {
+		s.GatheringMs = d.Milliseconds()
+	}
+}
+
+func (it *ICETelemetry) StateChange(peerID string, state webrtc.ICEConnectionState) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if s, ok := it.sessions[peerID]; ok {
+		s.State = state.String()
+	}
+}
+
+// Connected records the selected pair and RTT once ICE has connected
+func (it *ICETelemetry) Connected(peerID string, pc *webrtc.PeerConnection) {
+	local, remote := selectedPairTypes(pc)
+	it.connectedPair(peerID, local, remote, selectedPairRTT(pc))
+}
+
+func (it *ICETelemetry) connectedPair(peerID, local, remote string, rtt float64) {
+	it.mu.Lock()
+	s, ok := it.sessions[peerID]
+	if !ok || s.connected {
+		it.mu.Unlock()
+		return
+	}
+	s.connected = true
+	s.LocalCandidate = local
+	s.RemoteCandidate = remote
+	s.RTTMs = rtt
+	connect := time.Since(s.StartedAt)
+	s.ConnectMs = connect.Milliseconds()
+	pairType := s.PairType()
+	it.connected++
+	it.pairTypes[pairType]++
+	it.mu.Unlock()
+
+	it.connect.Record(connect)
+	if rtt > 0 {
+		it.rtt.Record(time.Duration(rtt * float64(time.Millisecond)))
+	}
+	logger.Info("ice connected", logKeySession, peerID, "pair", pairType, "connect_ms", connect.Milliseconds(), "rtt_ms", rtt)
+}
+
+// Failed records why a session never got (or stayed) connected. Offers
+// rejected before Start are counted here but are not attempts.
+func (it *ICETelemetry) Failed(peerID, reason string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if s, ok := it.sessions[peerID]; ok {
+		if s.FailureReason != "" {
+			return
+		}
+		s.FailureReason = reason
+	}
+	it.failures[reason]++
+}
+
+// Restart records an ICE restart attempt on a connected session
+func (it *ICETelemetry) Restart(peerID string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.restarts++
+	if s, ok := it.sessions[peerID]; ok {
+		s.Restarts++
+	}
+}
+
+// Restarted records a restart that reconnected
+func (it *ICETelemetry) Restarted(peerID string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.restarted++
+}
+
+// Closed marks the end of a session
+func (it *ICETelemetry) Closed(peerID string) {
+	it.mu.Lock()
+	s, ok := it.sessions[peerID]
+	early := ok && !s.connected && s.FailureReason == ""
+	it.mu.Unlock()
+	if early {
+		it.Failed(peerID, iceFailClosedEarly)
+	}
+}
+
+// Session returns the debug view of one session
+func (it *ICETelemetry) Session(peerID string) (ICESessionInfo, bool) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	s, ok := it.sessions[peerID]
+	if !ok {
+		return ICESessionInfo{}, false
+	}
+	return *s, true
+}
+
+// Sessions returns the debug view of recent sessions, newest first
+func (it *ICETelemetry) Sessions() []ICESessionInfo {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	out := make([]ICESessionInfo, 0, len(it.order))
+	for i := len(it.order) - 1; i >= 0; i-- {
+		out = append(out, *it.sessions[it.order[i]])
+	}
+	return out
+}
+
+// Aggregate returns the anonymized metrics
+func (it *ICETelemetry) Aggregate() map[string]interface{} {
+	it.mu.Lock()
+	pairTypes := make(map[string]int, len(it.pairTypes))
+	for k, v := range it.pairTypes {
+		pairTypes[k] = v
+	}
+	failures := make(map[string]int, len(it.failures))
+	for k, v := range it.failures {
+		failures[k] = v
+	}
+	attempts, connected := it.attempts, it.connected
+	restarts, restarted := it.restarts, it.restarted
+	it.mu.Unlock()
+
+	turnRate := 0.0
+	if connected > 0 {
+		turnRate = float64(pairTypes["relay"]) / float64(connected)
+	}
+	successRate := 0.0
+	if attempts > 0 {
+		successRate = float64(connected) / float64(attempts)
+	}
+
+	gp50, gp90, _ := it.gathering.GetStats()
+	cp50, cp90, _ := it.connect.GetStats()
+	rp50, rp90, _ := it.rtt.GetStats()
+
+	return map[string]interface{}{
+		"attempts":         attempts,
+		"connected":        connected,
+		"success_rate":     successRate,
+		"turn_dependency":  turnRate,
+		"pair_types":       pairTypes,
+		"failures":         failures,
+		"restarts":         restarts,
+		"restarts_ok":      restarted,
+		"gathering_p50_ms": gp50,
+		"gathering_p90_ms": gp90,
+		"connect_p50_ms":   cp50,
+		"connect_p90_ms":   cp90,
+		"rtt_p50_ms":       rp50,
+		"rtt_p90_ms":       rp90,
+	}
+}
+
+// selectedPairTypes returns the candidate types of the selected pair
+func selectedPairTypes(pc *webrtc.PeerConnection) (local, remote string) {
+	sctp := pc.SCTP()
+	if sctp == nil || sctp.Transport() == nil || sctp.Transport().ICETransport() == nil {
+		return "", ""
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil || pair.Local == nil || pair.Remote == nil {
+		return "", ""
+	}
+	return pair.Local.Typ.String(), pair.Remote.Typ.String()
+}
+
+// selectedPairRTT returns the current RTT of the nominated pair in milliseconds
+func selectedPairRTT(pc *webrtc.PeerConnection) float64 {
+	for _, s := range pc.GetStats() {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		return pair.CurrentRoundTripTime * 1000
+	}
+	return 0
+}
+
+var iceTelemetry = NewICETelemetry()
+
+func handleICEMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(iceTelemetry.Aggregate())
+}
+
+// handleICEDebug serves the per-session view, optionally for a single peer
+func handleICEDebug(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if peerID := r.URL.Query().Get("peer"); peerID != "" {
+		s, ok := iceTelemetry.Session(peerID)
+		if !ok {
+			http.Error(w, "unknown peer", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+		return
+	}
+	json.NewEncoder(w).Encode(iceTelemetry.Sessions())
+}
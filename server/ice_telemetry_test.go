@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestICEPairType(t *testing.T) {
+	for _, tc := range []struct {
+		local, remote, want string
+	}{
+		{"host", "host", "host"},
+		{"host", "srflx", "srflx"},
+		{"srflx", "prflx", "prflx"},
+		{"relay", "host", "relay"},
+		{"prflx", "relay", "relay"},
+	} {
+		s := &ICESessionInfo{LocalCandidate: tc.local, RemoteCandidate: tc.remote}
+		if got := s.PairType(); got != tc.want {
+			t.Errorf("%s/%s: expected %q, got %q", tc.local, tc.remote, tc.want, got)
+		}
+	}
+}
+
+func TestICETelemetryAggregate(t *testing.T) {
+	it := NewICETelemetry()
+	// Rejected offers count as failures but not as attempts
+	it.Failed("peer-0", iceFailUnauthorized)
+
+	for _, tc := range []struct {
+		peer          string
+		local, remote string
+		rtt           float64
+		failure       string
+	}{
+		{peer: "peer-1", local: "host", remote: "host", rtt: 4},
+		{peer: "peer-2", local: "relay", remote: "srflx", rtt: 40},
+		{peer: "peer-3", failure: iceFailICE},
+		{peer: "peer-4"}, // closed before connecting
+	} {
+		it.Start(tc.peer)
+		it.Gathered(tc.peer, 20*time.Millisecond)
+		switch {
+		case tc.local != "":
+			it.connectedPair(tc.peer, tc.local, tc.remote, tc.rtt)
+		case tc.failure != "":
+			it.Failed(tc.peer, tc.failure)
+		}
+		it.Closed(tc.peer)
+	}
+	// A second connect or failure report does not count twice
+	it.connectedPair("peer-1", "host", "host", 4)
+	it.Failed("peer-3", iceFailNegotiation)
+
+	agg := it.Aggregate()
+	if agg["attempts"] != 4 || agg["connected"] != 2 || agg["success_rate"] != 0.5 || agg["turn_dependency"] != 0.5 {
+		t.Errorf("unexpected counts: %v", agg)
+	}
+	failures := agg["failures"].(map[string]int)
+	for reason, want := range map[string]int{iceFailUnauthorized: 1, iceFailICE: 1, iceFailClosedEarly: 1, iceFailNegotiation: 0} {
+		if failures[reason] != want {
+			t.Errorf("failures[%s] = %d, want %d", reason, failures[reason], want)
+		}
+	}
+	if pt := agg["pair_types"].(map[string]int); pt["host"] != 1 || pt["relay"] != 1 {
+		t.Errorf("unexpected pair types: %v", pt)
+	}
+	if agg["gathering_p50_ms"] != 20.0 || agg["rtt_p50_ms"] != 4.0 {
+		t.Errorf("unexpected timings: %v", agg)
+	}
+
+	s, ok := it.Session("peer-2")
+	if !ok || s.GatheringMs != 20 || s.RTTMs != 40 || s.PairType() != "relay" {
+		t.Errorf("unexpected session view: %+v", s)
+	}
+	if _, ok := it.Session("peer-0"); ok {
+		t.Error("rejected offer got a session entry")
+	}
+}
+
+func TestICETelemetryKeepsRecentSessions(t *testing.T) {
+	it := NewICETelemetry()
+	for i := 0; i < maxICESessions+10; i++ {
+		it.Start(time.Duration(i).String())
+	}
+	sessions := it.Sessions()
+	if len(sessions) != maxICESessions || sessions[0].PeerID != time.Duration(maxICESessions+9).String() {
+		t.Errorf("expected the %d newest sessions, newest first", maxICESessions)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// KeyStore persists key material as owner-only files under the data
+// directory. It is used for the TLS identity and anything else that must
+// survive restarts; private keys never leave this directory.
+type KeyStore struct {
+	dir string
+}
+
+var validKeyName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+func OpenKeyStore(dir string) (*KeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Tighten permissions in case the directory already existed
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &KeyStore{dir: dir}, nil
+}
+
+func (ks *KeyStore) path(name string) (string, error) {
+	if !validKeyName.MatchString(name) {
+		return "", errors.New("invalid key name")
+	}
+	return filepath.Join(ks.dir, name), nil
+}
+
+// Load returns the stored item, or os.ErrNotExist if there is none
+func (ks *KeyStore) Load(name string) ([]byte, error) {
+	p, err := ks.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+// Save writes the item atomically with 0600 permissions
+func (ks *KeyStore) Save(name string, data []byte) error {
+	p, err := ks.path(name)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (ks *KeyStore) Delete(name string) error {
+	p, err := ks.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (ks *KeyStore) Dir() string { return ks.dir }
+
+var keyStore *KeyStore
+
+func initKeyStore() {
+	var err error
+	keyStore, err = OpenKeyStore(filepath.Join(dataDir(), "keys"))
+	if err != nil {
+		fatal("failed to open key store", "error", err)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Structured log field keys
+const (
+	logKeySession = "session"
+	logKeyPeer    = "peer"
+	logKeyModel   = "model"
+	logKeyRequest = "request_id"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys and struct fields whose values must never
+// reach the log. Keys are compared lowercased with '_' and '-' removed.
+var sensitiveKeys = map[string]bool{
+	"prompt":        true,
+	"content":       true,
+	"messages":      true,
+	"images":        true,
+	"noiseinit":     true,
+	"noiseresponse": true,
+	"privatekey":    true,
+	"key":           true,
+	"psk":           true,
+	"secret":        true,
+	"token":         true,
+	"password":      true,
+	"credential":    true,
+	"authorization": true,
+}
+
+func isSensitiveKey(k string) bool {
+	k = strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(k))
+	if sensitiveKeys[k] {
+		return true
+	}
+	return strings.HasSuffix(k, "privatekey") || strings.HasSuffix(k, "secret") || strings.HasSuffix(k, "token")
+}
+
+// redactHandler strips payloads and key material from every record before
+// passing it on. Messages themselves must be constant strings; variable data
+// goes into attributes so it can be filtered here.
+type redactHandler struct {
+	next slog.Handler
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	nr := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		nr.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, nr)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		clean[i] = redactAttr(a)
+	}
+	return &redactHandler{next: h.next.WithAttrs(clean)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	if isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	return slog.Attr{Key: a.Key, Value: redactValue(a.Value, 0)}
+}
+
+// redactValue walks groups, structs, maps and slices so that nested
+// payload fields are caught as well as top-level attributes
+func redactValue(v slog.Value, depth int) slog.Value {
+	v = v.Resolve()
+	if depth > 8 {
+		return slog.StringValue("[TRUNCATED]")
+	}
+
+	switch v.Kind() {
+	case slog.KindGroup:
+		attrs := v.Group()
+		clean := make([]slog.Attr, len(attrs))
+		for i, a := range attrs {
+			if isSensitiveKey(a.Key) {
+				clean[i] = slog.String(a.Key, redacted)
+			} else {
+				clean[i] = slog.Attr{Key: a.Key, Value: redactValue(a.Value, depth+1)}
+			}
+		}
+		return slog.GroupValue(clean...)
+	case slog.KindAny:
+	default:
+		return v
+	}
+
+	switch x := v.Any().(type) {
+	case nil:
+		return v
+	case error:
+		return slog.StringValue(x.Error())
+	case []byte:
+		// Raw bytes are handshake or key material more often than not
+		return slog.StringValue(fmt.Sprintf("[%d bytes]", len(x)))
+	}
+
+	rv := reflect.ValueOf(v.Any())
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return slog.StringValue("<nil>")
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		var attrs []slog.Attr
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := f.Name
+			if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			if isSensitiveKey(name) || isSensitiveKey(f.Name) {
+				attrs = append(attrs, slog.String(name, redacted))
+				continue
+			}
+			attrs = append(attrs, slog.Attr{Key: name, Value: redactValue(slog.AnyValue(rv.Field(i).Interface()), depth+1)})
+		}
+		return slog.GroupValue(attrs...)
+	case reflect.Map:
+		var attrs []slog.Attr
+		iter := rv.MapRange()
+		for iter.Next() {
+			k := fmt.Sprint(iter.Key().Interface())
+			if isSensitiveKey(k) {
+				attrs = append(attrs, slog.String(k, redacted))
+				continue
+			}
+			attrs = append(attrs, slog.Attr{Key: k, Value: redactValue(slog.AnyValue(iter.Value().Interface()), depth+1)})
+		}
+		return slog.GroupValue(attrs...)
+	case reflect.Slice, reflect.Array:
+		attrs := make([]slog.Attr, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			attrs[i] = slog.Attr{Key: strconv.Itoa(i), Value: redactValue(slog.AnyValue(rv.Index(i).Interface()), depth+1)}
+		}
+		return slog.GroupValue(attrs...)
+	}
+	return v
+}
+
+// fanoutHandler writes every record to several handlers
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range f {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanoutHandler, len(f))
+	for i, h := range f {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	out := make(fanoutHandler, len(f))
+	for i, h := range f {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// newLogger builds a redacting logger writing text to w and, if jsonSink is
+// non-nil, JSON lines to jsonSink
+func newLogger(w io.Writer, jsonSink io.Writer, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if jsonSink != nil {
+		h = fanoutHandler{h, slog.NewJSONHandler(jsonSink, opts)}
+	}
+	return slog.New(&redactHandler{next: h})
+}
+
+// logHandler is the configured handler behind logger. A reload swaps it
+// instead of replacing logger, which is read without a lock everywhere.
+var logHandler atomic.Pointer[slog.Handler]
+
+var logger = newSwapLogger(newLogger(os.Stderr, nil, slog.LevelInfo).Handler())
+
+func newSwapLogger(h slog.Handler) *slog.Logger {
+	logHandler.Store(&h)
+	return slog.New(&swapHandler{})
+}
+
+// swapHandler passes records to the current logHandler. Loggers derived
+// with With or WithGroup replay those calls on it, so they follow a swap.
+type swapHandler struct {
+	derive []func(slog.Handler) slog.Handler
+	cache  atomic.Pointer[derivedHandler]
+}
+
+type derivedHandler struct {
+	base, h slog.Handler
+}
+
+func (s *swapHandler) current() slog.Handler {
+	base := *logHandler.Load()
+	if len(s.derive) == 0 {
+		return base
+	}
+	if d := s.cache.Load(); d != nil && d.base == base {
+		return d.h
+	}
+	h := base
+	for _, f := range s.derive {
+		h = f(h)
+	}
+	s.cache.Store(&derivedHandler{base: base, h: h})
+	return h
+}
+
+func (s *swapHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.current().Enabled(ctx, level)
+}
+
+func (s *swapHandler) Handle(ctx context.Context, r slog.Record) error {
+	return s.current().Handle(ctx, r)
+}
+
+func (s *swapHandler) with(f func(slog.Handler) slog.Handler) slog.Handler {
+	return &swapHandler{derive: append(slices.Clip(s.derive), f)}
+}
+
+func (s *swapHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return s.with(func(h slog.Handler) slog.Handler { return h.WithAttrs(attrs) })
+}
+
+func (s *swapHandler) WithGroup(name string) slog.Handler {
+	return s.with(func(h slog.Handler) slog.Handler { return h.WithGroup(name) })
+}
+
+// logSink is the open log.json_path file, closed when a reload replaces it
+var logSink *os.File
+
+// initLogging configures the global logger from log.level and log.json_path
+// and routes the standard log package through it
+func initLogging() {
+	if err := configureLogging(); err != nil {
+		fatal("failed to open JSON log sink", "path", cfg().Log.JSONPath, "error", err)
+	}
+}
+
+// configureLogging applies the log section; on error the logger is unchanged
+func configureLogging() error {
+	ls, err := openLogging(cfg().Log)
+	if err != nil {
+		return err
+	}
+	ls.use()
+	return nil
+}
+
+// logSetup is a log section opened but not yet in use
+type logSetup struct {
+	handler  slog.Handler
+	sink     *os.File
+	levelErr error
+}
+
+// openLogging prepares lc without touching the running logger
+func openLogging(lc LogConfig) (*logSetup, error) {
+	level := slog.LevelInfo
+	levelErr := level.UnmarshalText([]byte(lc.Level))
+
+	var sink io.Writer
+	var f *os.File
+	if lc.JSONPath != "" {
+		var err error
+		f, err = os.OpenFile(lc.JSONPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		sink = f
+	}
+	return &logSetup{handler: newLogger(os.Stderr, sink, level).Handler(), sink: f, levelErr: levelErr}, nil
+}
+
+// use makes ls the handler of logger and closes the sink it replaces
+func (ls *logSetup) use() {
+	logHandler.Store(&ls.handler)
+	slog.SetDefault(logger)
+	if logSink != nil {
+		logSink.Close()
+	}
+	logSink = ls.sink
+	if ls.levelErr != nil {
+		logger.Warn("invalid LOG_LEVEL, using info", "error", ls.levelErr)
+	}
+}
+
+// fatal logs at error level and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newRequestID returns a short random identifier for correlating log lines
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LogValue keeps payloads out of structured logs
+func (m ClientMsg) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("op", m.Op),
+		slog.String(logKeyModel, m.Model),
+		slog.Bool("stream", m.Stream),
+		slog.Int("prompt_len", len(m.Prompt)),
+	)
+}
+
+// String keeps payloads out of fmt-based logging such as log.Printf("%v")
+func (m ClientMsg) String() string {
+	return fmt.Sprintf("ClientMsg{op=%s model=%s prompt_len=%d}", m.Op, m.Model, len(m.Prompt))
+}
+
+func (m ClientMsg) GoString() string { return m.String() }
+
+func (m ServerMsg) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("op", m.Op),
+		slog.String("error", m.Error),
+		slog.Int("content_len", len(m.Content)),
+	)
+}
+
+func (m ServerMsg) String() string {
+	return fmt.Sprintf("ServerMsg{op=%s content_len=%d}", m.Op, len(m.Content))
+}
+
+func (m ServerMsg) GoString() string { return m.String() }
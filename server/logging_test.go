@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogRedactsClientPayloads(t *testing.T) {
+	const secret = "my-secret-prompt"
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	var text, jsonl bytes.Buffer
+	l := newLogger(&text, &jsonl, slog.LevelDebug)
+
+	cm := ClientMsg{
+		Op:            "chat",
+		Model:         "qwen3:1.7b",
+		Prompt:        secret,
+		NoiseInit:     key,
+		NoiseResponse: key,
+	}
+	sm := ServerMsg{Op: "delta", Content: secret}
+
+	// Every way a payload could plausibly be handed to the logger
+	l.Info("client message", "msg", cm)
+	l.Info("client message", "msg", &cm)
+	l.Info("client message", slog.Any("msg", []ClientMsg{cm}))
+	l.Info("client message", "prompt", cm.Prompt, "content", sm.Content)
+	l.Info("client message", "payload", map[string]interface{}{"prompt": secret, "nested": map[string]string{"content": secret}})
+	l.Info("server message", "msg", sm)
+	l.With("prompt", secret).Info("with attrs")
+	l.WithGroup("req").Info("grouped", "content", secret, "private_key", key)
+	l.Debug("noise", "noise_init", cm.NoiseInit, "raw", key)
+	l.Info("anonymous struct", "body", struct {
+		Messages []map[string]string `json:"messages"`
+	}{Messages: []map[string]string{{"role": "user", "content": secret}}})
+
+	// fmt-based logging through the standard library
+	var std bytes.Buffer
+	stdLog := log.New(&std, "", 0)
+	stdLog.Printf("%v %+v %#v %s", cm, cm, cm, cm)
+	stdLog.Print(sm, &cm)
+	text.WriteString(std.String())
+	text.WriteString(fmt.Sprint(cm))
+
+	for name, out := range map[string]string{"text": text.String(), "json": jsonl.String()} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("%s log output contains prompt payload:\n%s", name, out)
+		}
+		if strings.Contains(out, string(key)) {
+			t.Fatalf("%s log output contains key material:\n%s", name, out)
+		}
+	}
+
+	// Metadata is still logged
+	if !strings.Contains(jsonl.String(), `"op":"chat"`) || !strings.Contains(jsonl.String(), "qwen3:1.7b") {
+		t.Fatalf("Expected op and model in JSON output:\n%s", jsonl.String())
+	}
+}
+
+func TestSensitiveKeys(t *testing.T) {
+	for _, k := range []string{"prompt", "Prompt", "content", "noise_init", "NoiseResponse", "private_key", "api-token", "TURN_PASS_secret"} {
+		if !isSensitiveKey(k) {
+			t.Errorf("Expected %q to be redacted", k)
+		}
+	}
+	for _, k := range []string{"op", "model", "public_key", "ttft_ms", "completion_tokens", logKeySession, logKeyRequest} {
+		if isSensitiveKey(k) {
+			t.Errorf("Expected %q to be logged", k)
+		}
+	}
+}
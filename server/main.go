@@ -3,16 +3,22 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"bufio"
 
@@ -20,8 +26,17 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
-type Offer struct{ SDP string `json:"sdp"` }
-type Answer struct{ SDP string `json:"sdp"` }
+type Offer struct {
+	SDP string `json:"sdp"`
+	// Channels says who creates the DataChannels: "server", "client"
+	// (default) or "negotiated"
+	Channels string `json:"channels,omitempty"`
+}
+type Answer struct {
+	SDP string `json:"sdp"`
+	// PeerID addresses this PeerConnection on /signaling/restart
+	PeerID string `json:"peer_id"`
+}
 
 type ClientMsg struct {
 	Op     string `json:"op"`
@@ -31,30 +46,93 @@ type ClientMsg struct {
 	// Noise handshake messages
 	NoiseInit     []byte `json:"noise_init,omitempty"`
 	NoiseResponse []byte `json:"noise_response,omitempty"`
+	// Static key the handshake targets; empty means the current key
+	KeyID string `json:"key_id,omitempty"`
+	// Client-chosen ID for a chat; the server picks one if empty
+	RequestID string `json:"request_id,omitempty"`
+	// resume: the ticket and the last seq received per request
+	Ticket string         `json:"ticket,omitempty"`
+	Acks   map[string]int `json:"acks,omitempty"`
+	// ack: the last seq received for RequestID
+	Seq int `json:"seq,omitempty"`
+	// ice_answer: the answer to a server ICE restart offer
+	SDP string `json:"sdp,omitempty"`
+	// stream_options: requested delta batching
+	Batch *BatchOptions `json:"batch,omitempty"`
+	// hello: wire encodings the client accepts, preferred first
+	Encodings []string `json:"encodings,omitempty"`
+	// chat: images small enough to send inline, and the IDs of images
+	// sent earlier with attach
+	Images      [][]byte `json:"images,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+	// attach: one chunk of a large image
+	Attachment *AttachmentChunk `json:"attachment,omitempty"`
+	// chat: names of the tools the model may call
+	Tools []string `json:"tools,omitempty"`
+	// chat: "json" or a JSON schema the answer must match
+	Format interface{} `json:"format,omitempty"`
+	// tool_approval: the device's answer for a sensitive tool call
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	Approved   bool   `json:"approved,omitempty"`
 }
 
 type ServerMsg struct {
 	Op      string `json:"op"`
 	Content string `json:"content,omitempty"`
 	Error   string `json:"error,omitempty"`
+	// Machine-readable reason on error and done, e.g. "shutdown"
+	Code string `json:"code,omitempty"`
 	// Noise handshake messages
 	NoiseInit     []byte `json:"noise_init,omitempty"`
 	NoiseResponse []byte `json:"noise_response,omitempty"`
 	// E2E status
 	E2EEstablished bool   `json:"e2e_established,omitempty"`
 	PublicKey      string `json:"public_key,omitempty"`
+	// Token accounting, set on done
+	Usage *UsageStats `json:"usage,omitempty"`
+	// Static key rotation announcement, sent over E2E only
+	KeyRotation *KeyRotation `json:"key_rotation,omitempty"`
+	// Set on generation output so it can be acknowledged and replayed
+	RequestID string `json:"request_id,omitempty"`
+	Seq       int    `json:"seq,omitempty"`
+	// Single-use ticket for the resume op, sent over E2E only
+	ResumeTicket string `json:"resume_ticket,omitempty"`
+	// ice_restart: the restart offer and the peer it belongs to
+	PeerID string `json:"peer_id,omitempty"`
+	SDP    string `json:"sdp,omitempty"`
+	// stream_options: the batching now in effect
+	Batch *BatchOptions `json:"batch,omitempty"`
+	// hello: the wire encoding used from this message on
+	Encoding string `json:"encoding,omitempty"`
+	// tool_call and tool_result events of a chat
+	Tool *ToolEvent `json:"tool,omitempty"`
+	// tools: the tools a chat may name
+	Tools []ToolInfo `json:"tools,omitempty"`
 }
 
-// TTFTMetrics tracks Time To First Token measurements
+// maxTTFTSamples bounds the measurements kept for percentiles
+const maxTTFTSamples = 1024
+
+// TTFTMetrics tracks Time To First Token measurements. Percentiles cover
+// the last maxTTFTSamples; count is every measurement recorded.
 type TTFTMetrics struct {
 	mu          sync.Mutex
 	measurements []float64
+	next         int
+	count        int
 }
 
 func (m *TTFTMetrics) Record(ttft time.Duration) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.measurements = append(m.measurements, float64(ttft.Milliseconds()))
+	ms := float64(ttft.Milliseconds())
+	if len(m.measurements) < maxTTFTSamples {
+		m.measurements = append(m.measurements, ms)
+	} else {
+		m.measurements[m.next] = ms
+	}
+	m.next = (m.next + 1) % maxTTFTSamples
+	m.count++
 }
 
 func (m *TTFTMetrics) GetStats() (p50, p90 float64, count int) {
@@ -63,51 +141,96 @@ func (m *TTFTMetrics) GetStats() (p50, p90 float64, count int) {
 	if len(m.measurements) == 0 {
 		return 0, 0, 0
 	}
-	data := stats.LoadRawData(m.measurements)
+	// Percentile sorts its input, so work on a copy of the ring
+	data := stats.LoadRawData(append([]float64(nil), m.measurements...))
 	p50, _ = stats.Percentile(data, 50)
 	p90, _ = stats.Percentile(data, 90)
-	return p50, p90, len(m.measurements)
+	return p50, p90, m.count
 }
 
 var (
 	ttftMetrics   = &TTFTMetrics{}
 	noiseManager  *NoiseManager
-	strictLocalMode = true
 )
 
+// strictLocalMode reports strict_local.enabled; a reload can change it
+func strictLocalMode() bool { return cfg().StrictLocal.Enabled }
+
 func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// serve runs the server until SIGINT or SIGTERM
+func serve(args []string) int {
+	path, flags := parseConfigFlags(flag.NewFlagSet("serve", flag.ExitOnError), args)
+	initConfig(path, flags)
+	initLogging()
+	initAuditLog()
+	initKeyStore()
+	initTLS()
+	initDeviceRegistry()
+	initSignalingAuth()
+	initAPIKeys()
+
+	// Check Strict Local Mode before any outbound client is created
+	if !strictLocalMode() {
+		logger.Warn("strict local mode is disabled")
+	} else {
+		logger.Info("strict local mode is enabled")
+	}
+	initNetPolicy()
+	initEgressGuard()
+	initCORS()
+
 	// Initialize Ollama manager for model optimization
 	initOllamaManager()
 	initFastOllama()
+	initModelCapabilities()
+	initTools()
 	
 	// Initialize Noise manager
 	var err error
-	devMode := os.Getenv("DEV_MODE") == "1"
-	noiseManager, err = NewNoiseManager(devMode)
+	devMode := cfg().Dev.Enabled
+	noiseManager, err = NewNoiseManager(devMode, keyStore)
 	if err != nil {
-		log.Fatalf("Failed to initialize Noise: %v", err)
+		fatal("failed to initialize noise", "error", err)
 	}
-	log.Printf("Noise public key: %s", noiseManager.GetPublicKey())
+	logger.Info("noise ready", "public_key", noiseManager.GetPublicKey(), "key_id", noiseManager.Fingerprint())
 
-	// Check Strict Local Mode
-	if os.Getenv("DISABLE_STRICT_LOCAL") == "1" {
-		strictLocalMode = false
-		log.Println("WARNING: Strict Local Mode is DISABLED")
-	} else {
-		log.Println("Strict Local Mode is ENABLED (default)")
-	}
+	auditLog.Record(auditServerStarted, map[string]string{
+		"strict_local": fmt.Sprint(strictLocalMode()),
+		"dev_mode":     fmt.Sprint(devMode),
+	})
 
+	addr := cfg().Listen
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { 
 		fmt.Fprintln(w, "ok") 
 	})
 	mux.HandleFunc("/signaling/offer", handleOffer)
+	mux.HandleFunc("/signaling/restart", handleICERestart)
 	mux.HandleFunc("/metrics/ttft", handleTTFTMetrics)
+	// Usage is broken down per device and API key
+	mux.Handle("/metrics/usage", adminAccess(http.HandlerFunc(handleUsageMetrics)))
+	mux.Handle("/metrics/ice", adminAccess(http.HandlerFunc(handleICEMetrics)))
+	mux.HandleFunc("/metrics/netpolicy", handleNetPolicyMetrics)
+	mux.HandleFunc("/metrics/egress", handleEgressMetrics)
+	mux.Handle("/metrics/buffers", adminAccess(http.HandlerFunc(handleBufferMetrics)))
+	mux.Handle("/debug/ice", adminAccess(http.HandlerFunc(handleICEDebug)))
 	mux.HandleFunc("/noise/pubkey", handleNoisePubKey)
-	mux.HandleFunc("/api/chat", handleChatProxy)
+	mux.Handle("/api/chat", requireAPIKey(scopeChat, http.HandlerFunc(handleChatProxy)))
+	mux.Handle("/api/models", requireAPIKey(scopeModels, http.HandlerFunc(handleModelsProxy)))
+	mux.Handle("/pairing/payload", loopbackOnly(handlePairingPayload(addr)))
+	mux.Handle("/pairing/start", loopbackOnly(handlePairingStart(addr)))
+	mux.HandleFunc("/pairing/complete", handlePairingComplete)
+	mux.Handle("/admin/devices", adminAccess(http.HandlerFunc(handleDevices)))
+	mux.Handle("/admin/audit", adminAccess(http.HandlerFunc(handleAuditQuery)))
+	mux.Handle("/admin/audit/verify", adminAccess(http.HandlerFunc(handleAuditVerify)))
+	mux.Handle("/admin/keys", adminAccess(http.HandlerFunc(handleAPIKeys)))
+	mux.Handle("/admin/config", adminAccess(http.HandlerFunc(handleAdminConfig)))
 	
-	addr := ":8443"
-	log.Printf("listening on %s", addr)
+	initAdminSocket()
+	logger.Info("listening", "addr", addr, "tls", tlsState.Mode)
 	
 	// Create custom server with local-only listener if strict mode
 	server := &http.Server{
@@ -115,18 +238,76 @@ func main() {
 		Handler: cors(localOnly(mux)),
 	}
 	
-	if strictLocalMode {
-		// Custom listener that only accepts local connections
-		ln, err := net.Listen("tcp", addr)
-		if err != nil {
-			log.Fatal(err)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("listen failed", "addr", addr, "error", err)
+	}
+	// In strict local mode non-local peers are dropped before the TLS
+	// handshake. The listener is always installed so a reload can turn the
+	// mode on.
+	ln = &strictLocalListener{ln}
+	if tlsState.Config != nil {
+		ln = tls.NewListener(ln, tlsState.Config)
+	}
+	if tlsState.challenge != nil {
+		go serveACMEChallenges(cfg().TLS.ACMEChallengeListen, tlsState.challenge)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve(ln) }()
+
+	// SIGHUP reloads configuration; SIGINT and SIGTERM drain and exit
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case err := <-serveErr:
+			fatal("server stopped", "error", err)
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if err := reloadConfig("sighup"); err != nil {
+					logger.Error("configuration reload failed, keeping current settings", "error", err)
+				}
+				continue
+			}
+			shutdown(server, sig.String())
+			return 0
 		}
-		log.Fatal(server.Serve(&strictLocalListener{ln}))
-	} else {
-		log.Fatal(server.ListenAndServe())
 	}
 }
 
+// shutdown stops accepting connections, lets in-flight generations and HTTP
+// streams finish until shutdown_timeout (default 30s), then closes everything
+func shutdown(server *http.Server, reason string) {
+	timeout := cfg().shutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	logger.Info("shutting down", "reason", reason, "timeout", timeout, "sessions", len(sessions.List()))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sessions.Drain(ctx)
+	}()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("HTTP drain deadline reached, closing connections", "error", err)
+		server.Close()
+	}
+	wg.Wait()
+
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	if om := globalOllamaManager(); om != nil {
+		om.Close()
+	}
+	closeAPIKeys()
+	auditLog.Record(auditServerStopped, map[string]string{"reason": reason})
+	auditLog.Close()
+	logger.Info("server stopped")
+}
+
 // strictLocalListener wraps a listener to only accept local connections
 type strictLocalListener struct {
 	net.Listener
@@ -140,98 +321,32 @@ func (s *strictLocalListener) Accept() (net.Conn, error) {
 		}
 		
 		// Check if connection is from local network
-		if isLocalConnection(conn) {
+		if !strictLocalMode() || isLocalConnection(conn, "listener") {
 			return conn, nil
 		}
 		
 		// Reject non-local connections
 		conn.Close()
-		log.Printf("Rejected non-local connection from %s", conn.RemoteAddr())
+		logger.Warn("rejected non-local connection", "remote", conn.RemoteAddr().String())
+		auditLog.RecordLimited(auditRejectedNonLocal, map[string]string{
+			"remote": conn.RemoteAddr().String(),
+			"layer":  "listener",
+		})
 	}
 }
 
-func isLocalConnection(conn net.Conn) bool {
+func isLocalConnection(conn net.Conn, layer string) bool {
 	addr := conn.RemoteAddr().String()
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return false
 	}
-	
-	ip := net.ParseIP(host)
-	if ip == nil {
-		return false
-	}
-	
-	// Allow loopback
-	if ip.IsLoopback() {
-		return true
-	}
-	
-	// Allow private networks (RFC1918)
-	if ip.IsPrivate() {
-		return true
-	}
-	
-	// Allow link-local
-	if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-		return true
-	}
-	
-	// Check for Tailscale CGNAT range (100.64.0.0/10)
-	if ip.To4() != nil {
-		if ip[0] == 100 && ip[1] >= 64 && ip[1] <= 127 {
-			return true
-		}
-	}
-	
-	return false
-}
-
-func cors(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// In strict local mode, only allow CORS from local origins
-		origin := r.Header.Get("Origin")
-		if strictLocalMode && origin != "" {
-			// Parse origin URL properly
-			if strings.HasPrefix(origin, "file://") {
-				// Allow file:// origins for local HTML files
-			} else if strings.HasPrefix(origin, "http://localhost") || 
-					  strings.HasPrefix(origin, "http://127.0.0.1") ||
-					  strings.HasPrefix(origin, "http://[::1]") {
-				// Allow localhost origins
-			} else {
-				// Check if it's a local IP
-				if u, err := url.Parse(origin); err == nil {
-					if host, _, err := net.SplitHostPort(u.Host); err == nil {
-						if ip := net.ParseIP(host); ip != nil && !isLocalIP(ip) {
-							http.Error(w, "Forbidden: non-local origin", 403)
-							return
-						}
-					} else {
-						// No port in URL
-						if ip := net.ParseIP(u.Host); ip != nil && !isLocalIP(ip) {
-							http.Error(w, "Forbidden: non-local origin", 403)
-							return
-						}
-					}
-				}
-			}
-		}
-		
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "content-type")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(204)
-			return
-		}
-		h.ServeHTTP(w, r)
-	})
+	return netPolicy.Permit(net.ParseIP(host), layer, addr)
 }
 
 func localOnly(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strictLocalMode {
+		if strictLocalMode() {
 			// Check if request is from local network
 			host, _, err := net.SplitHostPort(r.RemoteAddr)
 			if err != nil {
@@ -239,8 +354,12 @@ func localOnly(h http.Handler) http.Handler {
 				return
 			}
 			
-			ip := net.ParseIP(host)
-			if !isLocalIP(ip) {
+			if !netPolicy.Permit(net.ParseIP(host), "http", r.RemoteAddr) {
+				auditLog.RecordLimited(auditRejectedNonLocal, map[string]string{
+					"remote": r.RemoteAddr,
+					"layer":  "http",
+					"path":   r.URL.Path,
+				})
 				http.Error(w, "Forbidden: non-local access", 403)
 				return
 			}
@@ -249,19 +368,30 @@ func localOnly(h http.Handler) http.Handler {
 	})
 }
 
+// loopbackOnly restricts admin endpoints to requests from this machine
+func loopbackOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackRequest(r) {
+			http.Error(w, "Forbidden: admin endpoints are loopback only", 403)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isLoopbackRequest(r *http.Request) bool {
+	ip := net.ParseIP(remoteHost(r))
+	return ip != nil && ip.IsLoopback()
+}
+
+// isLocalIP reports whether the network policy treats ip as local
 func isLocalIP(ip net.IP) bool {
-	if ip == nil {
-		return false
-	}
-	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || 
-		(ip.To4() != nil && ip[0] == 100 && ip[1] >= 64 && ip[1] <= 127) // Tailscale CGNAT
+	return ip != nil && netPolicy.Allowed(ip)
 }
 
 func handleNoisePubKey(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"public_key": noiseManager.GetPublicKey(),
-	})
+	json.NewEncoder(w).Encode(noiseManager.RotationState())
 }
 
 func handleTTFTMetrics(w http.ResponseWriter, r *http.Request) {
@@ -275,176 +405,390 @@ func handleTTFTMetrics(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleOffer(w http.ResponseWriter, r *http.Request) {
+	// Generate peer ID for this connection
+	peerID := fmt.Sprintf("peer-%d", time.Now().UnixNano())
+
+	if sessions.Draining() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	var off Offer
+	r.Body = http.MaxBytesReader(w, r.Body, maxSignalingBody)
 	if err := json.NewDecoder(r.Body).Decode(&off); err != nil {
+		iceTelemetry.Failed(peerID, iceFailBadOffer)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	mode, err := offerChannelMode(off)
+	if err != nil {
+		iceTelemetry.Failed(peerID, iceFailBadOffer)
 		http.Error(w, err.Error(), 400)
 		return
 	}
 
+	// Require proof of pairing before any WebRTC state is created
+	deviceID, ok := authenticateSignaling(w, r, off.SDP)
+	if !ok {
+		iceTelemetry.Failed(peerID, iceFailUnauthorized)
+		return
+	}
+	// Only accepted offers are attempts with an entry of their own
+	iceTelemetry.Start(peerID)
+
 	api := webrtc.NewAPI()
 	pc, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-			{URLs: envURLs("TURN_URLS"), Username: os.Getenv("TURN_USER"), Credential: os.Getenv("TURN_PASS")},
-		},
+		ICEServers: currentConfig().ICEServers,
 	})
 	if err != nil {
+		iceTelemetry.Failed(peerID, iceFailPeerConnection)
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	defer pc.Close()
 
-	// Generate peer ID for this connection
-	peerID := fmt.Sprintf("peer-%d", time.Now().UnixNano())
-	var e2eEstablished bool
-	var sessionMux sync.RWMutex
+	// The PeerConnection outlives this handler once answered and is then
+	// closed with its session. Until then every return below closes it here,
+	// as the deferred pc.Close() did before.
+	answered := false
+	defer func() {
+		if !answered {
+			pc.Close()
+		}
+	}()
 
-	dc, err := pc.CreateDataChannel("llm", nil)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	// active is the session this PeerConnection carries. It starts as a new
+	// session and is swapped if the client resumes an earlier one.
+	var active atomic.Pointer[Session]
+
+	sessionLog := logger.With(logKeySession, peerID, logKeyPeer, deviceID)
+	health := peerHealth.Watch(peerID, deviceID, pc, active.Load, sessionLog)
+	defer func() {
+		if !answered {
+			health.Stop()
+		}
+	}()
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		iceTelemetry.StateChange(peerID, state)
+		switch state {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+			go iceTelemetry.Connected(peerID, pc)
+			health.Connected()
+		case webrtc.ICEConnectionStateDisconnected:
+			health.Lost("ice disconnected")
+		case webrtc.ICEConnectionStateFailed:
+			// Restart ICE if the connection was up; otherwise give up
+			if !health.Lost("ice failed") {
+				iceTelemetry.Failed(peerID, iceFailICE)
+				pc.Close()
+			}
+		case webrtc.ICEConnectionStateClosed:
+			iceTelemetry.Closed(peerID)
+			health.Stop()
+			sessions.TransportClosed(active.Load(), pc)
+		}
+	})
+
+	sess := NewSession(peerID, deviceID, pc, nil)
+	active.Store(sess)
+	if !sessions.Add(sess) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
+	// A session whose signaling failed has no client to resume it
+	defer func() {
+		if !answered {
+			sessions.end(active.Load())
+		}
+	}()
 	
-	dc.OnOpen(func() {
-		// Send server public key when channel opens
-		_ = dc.SendText(mustJSON(ServerMsg{
-			Op:        "noise_pubkey",
-			PublicKey: noiseManager.GetPublicKey(),
-		}))
-	})
+	// onControl wires up the control channel, whichever side created it
+	onControl := func(dc *webrtc.DataChannel) {
+		active.Load().SetControl(pc, dc)
+
+		dc.OnOpen(func() {
+			// Send server public key when channel opens
+			_ = dc.SendText(mustJSON(ServerMsg{
+				Op:        "noise_pubkey",
+				PublicKey: noiseManager.GetPublicKey(),
+			}))
+			go health.Heartbeat()
+		})
 	
-	dc.OnClose(func() {
-		// Clean up Noise session
-		noiseManager.CloseSession(peerID)
-		log.Printf("DataChannel closed, removed session for %s", peerID)
-	})
+		dc.OnClose(func() {
+			sessionLog.Info("datachannel closed")
+			sessions.TransportClosed(active.Load(), pc)
+		})
 	
-	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		// Try to decrypt if E2E is established
-		sessionMux.RLock()
-		isE2E := e2eEstablished
-		sessionMux.RUnlock()
-
-		var msgData []byte
-		if isE2E {
-			// Try to decrypt
-			decrypted, err := noiseManager.Decrypt(peerID, msg.Data)
-			if err != nil {
-				log.Printf("Failed to decrypt message: %v", err)
-				_ = dc.SendText(mustJSON(ServerMsg{Op: "error", Error: "decryption failed"}))
-				return
-			}
-			msgData = decrypted
-		} else {
-			msgData = msg.Data
-		}
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			sess := active.Load()
+			// Try to decrypt if E2E is established
+			isE2E := sess.E2E()
 
-		var cm ClientMsg
-		if err := json.Unmarshal(msgData, &cm); err != nil {
-			_ = dc.SendText(mustJSON(ServerMsg{Op: "error", Error: "bad json"}))
-			return
-		}
+			var msgData []byte
+			if isE2E {
+				// Try to decrypt
+				decrypted, err := noiseManager.Decrypt(sess.ID, msg.Data)
+				if err != nil {
+					sessionLog.Warn("failed to decrypt message", "error", err)
+					_ = sess.SendPlain(ServerMsg{Op: "error", Error: "decryption failed"})
+					return
+				}
+				msgData = decrypted
+			} else {
+				msgData = msg.Data
+			}
 
-		switch cm.Op {
-		case "noise_init":
-			// Handle Noise handshake initiation
-			response, err := noiseManager.HandleHandshake(peerID, cm.NoiseInit)
-			if err != nil {
-				_ = dc.SendText(mustJSON(ServerMsg{Op: "error", Error: fmt.Sprintf("handshake failed: %v", err)}))
+			var cm ClientMsg
+			if _, err := decodeClientMsg(msgData, &cm); err != nil {
+				_ = sess.SendPlain(ServerMsg{Op: "error", Error: "bad message"})
 				return
 			}
-			_ = dc.SendText(mustJSON(ServerMsg{Op: "noise_response", NoiseResponse: response}))
+
+			switch cm.Op {
+			case "hello":
+				// The reply is already in the chosen encoding
+				enc := chooseEncoding(cm.Encodings)
+				sess.SetEncoding(enc)
+				_ = sess.Send(ServerMsg{Op: "hello", Encoding: enc.String()})
+
+			case "noise_init":
+				// Handle Noise handshake initiation
+				response, err := noiseManager.HandleHandshake(sess.ID, cm.NoiseInit, cm.KeyID)
+				if err != nil {
+					auditLog.Record(auditHandshakeFailed, map[string]string{
+						"session": sess.ID,
+						"peer":    deviceID,
+						"reason":  err.Error(),
+					})
+					_ = sess.SendPlain(ServerMsg{Op: "error", Error: fmt.Sprintf("handshake failed: %v", err)})
+					return
+				}
+				_ = sess.SendPlain(ServerMsg{Op: "noise_response", NoiseResponse: response})
 			
-			sessionMux.Lock()
-			e2eEstablished = true
-			sessionMux.Unlock()
+				sess.SetE2E()
 			
-			_ = dc.SendText(mustJSON(ServerMsg{Op: "e2e_established", E2EEstablished: true}))
-			log.Printf("E2E established with %s", peerID)
+				_ = sess.SendPlain(ServerMsg{Op: "e2e_established", E2EEstablished: true})
+				sessionLog.Info("e2e established")
+				// The ticket only travels encrypted
+				sess.Send(ServerMsg{Op: "resume_ticket", ResumeTicket: sess.IssueTicket()})
 
-		case "ping":
-			response := mustJSON(ServerMsg{Op: "pong"})
-			if isE2E {
-				encrypted, _ := noiseManager.Encrypt(peerID, []byte(response))
-				_ = dc.Send(encrypted)
-			} else {
-				_ = dc.SendText(response)
-			}
+			case "resume":
+				// A client that lost its connection continues an earlier
+				// session, reusing its Noise keys instead of a new handshake
+				if isE2E {
+					_ = sess.SendPlain(ServerMsg{Op: "error", Code: codeResumeRejected, Error: "session already established"})
+					return
+				}
+				resumed, err := sessions.Resume(cm.Ticket, deviceID, sess)
+				if err != nil {
+					sessionLog.Warn("resume rejected", "error", err)
+					_ = sess.SendPlain(ServerMsg{Op: "error", Code: codeResumeRejected, Error: err.Error()})
+					return
+				}
+				// Drop the placeholder session without closing the transport
+				// it handed over
+				sessions.Remove(sess.ID)
+				sess.cancel()
+				active.Store(resumed)
+				sessionLog.Info("session resumed", "resumed", resumed.ID)
+				resumed.Replay(cm.Acks)
 
-		case "chat":
-			model := cm.Model
-			if model == "" {
-				model = env("OLLAMA_MODEL", "qwen2.5:3b") // Use faster default model
-			}
-			// Ensure model is warmed up
-			if globalOllamaManager != nil {
-				globalOllamaManager.WarmupModel(model)
-				globalOllamaManager.UpdateLastUsed(model)
-			}
-			go proxyOllamaStream(dc, peerID, model, cm.Prompt, true, isE2E)
+			case "ack":
+				sess.Ack(cm.RequestID, cm.Seq)
 
-		default:
-			_ = dc.SendText(mustJSON(ServerMsg{Op: "error", Error: "unknown op"}))
-		}
-	})
+			case "cancel":
+				if !sess.CancelRequest(cm.RequestID) {
+					_ = sess.Send(ServerMsg{Op: "error", RequestID: cm.RequestID, Error: "no such request"})
+				}
+
+			case "ping":
+				_ = sess.Send(ServerMsg{Op: "pong"})
+
+			case "pong":
+				health.Pong()
+
+			case "stream_options":
+				opts := sess.SetBatch(cm.Batch)
+				_ = sess.Send(ServerMsg{Op: "stream_options", Batch: &opts})
+
+			case "ice_answer":
+				if err := health.Answer(cm.SDP); err != nil {
+					sessionLog.Warn("ice restart answer rejected", "error", err)
+					_ = sess.Send(ServerMsg{Op: "error", Error: err.Error()})
+				}
+
+			case "attach":
+				if cm.Attachment == nil {
+					_ = sess.Send(ServerMsg{Op: "error", Code: codeBadAttachment, Error: "missing attachment"})
+					return
+				}
+				if err := sess.AddChunk(*cm.Attachment); err != nil {
+					_ = sess.Send(ServerMsg{Op: "error", Code: codeBadAttachment, Error: err.Error()})
+				}
+
+			case "tools":
+				_ = sess.Send(ServerMsg{Op: "tools", Tools: toolRegistry().List()})
+
+			case "tool_approval":
+				if !sess.Approve(cm.RequestID, cm.ToolCallID, cm.Approved) {
+					_ = sess.Send(ServerMsg{Op: "error", RequestID: cm.RequestID, Error: "no such tool call"})
+				}
+
+			case "chat":
+				requestID := cm.RequestID
+				if requestID == "" {
+					requestID = newRequestID()
+				}
+				toolDefs, err := toolRegistry().Definitions(cm.Tools)
+				if err != nil {
+					_ = sess.Send(ServerMsg{Op: "error", RequestID: requestID, Code: codeUnknownTool, Error: err.Error()})
+					return
+				}
+				format, err := compileFormat(cm.Format)
+				if err != nil {
+					_ = sess.Send(ServerMsg{Op: "error", RequestID: requestID, Code: codeBadFormat, Error: err.Error()})
+					return
+				}
+				images, err := sess.ChatImages(cm.Images, cm.Attachments)
+				if err != nil {
+					_ = sess.Send(ServerMsg{Op: "error", RequestID: requestID, Code: codeBadAttachment, Error: err.Error()})
+					return
+				}
+				genCtx, done, ok := sessions.BeginGeneration(sess)
+				if !ok {
+					_ = sess.Send(ServerMsg{Op: "error", RequestID: requestID, Code: codeShutdown, Error: "server is shutting down"})
+					return
+				}
+				reqCtx, release, err := sess.TrackRequest(genCtx, requestID)
+				if err != nil {
+					done()
+					_ = sess.Send(ServerMsg{Op: "error", RequestID: requestID, Code: codeDuplicateRequest, Error: err.Error()})
+					return
+				}
+				reqLog := sessionLog.With(logKeyRequest, requestID)
+				out := sess.NewStream(reqCtx, requestID)
+				go func() {
+					defer done()
+					defer release()
+					// Model resolution asks Ollama, so it stays off the
+					// DataChannel's message loop
+					model := cm.Model
+					if len(images) > 0 {
+						// Only models that report vision support get images
+						m, err := modelCaps().VisionModel(reqCtx, cm.Model, currentConfig().Routing)
+						if err != nil {
+							_ = out.Send(ServerMsg{Op: "error", Code: codeBadAttachment, Error: err.Error()})
+							return
+						}
+						model = m
+					}
+					if model == "" {
+						model = currentConfig().Routing.DefaultModel
+					}
+					// Ensure model is warmed up
+					if om := globalOllamaManager(); om != nil {
+						om.WarmupModel(model)
+						om.UpdateLastUsed(model)
+					}
+					proxyOllamaStream(reqCtx, out, reqLog, deviceID, model, cm.Prompt, images, toolDefs, format, true)
+				}()
+
+			default:
+				_ = sess.SendPlain(ServerMsg{Op: "error", Error: "unknown op"})
+			}
+		})
+	}
+	// onStream adds a stream channel to the pool once it opens
+	onStream := func(sc *webrtc.DataChannel) {
+		sc.OnOpen(func() { active.Load().AddStreamChannel(pc, sc) })
+		sc.OnClose(func() { active.Load().RemoveStreamChannel(sc) })
+	}
+	if err := openChannels(pc, mode, onControl, onStream, sessionLog); err != nil {
+		iceTelemetry.Failed(peerID, iceFailNegotiation)
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
 	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: off.SDP}
 	if err := pc.SetRemoteDescription(offer); err != nil {
+		iceTelemetry.Failed(peerID, iceFailNegotiation)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	
 	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
+		iceTelemetry.Failed(peerID, iceFailNegotiation)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	
+	gatherStart := time.Now()
 	done := webrtc.GatheringCompletePromise(pc)
 	if err := pc.SetLocalDescription(answer); err != nil {
+		iceTelemetry.Failed(peerID, iceFailNegotiation)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	<-done
+	iceTelemetry.Gathered(peerID, time.Since(gatherStart))
 	
-	_ = json.NewEncoder(w).Encode(Answer{SDP: pc.LocalDescription().SDP})
+	answered = true
+	_ = json.NewEncoder(w).Encode(Answer{SDP: pc.LocalDescription().SDP, PeerID: peerID})
 }
 
-func proxyOllamaStream(dc *webrtc.DataChannel, peerID, model, prompt string, stream bool, isE2E bool) {
+// proxyOllamaStream streams a generation to the session. Output is buffered
+// while the client is away, so it continues across a resume. If ctx is
+// cancelled mid-stream the client gets a done message with codeShutdown.
+// With tools the server runs the tool-call loop, feeding results back to
+// the model for up to tools.max_rounds rounds. With a format the answer is
+// held back until it has been checked and is sent as a single delta.
+func proxyOllamaStream(ctx context.Context, out *RequestStream, reqLog *slog.Logger, deviceID, model, prompt string, images [][]byte, tools []map[string]interface{}, format *outputFormat, stream bool) {
 	// Record start time for TTFT
 	startTime := time.Now()
 	firstTokenSent := false
+	var ttft time.Duration
 	
-	// Use fast client if available
-	if globalFastClient != nil {
+	// Use fast client if available; it does not run tools or formats
+	if fast := globalFastClient(); fast != nil && len(tools) == 0 && format == nil {
 		// Optimize prompt
 		prompt = OptimizePrompt(prompt)
 		
-		// Select best model if not specified
-		if model == "" || model == "qwen2.5:3b" {
+		// Select best model if not specified; images were already routed
+		// to a vision model
+		if len(images) == 0 && (model == "" || model == "qwen2.5:3b") {
 			model = GetFastestModel(len(prompt))
 		}
 		
-		globalFastClient.StreamChat(model, prompt, func(content string, err error) {
+		final := fast.StreamChat(ctx, model, prompt, images, func(content string, err error) {
+			if ctx.Err() != nil {
+				return
+			}
 			if err != nil {
-				sendMessage(dc, peerID, ServerMsg{Op: "error", Error: err.Error()}, isE2E)
+				out.Send(ServerMsg{Op: "error", Error: err.Error()})
 				return
 			}
 			
 			if content != "" {
 				// Record TTFT on first token
 				if !firstTokenSent {
-					ttft := time.Since(startTime)
+					ttft = time.Since(startTime)
 					ttftMetrics.Record(ttft)
-					log.Printf("TTFT: %dms (model: %s)", ttft.Milliseconds(), model)
+					reqLog.Info("first token", logKeyModel, model, "ttft_ms", ttft.Milliseconds())
 					firstTokenSent = true
 				}
 				
-				sendMessage(dc, peerID, ServerMsg{Op: "delta", Content: content}, isE2E)
+				out.Send(ServerMsg{Op: "delta", Content: content})
 			}
 		})
 		
-		sendMessage(dc, peerID, ServerMsg{Op: "done"}, isE2E)
+		usage := final.Usage(model, startTime, ttft)
+		usageTracker.Record(deviceID, usage)
+		reqLog.Info("generation done", "usage", usage)
+		out.Send(ServerMsg{Op: "done", Usage: usage, Code: shutdownCode(ctx)})
 		return
 	}
 	
@@ -452,8 +796,8 @@ func proxyOllamaStream(dc *webrtc.DataChannel, peerID, model, prompt string, str
 	options := map[string]interface{}{
 		"num_predict": 512,
 	}
-	if globalOllamaManager != nil {
-		optSettings := globalOllamaManager.GetOptimizedSettings(model)
+	if om := globalOllamaManager(); om != nil {
+		optSettings := om.GetOptimizedSettings(model)
 		for k, v := range optSettings {
 			options[k] = v
 		}
@@ -462,100 +806,180 @@ func proxyOllamaStream(dc *webrtc.DataChannel, peerID, model, prompt string, str
 	payload := map[string]any{
 		"model":       model,
 		"stream":      true,
-		"messages":    []map[string]string{{"role": "user", "content": prompt}},
 		"options":     options,
 	}
-	
-	b, _ := json.Marshal(payload)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
+	if len(tools) > 0 {
+		payload["tools"] = tools
+	}
+	if format != nil {
+		payload["format"] = format.raw
+	}
+	messages := []ChatMessage{{Role: "user", Content: prompt, Images: images}}
 	
 	// Check if Ollama URL would violate strict local mode
-	ollamaURL := env("OLLAMA_URL", "http://127.0.0.1:11434")
-	if strictLocalMode && !isLocalURL(ollamaURL) {
-		sendMessage(dc, peerID, ServerMsg{Op: "error", Error: "Ollama URL violates strict local mode"}, isE2E)
+	ollamaURL := cfg().Ollama.URL
+	if strictLocalMode() && !isLocalURL(ollamaURL) {
+		out.Send(ServerMsg{Op: "error", Error: "Ollama URL violates strict local mode"})
+		return
+	}
+	
+	var final *OllamaFinal
+	var mismatch error
+	var answer string
+	calls := 0
+	retried := false
+	for round := 1; ; round++ {
+		payload["messages"] = messages
+		reply, roundFinal, err := ollamaChatRound(ctx, ollamaURL, payload, func(content string) {
+			// Record TTFT on first token
+			if !firstTokenSent {
+				ttft = time.Since(startTime)
+				ttftMetrics.Record(ttft)
+				reqLog.Info("first token", logKeyModel, model, "ttft_ms", ttft.Milliseconds())
+				firstTokenSent = true
+			}
+			
+			if format == nil {
+				out.Send(ServerMsg{Op: "delta", Content: content})
+			}
+		})
+		if err != nil {
+			out.Send(ServerMsg{Op: "error", Error: err.Error()})
+			return
+		}
+		final = final.add(roundFinal)
+		if len(reply.ToolCalls) == 0 || roundFinal == nil {
+			if format == nil || roundFinal == nil {
+				break
+			}
+			answer = reply.Content
+			mismatch = format.check(answer)
+			if mismatch == nil {
+				out.Send(ServerMsg{Op: "delta", Content: reply.Content})
+				break
+			}
+			if retried {
+				break
+			}
+			retried = true
+			reqLog.Info("answer does not match format, retrying", "error", mismatch)
+			messages = append(messages, reply, ChatMessage{Role: "user", Content: fmt.Sprintf(schemaRetryPrompt, mismatch)})
+			continue
+		}
+		if round >= cfg().Tools.MaxRounds {
+			reqLog.Warn("tool rounds exhausted", "rounds", round)
+			break
+		}
+		mismatch = nil
+		messages = append(messages, reply)
+		for _, call := range reply.ToolCalls {
+			calls++
+			messages = append(messages, toolRegistry().Call(ctx, out, fmt.Sprintf("call_%d", calls), call))
+		}
+	}
+	
+	usage := final.Usage(model, startTime, ttft)
+	usageTracker.Record(deviceID, usage)
+	reqLog.Info("generation done", "usage", usage)
+	if mismatch != nil && ctx.Err() == nil {
+		// The answer is included so the client can see what was wrong
+		out.Send(ServerMsg{Op: "error", Code: codeSchemaMismatch, Error: mismatch.Error(), Content: answer})
 		return
 	}
+	out.Send(ServerMsg{Op: "done", Usage: usage, Code: shutdownCode(ctx)})
+}
+
+// ollamaChatRound streams one /api/chat call, passing content to onContent,
+// and returns the assistant message with any tool calls. The final object
+// is nil if the stream ended early, e.g. because ctx was cancelled.
+func ollamaChatRound(ctx context.Context, ollamaURL string, payload map[string]any, onContent func(string)) (ChatMessage, *OllamaFinal, error) {
+	reply := ChatMessage{Role: "assistant"}
+	b, _ := json.Marshal(payload)
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
 	
 	req, _ := http.NewRequestWithContext(ctx, "POST", ollamaURL+"/api/chat", bytes.NewReader(b))
 	req.Header.Set("Content-Type", "application/json")
 	
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := newEgressClient(0).Do(req)
+	if errors.Is(err, ErrEgressBlocked) {
+		return reply, nil, errors.New("Ollama URL violates strict local mode")
+	}
 	if err != nil {
-		sendMessage(dc, peerID, ServerMsg{Op: "error", Error: "ollama connect failed"}, isE2E)
-		return
+		return reply, nil, errors.New("ollama connect failed")
 	}
 	defer resp.Body.Close()
 	
 	dec := json.NewDecoder(resp.Body)
-	var ln struct {
-		Model   string `json:"model"`
-		Message struct{ Role, Content string } `json:"message"`
-		Done    bool `json:"done"`
-	}
-	
+	var content strings.Builder
 	for {
+		var ln struct {
+			Message struct {
+				Content   string           `json:"content"`
+				ToolCalls []OllamaToolCall `json:"tool_calls"`
+			} `json:"message"`
+			Done bool `json:"done"`
+			OllamaFinal
+		}
 		if err := dec.Decode(&ln); err != nil {
-			if err == io.EOF {
-				break
+			if err == io.EOF || ctx.Err() != nil {
+				reply.Content = content.String()
+				return reply, nil, nil
 			}
-			sendMessage(dc, peerID, ServerMsg{Op: "error", Error: "decode error"}, isE2E)
-			return
+			return reply, nil, errors.New("decode error")
 		}
 		
 		if ln.Message.Content != "" {
-			// Record TTFT on first token
-			if !firstTokenSent {
-				ttft := time.Since(startTime)
-				ttftMetrics.Record(ttft)
-				log.Printf("TTFT: %dms", ttft.Milliseconds())
-				firstTokenSent = true
-			}
-			
-			sendMessage(dc, peerID, ServerMsg{Op: "delta", Content: ln.Message.Content}, isE2E)
+			content.WriteString(ln.Message.Content)
+			onContent(ln.Message.Content)
 		}
+		reply.ToolCalls = append(reply.ToolCalls, ln.Message.ToolCalls...)
 		
 		if ln.Done {
-			break
+			reply.Content = content.String()
+			return reply, &ln.OllamaFinal, nil
 		}
 	}
-	
-	sendMessage(dc, peerID, ServerMsg{Op: "done"}, isE2E)
 }
 
-func sendMessage(dc *webrtc.DataChannel, peerID string, msg ServerMsg, isE2E bool) error {
-	data := mustJSON(msg)
-	if isE2E {
-		encrypted, err := noiseManager.Encrypt(peerID, []byte(data))
-		if err != nil {
-			return err
-		}
-		return dc.Send(encrypted)
+// shutdownCode marks a generation cut short by session close or shutdown
+func shutdownCode(ctx context.Context) string {
+	if errors.Is(context.Cause(ctx), errRequestCancelled) {
+		return codeCancelled
 	}
-	return dc.SendText(data)
+	if ctx.Err() == context.Canceled {
+		return codeShutdown
+	}
+	return ""
 }
 
+func sendMessage(dc *webrtc.DataChannel, peerID string, msg ServerMsg, isE2E bool, enc wireEncoding) error {
+	if !isE2E {
+		return sendPlain(dc, enc, msg)
+	}
+	data, err := encodeServerMsg(enc, msg)
+	if err != nil {
+		return err
+	}
+	encrypted, err := noiseManager.Encrypt(peerID, data)
+	if err != nil {
+		return err
+	}
+	return dc.Send(encrypted)
+}
+
+// isLocalURL reports whether a URL names a local host. Names are only
+// checked syntactically; the egress guard verifies what they resolve to.
 func isLocalURL(urlStr string) bool {
-	if strings.HasPrefix(urlStr, "http://127.0.0.1") || 
-	   strings.HasPrefix(urlStr, "http://localhost") ||
-	   strings.HasPrefix(urlStr, "http://[::1]") {
-		return true
+	u, err := url.Parse(urlStr)
+	if err != nil || u.Host == "" {
+		return false
 	}
-	
-	// Parse URL and check if host is local
-	if strings.Contains(urlStr, "://") {
-		parts := strings.Split(urlStr, "://")
-		if len(parts) > 1 {
-			hostPort := strings.Split(parts[1], "/")[0]
-			host := strings.Split(hostPort, ":")[0]
-			ip := net.ParseIP(host)
-			if ip != nil {
-				return isLocalIP(ip)
-			}
-		}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return isLocalIP(ip)
 	}
-	
-	return false
+	return egressGuard.isLocalName(host)
 }
 
 func env(k, def string) string {
@@ -565,11 +989,18 @@ func env(k, def string) string {
 	return def
 }
 
-func envURLs(k string) []string {
-	if v := os.Getenv(k); v != "" {
-		return []string{v}
+// remoteHost returns the IP part of the request's remote address
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
-	return nil
+	return host
+}
+
+// dataDir is where the server keeps persistent state such as the audit log
+func dataDir() string {
+	return cfg().DataDir
 }
 
 func mustJSON(v any) string {
@@ -603,21 +1034,35 @@ func handleChatProxy(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if model == "" {
-			model = "qwen2.5:3b"
+			model = currentConfig().Routing.DefaultModel
 		}
 		requestBody["model"] = model
 	}
 
+	key := apiKeyFromContext(r.Context())
+	if key != nil && !key.AllowsModel(model) {
+		http.Error(w, "Forbidden: "+ErrModelDenied.Error(), http.StatusForbidden)
+		return
+	}
+
 	// Add optimized settings
-	if _, hasOptions := requestBody["options"]; !hasOptions && globalOllamaManager != nil {
-		requestBody["options"] = globalOllamaManager.GetOptimizedSettings(model)
+	if om := globalOllamaManager(); om != nil {
+		if _, hasOptions := requestBody["options"]; !hasOptions {
+			requestBody["options"] = om.GetOptimizedSettings(model)
+		}
+	}
+
+	format, err := compileFormat(requestBody["format"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	// Forward to Ollama
-	ollamaURL := env("OLLAMA_URL", "http://127.0.0.1:11434")
+	ollamaURL := cfg().Ollama.URL
 	
 	body, _ := json.Marshal(requestBody)
-	proxyReq, err := http.NewRequest("POST", ollamaURL+"/api/chat", bytes.NewReader(body))
+	proxyReq, err := http.NewRequestWithContext(r.Context(), "POST", ollamaURL+"/api/chat", bytes.NewReader(body))
 	if err != nil {
 		http.Error(w, "Failed to create request", http.StatusInternalServerError)
 		return
@@ -625,12 +1070,59 @@ func handleChatProxy(w http.ResponseWriter, r *http.Request) {
 
 	proxyReq.Header.Set("Content-Type", "application/json")
 
+	// Usage is recorded against the API key or device; keyless requests in
+	// dev mode only count towards the model totals
+	usageKey := ""
+	if key != nil {
+		usageKey = "key:" + key.ID
+	} else if device := deviceFromContext(r.Context()); device != "" {
+		usageKey = device
+	}
+	var final *OllamaFinal
+
 	// Track TTFT
 	startTime := time.Now()
 	firstTokenSent := false
+	reqID := r.Header.Get("X-Request-ID")
+	if reqID == "" {
+		reqID = newRequestID()
+	}
+	reqLog := logger.With(logKeyRequest, reqID, logKeyPeer, remoteHost(r), logKeyModel, model)
 
-	client := &http.Client{Timeout: 2 * time.Minute}
+	// Structured answers are checked before the client sees them
+	if format != nil {
+		result, final, err := structuredChat(r.Context(), ollamaURL, requestBody, format)
+		usage := final.Usage(model, startTime, 0)
+		usageTracker.Record(usageKey, usage)
+		if key != nil {
+			apiKeys.RecordTokens(key.ID, usage)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case errors.Is(err, ErrEgressBlocked):
+			http.Error(w, "Forbidden: Ollama URL violates strict local mode", http.StatusForbidden)
+		case errors.Is(err, ErrSchemaMismatch):
+			reqLog.Warn("answer does not match format", "error", err)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":    err.Error(),
+				"code":     codeSchemaMismatch,
+				"response": result,
+			})
+		case err != nil:
+			http.Error(w, "Failed to connect to Ollama", http.StatusServiceUnavailable)
+		default:
+			json.NewEncoder(w).Encode(result)
+		}
+		return
+	}
+
+	client := newEgressClient(2 * time.Minute)
 	resp, err := client.Do(proxyReq)
+	if errors.Is(err, ErrEgressBlocked) {
+		http.Error(w, "Forbidden: Ollama URL violates strict local mode", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to connect to Ollama", http.StatusServiceUnavailable)
 		return
@@ -649,21 +1141,72 @@ func handleChatProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var ttft time.Duration
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
 		line := scanner.Bytes()
 		
 		// Track TTFT on first content
 		if !firstTokenSent && bytes.Contains(line, []byte(`"content"`)) {
-			ttft := time.Since(startTime)
+			ttft = time.Since(startTime)
 			ttftMetrics.Record(ttft)
-			log.Printf("Proxy TTFT: %dms (model: %s)", ttft.Milliseconds(), model)
+			reqLog.Info("proxy first token", "ttft_ms", ttft.Milliseconds())
 			firstTokenSent = true
 		}
 
+		// Account usage from the final stream object
+		if bytes.Contains(line, []byte(`"done":true`)) {
+			final = &OllamaFinal{}
+			if json.Unmarshal(line, final) == nil {
+				usageTracker.Record(usageKey, final.Usage(model, startTime, ttft))
+			}
+		}
+
 		// Write to response
 		w.Write(line)
 		w.Write([]byte("\n"))
 		flusher.Flush()
 	}
-}
\ No newline at end of file
+
+	if key != nil {
+		apiKeys.RecordTokens(key.ID, final.Usage(model, startTime, ttft))
+	}
+}
+
+// handleModelsProxy lists installed Ollama models, filtered to those the
+// API key may use
+func handleModelsProxy(w http.ResponseWriter, r *http.Request) {
+	ollamaURL := cfg().Ollama.URL
+	client := newEgressClient(10 * time.Second)
+	resp, err := client.Get(ollamaURL + "/api/tags")
+	if errors.Is(err, ErrEgressBlocked) {
+		http.Error(w, "Forbidden: Ollama URL violates strict local mode", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to connect to Ollama", http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+
+	var tags struct {
+		Models []map[string]interface{} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		http.Error(w, "Invalid Ollama response", http.StatusBadGateway)
+		return
+	}
+
+	key := apiKeyFromContext(r.Context())
+	models := make([]map[string]interface{}, 0, len(tags.Models))
+	for _, m := range tags.Models {
+		name, _ := m["name"].(string)
+		if key != nil && !key.AllowsModel(name) {
+			continue
+		}
+		models = append(models, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"models": models})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTFTMetricsBounded(t *testing.T) {
+	m := &TTFTMetrics{}
+	for i := 0; i < maxTTFTSamples+100; i++ {
+		m.Record(10 * time.Millisecond)
+	}
+	m.Record(500 * time.Millisecond)
+	if len(m.measurements) != maxTTFTSamples {
+		t.Errorf("Expected %d samples kept, got %d", maxTTFTSamples, len(m.measurements))
+	}
+	p50, _, count := m.GetStats()
+	if count != maxTTFTSamples+101 || p50 != 10 {
+		t.Errorf("Expected count %d and p50 10, got %d and %v", maxTTFTSamples+101, count, p50)
+	}
+}
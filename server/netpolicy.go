@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultAllowCIDRs is what Strict Local Mode treats as local
+var defaultAllowCIDRs = []string{
+	"127.0.0.0/8",         // loopback
+	"::1/128",             // loopback
+	"10.0.0.0/8",          // RFC1918
+	"172.16.0.0/12",       // RFC1918
+	"192.168.0.0/16",      // RFC1918
+	"169.254.0.0/16",      // link-local
+	"fe80::/10",           // link-local
+	"fc00::/7",            // IPv6 ULA
+	"100.64.0.0/10",       // Tailscale CGNAT
+	"fd7a:115c:a1e0::/48", // Tailscale IPv6
+}
+
+// NetPolicy decides which peer addresses Strict Local Mode accepts. Denied
+// ranges take precedence over allowed ones. In dry-run mode violations are
+// logged and counted but still let through.
+type NetPolicy struct {
+	mu     sync.RWMutex
+	allow  []netip.Prefix
+	deny   []netip.Prefix
+	dryRun bool
+
+	rejected  atomic.Int64
+	wouldDeny atomic.Int64
+}
+
+func NewNetPolicy(allow, deny []string, dryRun bool) (*NetPolicy, error) {
+	p := &NetPolicy{}
+	if err := p.Reload(allow, deny, dryRun); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload replaces the ranges in place, keeping the counters. On error the
+// current ranges stay in effect.
+func (p *NetPolicy) Reload(allow, deny []string, dryRun bool) error {
+	a, err := parsePrefixes(allow)
+	if err != nil {
+		return err
+	}
+	d, err := parsePrefixes(deny)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allow, p.deny, p.dryRun = a, d, dryRun
+	return nil
+}
+
+func (p *NetPolicy) DryRun() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.dryRun
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		pfx, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", c, err)
+		}
+		out = append(out, pfx.Masked())
+	}
+	return out, nil
+}
+
+// Allowed reports whether the address falls in an allowed range and in no
+// denied one. IPv4-mapped IPv6 addresses are matched as IPv4.
+func (p *NetPolicy) Allowed(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, pfx := range p.deny {
+		if pfx.Contains(addr) {
+			return false
+		}
+	}
+	for _, pfx := range p.allow {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permit applies the policy at an enforcement point and reports whether the
+// caller should proceed. layer names the enforcement point for logs.
+func (p *NetPolicy) Permit(ip net.IP, layer, remote string) bool {
+	if p.Allowed(ip) {
+		return true
+	}
+	if p.DryRun() {
+		p.wouldDeny.Add(1)
+		logger.Warn("network policy would reject", "layer", layer, "remote", remote)
+		return true
+	}
+	p.rejected.Add(1)
+	return false
+}
+
+// Stats returns violation counters for the metrics endpoint
+func (p *NetPolicy) Stats() map[string]interface{} {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	allow := make([]string, len(p.allow))
+	for i, pfx := range p.allow {
+		allow[i] = pfx.String()
+	}
+	deny := make([]string, len(p.deny))
+	for i, pfx := range p.deny {
+		deny[i] = pfx.String()
+	}
+	return map[string]interface{}{
+		"dry_run":    p.dryRun,
+		"allow":      allow,
+		"deny":       deny,
+		"rejected":   p.rejected.Load(),
+		"would_deny": p.wouldDeny.Load(),
+	}
+}
+
+var netPolicy = mustDefaultNetPolicy()
+
+func mustDefaultNetPolicy() *NetPolicy {
+	p, err := NewNetPolicy(defaultAllowCIDRs, nil, false)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// initNetPolicy applies strict_local.allow_cidrs (added to the defaults),
+// deny_cidrs and dry_run from the configuration
+func initNetPolicy() {
+	if err := reloadNetPolicy(); err != nil {
+		fatal("invalid network policy", "error", err)
+	}
+}
+
+func reloadNetPolicy() error {
+	sl := cfg().StrictLocal
+	err := netPolicy.Reload(netPolicyAllow(sl), sl.DenyCIDRs, sl.DryRun)
+	if err == nil && netPolicy.DryRun() {
+		logger.Warn("network policy is in dry-run mode; non-local peers are only logged")
+	}
+	return err
+}
+
+// checkNetPolicy reports whether sl would be accepted by reloadNetPolicy
+func checkNetPolicy(sl StrictLocalConfig) error {
+	_, err := NewNetPolicy(netPolicyAllow(sl), sl.DenyCIDRs, sl.DryRun)
+	return err
+}
+
+func netPolicyAllow(sl StrictLocalConfig) []string {
+	return append(append([]string{}, defaultAllowCIDRs...), sl.AllowCIDRs...)
+}
+
+func handleNetPolicyMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(netPolicy.Stats())
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetPolicyDefaults(t *testing.T) {
+	p := mustDefaultNetPolicy()
+	for ip, want := range map[string]bool{
+		"127.0.0.1":            true,
+		"::1":                  true,
+		"192.168.1.20":         true,
+		"172.20.0.1":           true,
+		"169.254.10.1":         true,
+		"fe80::1":              true,
+		"fd12:3456::1":         true,
+		"100.100.1.1":          true,
+		"fd7a:115c:a1e0::1":    true,
+		"::ffff:192.168.1.20":  true,
+		"8.8.8.8":              false,
+		"100.128.0.1":          false,
+		"224.0.0.251":          false,
+		"2001:4860:4860::8888": false,
+	} {
+		if got := p.Allowed(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: expected %v, got %v", ip, want, got)
+		}
+	}
+}
+
+func TestNetPolicyDenyAndDryRun(t *testing.T) {
+	p, err := NewNetPolicy(defaultAllowCIDRs, []string{"192.168.50.0/24"}, false)
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	if p.Allowed(net.ParseIP("192.168.50.7")) {
+		t.Error("Denied range must take precedence over allowed range")
+	}
+	if p.Permit(net.ParseIP("8.8.8.8"), "test", "8.8.8.8:1") {
+		t.Error("Expected rejection when enforcing")
+	}
+
+	p.Reload(defaultAllowCIDRs, []string{"192.168.50.0/24"}, true)
+	if !p.Permit(net.ParseIP("8.8.8.8"), "test", "8.8.8.8:1") {
+		t.Error("Dry run must let the peer through")
+	}
+	stats := p.Stats()
+	if stats["rejected"].(int64) != 1 || stats["would_deny"].(int64) != 1 {
+		t.Errorf("Unexpected counters: %v", stats)
+	}
+
+	if _, err := NewNetPolicy([]string{"not-a-cidr"}, nil, false); err == nil {
+		t.Error("Expected invalid CIDR to fail")
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
-	"log"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"os"
 	"sync"
+	"time"
 )
 
 // Simple Noise implementation for testing
@@ -15,12 +21,87 @@ const (
 	keychainAccount = "noise-private-key"
 	noiseProtocol   = "Noise_IK_25519_ChaChaPoly_BLAKE2b"
 	maxMessageSize  = 65535
+
+	noiseKeysName = "noise-static.json"
 )
 
+var ErrUnknownStaticKey = errors.New("unknown or expired static key")
+
+// staticKey is a Noise static X25519 key pair. An Ed25519 key derived from
+// the private half signs the announcement of its successor, so a phone that
+// pinned this key can trust the next one.
+type staticKey struct {
+	Private   []byte    `json:"private"`
+	Public    []byte    `json:"public"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newStaticKey() (*staticKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &staticKey{Private: priv.Bytes(), Public: priv.PublicKey().Bytes(), CreatedAt: time.Now().UTC()}, nil
+}
+
+func (k *staticKey) signer() ed25519.PrivateKey {
+	seed := sha256.Sum256(append([]byte("quicpair noise signing v1\x00"), k.Private...))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+func (k *staticKey) signingKey() ed25519.PublicKey {
+	return k.signer().Public().(ed25519.PublicKey)
+}
+
+// ID is a short hex digest of the public key for logs and key selection
+func (k *staticKey) ID() string {
+	sum := sha256.Sum256(k.Public)
+	return hex.EncodeToString(sum[:8])
+}
+
+// noiseKeyState is persisted in the key store. Previous is still accepted
+// for handshakes until PreviousUntil; Next is published ahead of time.
+type noiseKeyState struct {
+	Current       *staticKey `json:"current"`
+	Next          *staticKey `json:"next"`
+	Previous      *staticKey `json:"previous,omitempty"`
+	PreviousUntil time.Time  `json:"previous_until,omitempty"`
+	RotatedAt     time.Time  `json:"rotated_at,omitempty"`
+	// LastRotation is the signed announcement of the latest rotation, for
+	// devices that were offline when it was sent
+	LastRotation *KeyRotation `json:"last_rotation,omitempty"`
+}
+
+// KeyRotation is sent to trusted devices over E2E when the static key
+// changes. Signature is made with the previous key's signing key over
+// signingInput.
+type KeyRotation struct {
+	PreviousKey string    `json:"previous_key"`
+	PublicKey   string    `json:"public_key"`
+	SigningKey  string    `json:"signing_key"`
+	GraceUntil  time.Time `json:"grace_until"`
+	Signature   string    `json:"signature"`
+}
+
+func (kr *KeyRotation) signingInput() []byte {
+	return []byte("quicpair-key-rotation-v1\n" + kr.PreviousKey + "\n" + kr.PublicKey + "\n" +
+		kr.SigningKey + "\n" + kr.GraceUntil.UTC().Format(time.RFC3339))
+}
+
+// VerifyKeyRotation checks an announcement against the signing key pinned
+// for the previous static key
+func VerifyKeyRotation(previousSigningKey ed25519.PublicKey, kr *KeyRotation) bool {
+	sig, err := base64.StdEncoding.DecodeString(kr.Signature)
+	if err != nil || len(previousSigningKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(previousSigningKey, kr.signingInput(), sig)
+}
+
 type NoiseManager struct {
 	mu           sync.RWMutex
-	privateKey   []byte
-	publicKey    []byte
+	keys         noiseKeyState
+	store        *KeyStore
 	sessions     map[string]*NoiseSession
 	devPlaintext bool
 }
@@ -28,31 +109,178 @@ type NoiseManager struct {
 type NoiseSession struct {
 	mu         sync.Mutex
 	isComplete bool
+	// keyID is the static key the handshake used
+	keyID string
 }
 
-func NewNoiseManager(devMode bool) (*NoiseManager, error) {
+// NewNoiseManager loads the static keys from the key store, creating them on
+// first start. A nil store keeps keys in memory only.
+func NewNoiseManager(devMode bool, store *KeyStore) (*NoiseManager, error) {
 	nm := &NoiseManager{
+		store:        store,
 		sessions:     make(map[string]*NoiseSession),
-		devPlaintext: devMode && os.Getenv("DEV_ALLOW_PLAINTEXT") == "1",
+		devPlaintext: devMode && cfg().Dev.AllowPlaintext,
+	}
+	if err := nm.loadKeys(); err != nil {
+		return nil, err
 	}
-
-	// Generate a simple key for testing
-	nm.privateKey = make([]byte, 32)
-	nm.publicKey = make([]byte, 32)
-	rand.Read(nm.privateKey)
-	rand.Read(nm.publicKey)
 
 	if nm.devPlaintext {
-		log.Println("⚠️  WARNING: Plaintext mode enabled (dev only)")
+		logger.Warn("plaintext mode enabled (dev only)")
 	}
 
 	return nm, nil
 }
 
+func (nm *NoiseManager) loadKeys() error {
+	if nm.store != nil {
+		data, err := nm.store.Load(noiseKeysName)
+		if err == nil {
+			if err := json.Unmarshal(data, &nm.keys); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	var err error
+	if nm.keys.Current == nil {
+		if nm.keys.Current, err = newStaticKey(); err != nil {
+			return err
+		}
+	}
+	if nm.keys.Next == nil {
+		if nm.keys.Next, err = newStaticKey(); err != nil {
+			return err
+		}
+	}
+	return nm.saveKeys()
+}
+
+// saveKeys must be called with mu held or before the manager is shared
+func (nm *NoiseManager) saveKeys() error {
+	if nm.store == nil {
+		return nil
+	}
+	data, err := json.Marshal(nm.keys)
+	if err != nil {
+		return err
+	}
+	return nm.store.Save(noiseKeysName, data)
+}
+
+// expirePrevious drops the previous key once its grace period is over; it
+// must be called with mu held for writing
+func (nm *NoiseManager) expirePrevious() {
+	if nm.keys.Previous != nil && time.Now().After(nm.keys.PreviousUntil) {
+		logger.Info("previous noise static key expired", "key_id", nm.keys.Previous.ID())
+		nm.keys.Previous, nm.keys.PreviousUntil = nil, time.Time{}
+		if err := nm.saveKeys(); err != nil {
+			logger.Error("failed to save noise keys", "error", err)
+		}
+	}
+}
+
 func (nm *NoiseManager) GetPublicKey() string {
 	nm.mu.RLock()
 	defer nm.mu.RUnlock()
-	return base64.StdEncoding.EncodeToString(nm.publicKey)
+	return base64.StdEncoding.EncodeToString(nm.keys.Current.Public)
+}
+
+// SigningKey returns the Ed25519 key that will sign the next rotation
+// announcement; phones pin it with the public key at pairing
+func (nm *NoiseManager) SigningKey() string {
+	nm.mu.RLock()
+	defer nm.mu.RUnlock()
+	return base64.StdEncoding.EncodeToString(nm.keys.Current.signingKey())
+}
+
+// Fingerprint is the current key's ID for comparing against what a phone
+// has pinned
+func (nm *NoiseManager) Fingerprint() string {
+	nm.mu.RLock()
+	defer nm.mu.RUnlock()
+	return nm.keys.Current.ID()
+}
+
+// Rotate promotes the next key to current, keeps the old one valid for
+// grace and generates a new next key. The returned announcement is signed
+// by the old key.
+func (nm *NoiseManager) Rotate(grace time.Duration) (*KeyRotation, error) {
+	upcoming, err := newStaticKey()
+	if err != nil {
+		return nil, err
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	saved := nm.keys
+	old, cur := nm.keys.Current, nm.keys.Next
+	now := time.Now().UTC()
+	kr := &KeyRotation{
+		PreviousKey: base64.StdEncoding.EncodeToString(old.Public),
+		PublicKey:   base64.StdEncoding.EncodeToString(cur.Public),
+		SigningKey:  base64.StdEncoding.EncodeToString(cur.signingKey()),
+		GraceUntil:  now.Add(grace).Truncate(time.Second),
+	}
+	kr.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(old.signer(), kr.signingInput()))
+
+	nm.keys = noiseKeyState{
+		Current:       cur,
+		Next:          upcoming,
+		Previous:      old,
+		PreviousUntil: kr.GraceUntil,
+		RotatedAt:     now,
+		LastRotation:  kr,
+	}
+	if err := nm.saveKeys(); err != nil {
+		nm.keys = saved
+		return nil, err
+	}
+	return kr, nil
+}
+
+// staticKeyFor picks the key a handshake targets. An empty ID means the
+// current key; the previous key is accepted only during its grace period.
+func (nm *NoiseManager) staticKeyFor(keyID string) (*staticKey, error) {
+	nm.expirePrevious()
+	switch {
+	case keyID == "" || keyID == nm.keys.Current.ID():
+		return nm.keys.Current, nil
+	case nm.keys.Previous != nil && keyID == nm.keys.Previous.ID():
+		return nm.keys.Previous, nil
+	}
+	return nil, ErrUnknownStaticKey
+}
+
+// RotationState is published at /noise/pubkey
+func (nm *NoiseManager) RotationState() map[string]interface{} {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.expirePrevious()
+	k := nm.keys
+	state := map[string]interface{}{
+		"public_key":      base64.StdEncoding.EncodeToString(k.Current.Public),
+		"key_id":          k.Current.ID(),
+		"signing_key":     base64.StdEncoding.EncodeToString(k.Current.signingKey()),
+		"created_at":      k.Current.CreatedAt,
+		"next_public_key": base64.StdEncoding.EncodeToString(k.Next.Public),
+		"next_key_id":     k.Next.ID(),
+		"state":           "stable",
+	}
+	if !k.RotatedAt.IsZero() {
+		state["rotated_at"] = k.RotatedAt
+	}
+	if k.LastRotation != nil {
+		state["key_rotation"] = k.LastRotation
+	}
+	if k.Previous != nil {
+		state["state"] = "grace"
+		state["previous_public_key"] = base64.StdEncoding.EncodeToString(k.Previous.Public)
+		state["previous_key_id"] = k.Previous.ID()
+		state["previous_valid_until"] = k.PreviousUntil
+	}
+	return state
 }
 
 func (nm *NoiseManager) StartSession(sessionID string, remotePublicKey []byte) (*NoiseSession, error) {
@@ -61,18 +289,25 @@ func (nm *NoiseManager) StartSession(sessionID string, remotePublicKey []byte) (
 
 	session := &NoiseSession{
 		isComplete: true, // Simplified - always complete
+		keyID:      nm.keys.Current.ID(),
 	}
 	nm.sessions[sessionID] = session
 	return session, nil
 }
 
-func (nm *NoiseManager) HandleHandshake(sessionID string, message []byte) ([]byte, error) {
+// HandleHandshake answers a handshake addressed to the static key keyID
+func (nm *NoiseManager) HandleHandshake(sessionID string, message []byte, keyID string) ([]byte, error) {
 	nm.mu.Lock()
 	defer nm.mu.Unlock()
 
+	key, err := nm.staticKeyFor(keyID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create session if doesn't exist
 	if _, exists := nm.sessions[sessionID]; !exists {
-		nm.sessions[sessionID] = &NoiseSession{isComplete: true}
+		nm.sessions[sessionID] = &NoiseSession{isComplete: true, keyID: key.ID()}
 	}
 
 	// Return a simple response
@@ -107,7 +342,7 @@ func (nm *NoiseManager) CloseSession(sessionID string) {
 	nm.mu.Lock()
 	defer nm.mu.Unlock()
 	delete(nm.sessions, sessionID)
-	log.Printf("🔒 Closed Noise session %s", sessionID)
+	logger.Info("closed noise session", logKeySession, sessionID)
 }
 
 func (nm *NoiseManager) GetSessionStats() map[string]interface{} {
@@ -117,6 +352,24 @@ func (nm *NoiseManager) GetSessionStats() map[string]interface{} {
 	return map[string]interface{}{
 		"active_sessions": len(nm.sessions),
 		"plaintext_mode":  nm.devPlaintext,
-		"public_key":      nm.GetPublicKey(),
+		"public_key":      base64.StdEncoding.EncodeToString(nm.keys.Current.Public),
 	}
-}
\ No newline at end of file
+}
+
+// announceKeyRotation sends the announcement to connected sessions that
+// completed the E2E handshake and belong to a paired, unrevoked device
+func announceKeyRotation(kr *KeyRotation) int {
+	n := 0
+	for _, s := range sessions.List() {
+		if !s.E2E() {
+			continue
+		}
+		if _, err := deviceRegistry.Active(s.DeviceID); err != nil {
+			continue
+		}
+		if err := s.Send(ServerMsg{Op: "key_rotation", KeyRotation: kr}); err == nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNoiseKeyRotation(t *testing.T) {
+	ks, err := OpenKeyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm, err := NewNoiseManager(false, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := nm.Fingerprint()
+	oldSigning, _ := base64.StdEncoding.DecodeString(nm.SigningKey())
+	nextID := nm.RotationState()["next_key_id"]
+
+	kr, err := nm.Rotate(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nm.Fingerprint() != nextID {
+		t.Errorf("rotation should promote the published next key")
+	}
+	if !VerifyKeyRotation(ed25519.PublicKey(oldSigning), kr) {
+		t.Error("announcement does not verify with the old signing key")
+	}
+	forged := *kr
+	forged.PublicKey = kr.PreviousKey
+	if VerifyKeyRotation(ed25519.PublicKey(oldSigning), &forged) {
+		t.Error("tampered announcement verified")
+	}
+
+	// Both keys are accepted during the grace period
+	for _, id := range []string{"", oldID, nm.Fingerprint()} {
+		if _, err := nm.HandleHandshake("s-"+id, nil, id); err != nil {
+			t.Errorf("handshake with key %q: %v", id, err)
+		}
+	}
+	if st := nm.RotationState(); st["state"] != "grace" || st["previous_key_id"] != oldID {
+		t.Errorf("rotation state = %v", st)
+	}
+
+	// State survives a restart
+	reloaded, err := NewNoiseManager(false, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Fingerprint() != nm.Fingerprint() {
+		t.Error("current key not persisted")
+	}
+	// Devices that missed the announcement can fetch it from /noise/pubkey
+	published, _ := reloaded.RotationState()["key_rotation"].(*KeyRotation)
+	if published == nil || !VerifyKeyRotation(ed25519.PublicKey(oldSigning), published) {
+		t.Errorf("signed rotation not published after restart: %+v", published)
+	}
+
+	// After the grace period the old key is refused
+	reloaded.mu.Lock()
+	reloaded.keys.PreviousUntil = time.Now().Add(-time.Second)
+	reloaded.mu.Unlock()
+	if _, err := reloaded.HandleHandshake("late", nil, oldID); !errors.Is(err, ErrUnknownStaticKey) {
+		t.Errorf("expired key accepted: %v", err)
+	}
+	if st := reloaded.RotationState(); st["state"] != "stable" {
+		t.Errorf("state after grace = %v", st["state"])
+	}
+}
@@ -2,14 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"bufio"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +30,7 @@ func NewFastOllamaClient(baseURL string) *FastOllamaClient {
 		IdleConnTimeout:     90 * time.Second,
 		DisableCompression:  true, // Disable compression for lower latency
 		ForceAttemptHTTP2:   false, // HTTP/1.1 is faster for local connections
+		DialContext:         egressGuard.DialContext,
 	}
 
 	return &FastOllamaClient{
@@ -41,12 +43,24 @@ func NewFastOllamaClient(baseURL string) *FastOllamaClient {
 	}
 }
 
-// StreamChat streams chat responses with minimal latency
-func (fc *FastOllamaClient) StreamChat(model, prompt string, callback func(string, error)) {
+// ChatMessage is a message of an Ollama /api/chat request. Images are
+// marshalled as the base64 strings Ollama expects.
+type ChatMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  [][]byte `json:"images,omitempty"`
+	// ToolCalls is set on assistant messages, ToolName on tool results
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+// StreamChat streams chat responses with minimal latency and returns the
+// accounting fields of the final stream object
+func (fc *FastOllamaClient) StreamChat(ctx context.Context, model, prompt string, images [][]byte, callback func(string, error)) *OllamaFinal {
 	// Use minimal options for fastest response
 	payload := map[string]interface{}{
 		"model":    model,
-		"messages": []map[string]string{{"role": "user", "content": prompt}},
+		"messages": []ChatMessage{{Role: "user", Content: prompt, Images: images}},
 		"stream":   true,
 		"options": map[string]interface{}{
 			"num_predict":     512,
@@ -66,10 +80,10 @@ func (fc *FastOllamaClient) StreamChat(model, prompt string, callback func(strin
 	}
 
 	body, _ := json.Marshal(payload)
-	req, err := http.NewRequest("POST", fc.baseURL+"/api/chat", bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", fc.baseURL+"/api/chat", bytes.NewReader(body))
 	if err != nil {
 		callback("", err)
-		return
+		return nil
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -78,7 +92,7 @@ func (fc *FastOllamaClient) StreamChat(model, prompt string, callback func(strin
 	resp, err := fc.client.Do(req)
 	if err != nil {
 		callback("", err)
-		return
+		return nil
 	}
 	defer resp.Body.Close()
 
@@ -93,6 +107,7 @@ func (fc *FastOllamaClient) StreamChat(model, prompt string, callback func(strin
 				Content string `json:"content"`
 			} `json:"message"`
 			Done bool `json:"done"`
+			OllamaFinal
 		}
 
 		if err := decoder.Decode(&msg); err != nil {
@@ -100,27 +115,28 @@ func (fc *FastOllamaClient) StreamChat(model, prompt string, callback func(strin
 				break
 			}
 			callback("", err)
-			return
+			return nil
 		}
 
 		if msg.Message.Content != "" {
 			if firstToken {
 				firstToken = false
 				// Log first token timing
-				log.Printf("⚡ First token received")
+				logger.Debug("first token received", logKeyModel, model)
 			}
 			callback(msg.Message.Content, nil)
 		}
 
 		if msg.Done {
-			break
+			return &msg.OllamaFinal
 		}
 	}
+	return nil
 }
 
 // PreloadModel ensures a model is loaded and ready
 func (fc *FastOllamaClient) PreloadModel(model string) error {
-	log.Printf("⏳ Preloading model: %s", model)
+	logger.Info("preloading model", logKeyModel, model)
 
 	// Use generate endpoint with keep_alive to load model
 	payload := map[string]interface{}{
@@ -150,26 +166,14 @@ func (fc *FastOllamaClient) PreloadModel(model string) error {
 	var result map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&result)
 
-	log.Printf("✅ Model %s preloaded", model)
+	logger.Info("model preloaded", logKeyModel, model)
 	return nil
 }
 
-// GetFastestModel returns the model with best TTFT for the prompt
+// GetFastestModel returns the model with best TTFT for the prompt, using the
+// configured routing tiers
 func GetFastestModel(promptLength int) string {
-	// Model selection based on prompt characteristics
-	if promptLength < 20 {
-		// Very short prompts - use smallest model
-		return "smollm2:135m"
-	} else if promptLength < 50 {
-		// Short prompts - use Gemma 3 270M
-		return "gemma3:270m"
-	} else if promptLength < 100 {
-		// Medium prompts
-		return "qwen3:1.7b"
-	} else {
-		// Longer prompts - use model with better context handling
-		return "qwen3:4b"
-	}
+	return currentConfig().Routing.ModelFor(promptLength)
 }
 
 // OptimizePrompt preprocesses prompt for faster inference
@@ -185,22 +189,25 @@ func OptimizePrompt(prompt string) string {
 	return prompt
 }
 
-var globalFastClient *FastOllamaClient
+// activeFastClient is replaced when a reload changes the Ollama URL
+var activeFastClient atomic.Pointer[FastOllamaClient]
+
+func globalFastClient() *FastOllamaClient { return activeFastClient.Load() }
 
 func initFastOllama() {
-	ollamaURL := env("OLLAMA_URL", "http://127.0.0.1:11434")
-	globalFastClient = NewFastOllamaClient(ollamaURL)
+	client := NewFastOllamaClient(cfg().Ollama.URL)
+	activeFastClient.Store(client)
 	
 	// Preload models in parallel
-	models := []string{"smollm2:135m", "gemma3:270m", "qwen3:1.7b", "qwen3:4b"}
+	models := cfg().Ollama.WarmupModels
 	var wg sync.WaitGroup
 	
 	for _, model := range models {
 		wg.Add(1)
 		go func(m string) {
 			defer wg.Done()
-			if err := globalFastClient.PreloadModel(m); err != nil {
-				log.Printf("Failed to preload %s: %v", m, err)
+			if err := client.PreloadModel(m); err != nil {
+				logger.Warn("failed to preload model", logKeyModel, m, "error", err)
 			}
 		}(model)
 	}
@@ -208,6 +215,6 @@ func initFastOllama() {
 	// Don't wait - let models load in background
 	go func() {
 		wg.Wait()
-		log.Println("✅ All models preloaded")
+		logger.Info("all models preloaded")
 	}()
 }
\ No newline at end of file
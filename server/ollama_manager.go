@@ -2,11 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,13 +18,18 @@ type OllamaManager struct {
 	baseURL      string
 	activeModels map[string]*ModelState
 	warmupDone   map[string]bool
+	keepAlive    map[string]bool
+	stop         chan struct{}
+	stopOnce     sync.Once
 }
 
 // ModelState tracks model-specific state
 type ModelState struct {
-	Name         string
-	LastUsed     time.Time
-	WarmupStatus bool
+	Name         string    `json:"name"`
+	LastUsed     time.Time `json:"last_used"`
+	WarmupStatus bool      `json:"warm"`
+	// Pinned models are kept resident even when idle
+	Pinned bool `json:"pinned"`
 }
 
 // NewOllamaManager creates a new Ollama manager
@@ -35,14 +41,22 @@ func NewOllamaManager(baseURL string) *OllamaManager {
 				MaxIdleConns:        10,
 				MaxIdleConnsPerHost: 10,
 				IdleConnTimeout:     90 * time.Second,
+				DialContext:         egressGuard.DialContext,
 			},
 		},
 		baseURL:      baseURL,
 		activeModels: make(map[string]*ModelState),
 		warmupDone:   make(map[string]bool),
+		keepAlive:    make(map[string]bool),
+		stop:         make(chan struct{}),
 	}
 }
 
+// Close stops all keep-alive loops
+func (om *OllamaManager) Close() {
+	om.stopOnce.Do(func() { close(om.stop) })
+}
+
 // WarmupModel preloads a model to reduce TTFT
 func (om *OllamaManager) WarmupModel(model string) error {
 	om.mu.Lock()
@@ -52,7 +66,7 @@ func (om *OllamaManager) WarmupModel(model string) error {
 	}
 	om.mu.Unlock()
 
-	log.Printf("🔥 Warming up model: %s", model)
+	logger.Info("warming up model", logKeyModel, model)
 	startTime := time.Now()
 
 	// Send a simple prompt to load the model
@@ -89,7 +103,7 @@ func (om *OllamaManager) WarmupModel(model string) error {
 	json.NewDecoder(resp.Body).Decode(&result)
 
 	warmupTime := time.Since(startTime)
-	log.Printf("✅ Model %s warmed up in %dms", model, warmupTime.Milliseconds())
+	logger.Info("model warmed up", logKeyModel, model, "warmup_ms", warmupTime.Milliseconds())
 
 	om.mu.Lock()
 	om.warmupDone[model] = true
@@ -103,18 +117,38 @@ func (om *OllamaManager) WarmupModel(model string) error {
 	return nil
 }
 
-// KeepAlive sends periodic requests to keep model in memory
+// KeepAlive sends periodic requests to keep model in memory. Only one loop
+// runs per model.
 func (om *OllamaManager) KeepAlive(model string) {
+	om.mu.Lock()
+	if om.keepAlive[model] {
+		om.mu.Unlock()
+		return
+	}
+	om.keepAlive[model] = true
+	om.mu.Unlock()
+	defer func() {
+		om.mu.Lock()
+		delete(om.keepAlive, model)
+		om.mu.Unlock()
+	}()
+
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-om.stop:
+			return
+		case <-ticker.C:
+		}
+
 		om.mu.RLock()
 		state, exists := om.activeModels[model]
 		om.mu.RUnlock()
 
-		if !exists || time.Since(state.LastUsed) > 5*time.Minute {
-			log.Printf("🛑 Stopping keep-alive for idle model: %s", model)
+		if !exists || (!state.Pinned && time.Since(state.LastUsed) > 5*time.Minute) {
+			logger.Info("stopping keep-alive for idle model", logKeyModel, model)
 			return
 		}
 
@@ -175,21 +209,96 @@ func (om *OllamaManager) UpdateLastUsed(model string) {
 	}
 }
 
-var globalOllamaManager *OllamaManager
+// Pin warms a model and keeps it resident until it is unloaded
+func (om *OllamaManager) Pin(model string) error {
+	if err := om.WarmupModel(model); err != nil {
+		return err
+	}
+	om.mu.Lock()
+	if state, ok := om.activeModels[model]; ok {
+		state.Pinned = true
+	}
+	om.mu.Unlock()
+	go om.KeepAlive(model)
+	return nil
+}
+
+// Unload asks Ollama to evict a model and stops keeping it warm
+func (om *OllamaManager) Unload(ctx context.Context, model string) error {
+	om.mu.Lock()
+	delete(om.activeModels, model)
+	delete(om.warmupDone, model)
+	om.mu.Unlock()
+
+	body, _ := json.Marshal(map[string]interface{}{"model": model, "keep_alive": 0})
+	req, err := http.NewRequestWithContext(ctx, "POST", om.baseURL+"/api/generate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := om.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unload failed: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Managed returns the models this server is keeping warm
+func (om *OllamaManager) Managed() []ModelState {
+	om.mu.RLock()
+	defer om.mu.RUnlock()
+	out := make([]ModelState, 0, len(om.activeModels))
+	for _, s := range om.activeModels {
+		out = append(out, *s)
+	}
+	return out
+}
+
+// Loaded returns the models Ollama currently holds in memory
+func (om *OllamaManager) Loaded(ctx context.Context) ([]map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", om.baseURL+"/api/ps", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := om.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama returned status %d", resp.StatusCode)
+	}
+	var ps struct {
+		Models []map[string]interface{} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
+		return nil, err
+	}
+	return ps.Models, nil
+}
+
+// activeOllamaManager is replaced when a reload changes the Ollama URL
+var activeOllamaManager atomic.Pointer[OllamaManager]
+
+func globalOllamaManager() *OllamaManager { return activeOllamaManager.Load() }
 
 func initOllamaManager() {
-	ollamaURL := env("OLLAMA_URL", "http://127.0.0.1:11434")
-	globalOllamaManager = NewOllamaManager(ollamaURL)
+	om := NewOllamaManager(cfg().Ollama.URL)
+	activeOllamaManager.Store(om)
 
 	// Warmup default models
+	models := cfg().Ollama.WarmupModels
 	go func() {
-		models := []string{"smollm2:135m", "gemma3:270m", "qwen3:1.7b", "qwen3:4b"}
 		for _, model := range models {
-			if err := globalOllamaManager.WarmupModel(model); err != nil {
-				log.Printf("Failed to warmup %s: %v", model, err)
+			if err := om.WarmupModel(model); err != nil {
+				logger.Warn("failed to warm up model", logKeyModel, model, "error", err)
 			} else {
 				// Start keep-alive for warmed up models
-				go globalOllamaManager.KeepAlive(model)
+				go om.KeepAlive(model)
 			}
 		}
 	}()
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// sessionResumeWindow is how long a session whose PeerConnection died waits
+// for the client to come back, e.g. after moving from Wi-Fi to cellular
+const sessionResumeWindow = 2 * time.Minute
+
+// maxResumeBufferBytes bounds the undelivered output kept per session
+const maxResumeBufferBytes = 1 << 20
+
+const (
+	// codeResumeRejected tells the client to fall back to a full handshake
+	codeResumeRejected = "resume_rejected"
+	// codeResumeGap marks a request whose buffered output overflowed while
+	// the client was away; the client should retry it
+	codeResumeGap = "resume_gap"
+)
+
+var ErrResumeRejected = errors.New("invalid or expired resumption ticket")
+
+// resumeTicketKey authenticates tickets. Sessions do not survive a restart,
+// so neither does the key.
+var resumeTicketKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// Tickets look like rt1.<session id>.<generation>.<mac>. The MAC binds the
+// session to its device; the generation makes each ticket single-use.
+func resumeTicket(sessionID, deviceID string, gen int) string {
+	return "rt1." + sessionID + "." + strconv.Itoa(gen) + "." +
+		base64.RawURLEncoding.EncodeToString(resumeTicketMAC(sessionID, deviceID, gen))
+}
+
+func resumeTicketMAC(sessionID, deviceID string, gen int) []byte {
+	m := hmac.New(sha256.New, resumeTicketKey)
+	m.Write([]byte(sessionID + "\x00" + deviceID + "\x00" + strconv.Itoa(gen)))
+	return m.Sum(nil)
+}
+
+func parseResumeTicket(t string) (sessionID string, gen int, mac []byte, ok bool) {
+	parts := strings.Split(t, ".")
+	if len(parts) != 4 || parts[0] != "rt1" {
+		return "", 0, nil, false
+	}
+	gen, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", 0, nil, false
+	}
+	mac, err = base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", 0, nil, false
+	}
+	return parts[1], gen, mac, true
+}
+
+// IssueTicket returns a new resumption ticket, invalidating earlier ones
+func (s *Session) IssueTicket() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ticketGen++
+	return resumeTicket(s.ID, s.DeviceID, s.ticketGen)
+}
+
+// Resume moves the ticket's session onto the PeerConnection and channels of
+// prov, the placeholder session of a new connection. The old PeerConnection,
+// if it is still up, is closed.
+func (sr *SessionRegistry) Resume(ticket, deviceID string, prov *Session) (*Session, error) {
+	id, gen, mac, ok := parseResumeTicket(ticket)
+	if !ok || sr.Draining() {
+		return nil, ErrResumeRejected
+	}
+	s := sr.Get(id)
+	if s == nil || !hmac.Equal(mac, resumeTicketMAC(id, deviceID, gen)) {
+		return nil, ErrResumeRejected
+	}
+
+	prov.mu.RLock()
+	pc, dc, pool := prov.pc, prov.dc, append([]*webrtc.DataChannel(nil), prov.pool...)
+	prov.mu.RUnlock()
+
+	s.mu.Lock()
+	if s.closed || !s.e2e || s.ticketGen != gen {
+		s.mu.Unlock()
+		return nil, ErrResumeRejected
+	}
+	old := s.pc
+	s.attachLocked(pc, dc, pool)
+	s.epoch++
+	s.mu.Unlock()
+
+	if old != nil && old != pc {
+		old.Close()
+	}
+	return s, nil
+}
+
+// Replay sends the resumed message with a fresh ticket, then everything the
+// client has not acknowledged. acks maps request IDs to the last sequence
+// number received.
+func (s *Session) Replay(acks map[string]int) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.Send(ServerMsg{Op: "resumed", ResumeTicket: s.IssueTicket()})
+	s.mu.Lock()
+	for id, seq := range acks {
+		s.pending.ack(id, seq)
+	}
+	// Each request is replayed on the channel its new output will use, so
+	// it stays in order
+	type replayed struct {
+		dc  *webrtc.DataChannel
+		msg ServerMsg
+	}
+	var out []replayed
+	for _, id := range s.pending.order {
+		r := s.pending.requests[id]
+		slot, running := s.slots[id]
+		dc := s.streamChannelLocked(slot)
+		if running {
+			dc = s.channelForLocked(id, slot)
+		}
+		if r.truncated {
+			out = append(out, replayed{dc, ServerMsg{Op: "error", RequestID: id, Code: codeResumeGap, Error: "output lost while disconnected"}})
+			continue
+		}
+		for _, msg := range r.msgs {
+			out = append(out, replayed{dc, msg})
+		}
+	}
+	s.pending.dropTruncated()
+	s.mu.Unlock()
+
+	for _, r := range out {
+		if err := s.sendOn(r.dc, r.msg); err != nil {
+			return
+		}
+	}
+	// Output coalesced for the old channel goes out on the new one
+	for rs := range s.held {
+		rs.flushLocked()
+	}
+}
+
+// Ack drops buffered output the client has confirmed
+func (s *Session) Ack(requestID string, seq int) {
+	s.mu.Lock()
+	s.pending.ack(requestID, seq)
+	s.mu.Unlock()
+}
+
+// RequestStream carries the output of one generation. Messages are tagged
+// with the request ID and a sequence number and kept until acknowledged so
+// they can be replayed after a resume.
+type RequestStream struct {
+	s   *Session
+	id  string
+	seq int
+	// ctx ends with the request, e.g. when the client cancels it
+	ctx context.Context
+	// slot picks the stream channel
+	slot int
+	// held is delta content waiting for the batch window or a congested
+	// channel; started is set once the first delta has gone out
+	held    string
+	started bool
+	batch   BatchOptions
+	timer   *time.Timer
+}
+
+// NewStream starts the output of a request on the next stream channel
+func (s *Session) NewStream(ctx context.Context, requestID string) *RequestStream {
+	s.mu.Lock()
+	slot := s.nextSlot
+	s.nextSlot++
+	s.mu.Unlock()
+
+	s.sendMu.Lock()
+	s.slots[requestID] = slot
+	s.sendMu.Unlock()
+	return &RequestStream{s: s, id: requestID, ctx: ctx, slot: slot, batch: s.batchOptions()}
+}
+
+// Send pauses while the channel is full and coalesces deltas while it is
+// congested
+func (rs *RequestStream) Send(msg ServerMsg) error {
+	rs.waitWritable()
+	rs.s.sendMu.Lock()
+	defer rs.s.sendMu.Unlock()
+	return rs.sendLocked(msg, congested(rs.channel()))
+}
+
+// sendLocked must be called with sendMu held
+func (rs *RequestStream) sendLocked(msg ServerMsg, congested bool) error {
+	if msg.Op != "delta" {
+		err := rs.flushLocked()
+		if e := rs.emitLocked(msg); e != nil {
+			err = e
+		}
+		return err
+	}
+	if rs.held != "" {
+		rs.s.flow.coalesced.Add(1)
+	}
+	rs.held += msg.Content
+	limit := rs.batch.MaxBytes
+	if congested {
+		limit = maxCoalescedBytes
+	}
+	switch {
+	case !rs.started:
+		// The first token goes out at once to keep TTFT low
+		rs.started = true
+		return rs.flushLocked()
+	case len(rs.held) >= limit:
+		return rs.flushLocked()
+	case congested:
+		rs.s.held[rs] = struct{}{}
+		return nil
+	case rs.batch.WindowMs <= 0:
+		return rs.flushLocked()
+	}
+	rs.armLocked()
+	return nil
+}
+
+// flushLocked sends coalesced content as one delta
+func (rs *RequestStream) flushLocked() error {
+	delete(rs.s.held, rs)
+	if rs.timer != nil {
+		rs.timer.Stop()
+		rs.timer = nil
+	}
+	if rs.held == "" {
+		return nil
+	}
+	msg := ServerMsg{Op: "delta", Content: rs.held}
+	rs.held = ""
+	return rs.emitLocked(msg)
+}
+
+func (rs *RequestStream) emitLocked(msg ServerMsg) error {
+	rs.seq++
+	msg.RequestID, msg.Seq = rs.id, rs.seq
+	rs.s.mu.Lock()
+	rs.s.pending.add(msg)
+	dc := rs.s.channelForLocked(rs.id, rs.slot)
+	last := msg.Op == "done" || msg.Op == "error"
+	if last {
+		delete(rs.s.pinned, rs.id)
+	}
+	rs.s.mu.Unlock()
+	if last {
+		delete(rs.s.slots, rs.id)
+	}
+	return rs.s.sendOn(dc, msg)
+}
+
+// resumeBuffer holds per-request output until it is acknowledged. When it is
+// full, finished requests are evicted first; a running request that does
+// not fit is marked truncated and reported as a gap on resume.
+type resumeBuffer struct {
+	requests map[string]*pendingRequest
+	order    []string
+	bytes    int
+}
+
+type pendingRequest struct {
+	msgs      []ServerMsg
+	bytes     int
+	done      bool
+	truncated bool
+}
+
+func newResumeBuffer() resumeBuffer {
+	return resumeBuffer{requests: make(map[string]*pendingRequest)}
+}
+
+func messageSize(msg ServerMsg) int {
+	return len(msg.Content) + len(msg.Error) + 64
+}
+
+func (b *resumeBuffer) add(msg ServerMsg) {
+	r := b.requests[msg.RequestID]
+	if r == nil {
+		r = &pendingRequest{}
+		b.requests[msg.RequestID] = r
+		b.order = append(b.order, msg.RequestID)
+	}
+	if msg.Op == "done" || msg.Op == "error" {
+		r.done = true
+	}
+	if r.truncated {
+		return
+	}
+	size := messageSize(msg)
+	for i := 0; b.bytes+size > maxResumeBufferBytes && i < len(b.order); {
+		id := b.order[i]
+		if old := b.requests[id]; id != msg.RequestID && old.done {
+			b.remove(id)
+			continue
+		}
+		i++
+	}
+	if b.bytes+size > maxResumeBufferBytes {
+		b.bytes -= r.bytes
+		r.msgs, r.bytes, r.truncated = nil, 0, true
+		return
+	}
+	r.msgs = append(r.msgs, msg)
+	r.bytes += size
+	b.bytes += size
+}
+
+func (b *resumeBuffer) ack(requestID string, seq int) {
+	r := b.requests[requestID]
+	if r == nil {
+		return
+	}
+	n := 0
+	for n < len(r.msgs) && r.msgs[n].Seq <= seq {
+		size := messageSize(r.msgs[n])
+		r.bytes -= size
+		b.bytes -= size
+		n++
+	}
+	r.msgs = r.msgs[n:]
+	if r.done && len(r.msgs) == 0 && !r.truncated {
+		b.remove(requestID)
+	}
+}
+
+// dropTruncated forgets finished requests whose gap has been reported
+func (b *resumeBuffer) dropTruncated() {
+	for _, id := range append([]string(nil), b.order...) {
+		if r := b.requests[id]; r.truncated && r.done {
+			b.remove(id)
+		}
+	}
+}
+
+func (b *resumeBuffer) remove(id string) {
+	r := b.requests[id]
+	if r == nil {
+		return
+	}
+	b.bytes -= r.bytes
+	delete(b.requests, id)
+	for i, o := range b.order {
+		if o == id {
+			b.order = append(b.order[:i], b.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResumeTicket(t *testing.T) {
+	sr := NewSessionRegistry()
+	s := NewSession("s1", "dev-1", nil, nil)
+	sr.Add(s)
+	s.SetE2E()
+
+	ticket := s.IssueTicket()
+	// prov stands in for the session of the new connection
+	prov := NewSession("p", "dev-1", nil, nil)
+	if _, err := sr.Resume(ticket, "dev-2", prov); !errors.Is(err, ErrResumeRejected) {
+		t.Errorf("ticket accepted for another device: %v", err)
+	}
+	if _, err := sr.Resume(strings.Replace(ticket, ".1.", ".2.", 1), "dev-1", prov); !errors.Is(err, ErrResumeRejected) {
+		t.Errorf("forged generation accepted: %v", err)
+	}
+	if got, err := sr.Resume(ticket, "dev-1", prov); err != nil || got != s {
+		t.Fatalf("resume = %v, %v", got, err)
+	}
+
+	// A ticket is single-use once a newer one is issued
+	s.IssueTicket()
+	if _, err := sr.Resume(ticket, "dev-1", prov); !errors.Is(err, ErrResumeRejected) {
+		t.Errorf("stale ticket accepted: %v", err)
+	}
+
+	s.Close()
+	if _, err := sr.Resume(s.IssueTicket(), "dev-1", prov); !errors.Is(err, ErrResumeRejected) {
+		t.Errorf("closed session resumed: %v", err)
+	}
+}
+
+func TestResumeBuffer(t *testing.T) {
+	b := newResumeBuffer()
+	for i := 1; i <= 3; i++ {
+		b.add(ServerMsg{Op: "delta", RequestID: "r1", Seq: i, Content: "x"})
+	}
+	b.ack("r1", 2)
+	if r := b.requests["r1"]; len(r.msgs) != 1 || r.msgs[0].Seq != 3 {
+		t.Fatalf("after ack: %+v", r.msgs)
+	}
+	b.add(ServerMsg{Op: "done", RequestID: "r1", Seq: 4})
+	b.ack("r1", 4)
+	if len(b.requests) != 0 || b.bytes != 0 {
+		t.Errorf("finished request not released: %d requests, %d bytes", len(b.requests), b.bytes)
+	}
+
+	// A finished request is evicted to make room; a running one that
+	// still does not fit is truncated
+	big := strings.Repeat("x", maxResumeBufferBytes/2)
+	b.add(ServerMsg{Op: "done", RequestID: "old", Seq: 1, Content: big})
+	b.add(ServerMsg{Op: "delta", RequestID: "r2", Seq: 1, Content: big})
+	if _, ok := b.requests["old"]; ok {
+		t.Error("finished request not evicted")
+	}
+	b.add(ServerMsg{Op: "delta", RequestID: "r2", Seq: 2, Content: big})
+	if r := b.requests["r2"]; !r.truncated || b.bytes != 0 {
+		t.Errorf("overflowing request not truncated: %+v, %d bytes", r.truncated, b.bytes)
+	}
+	b.add(ServerMsg{Op: "done", RequestID: "r2", Seq: 3})
+	b.dropTruncated()
+	if len(b.requests) != 0 {
+		t.Error("reported gap not dropped")
+	}
+}
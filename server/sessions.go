@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// codeShutdown is set on error and done messages sent because the server is
+// stopping, so clients can reconnect instead of reporting a failure
+const codeShutdown = "shutdown"
+
+// codeClosed is sent when an administrator closes the session or revokes
+// its device
+const codeClosed = "closed"
+
+// Session is a conversation with a paired device. It normally lives as long
+// as its PeerConnection, but an E2E session with a resumption ticket survives
+// losing it for sessionResumeWindow and can be moved to a new one.
+type Session struct {
+	ID        string
+	DeviceID  string
+	StartedAt time.Time
+
+	// ctx is cancelled when the session closes; generations derive from it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// sendMu orders stream output against replay on resume; it also guards
+	// held, the streams with coalesced output waiting for the channel, and
+	// slots, the stream channel slot of each request
+	sendMu sync.Mutex
+	held   map[*RequestStream]struct{}
+	slots  map[string]int
+	flow   flowStats
+
+	mu sync.RWMutex
+	pc *webrtc.PeerConnection
+	// dc is the control channel; pool holds the open stream channels
+	dc       *webrtc.DataChannel
+	pool     []*webrtc.DataChannel
+	nextSlot int
+	// pinned is the channel each running request sends on
+	pinned   map[string]*webrtc.DataChannel
+	e2e      bool
+	inflight int
+	notified bool
+	closed   bool
+	// ticketGen is the generation of the only valid resumption ticket; 0
+	// means none has been issued
+	ticketGen int
+	// epoch counts transport changes so a stale expiry timer does nothing
+	epoch   int
+	pending resumeBuffer
+	// writable has a channel per DataChannel that is closed and replaced
+	// when it drains or the transport changes
+	writable map[*webrtc.DataChannel]chan struct{}
+	// cancels stops running generations by request ID
+	cancels map[string]context.CancelCauseFunc
+	// batch overrides the configured delta batching for this session
+	batch *BatchOptions
+	// enc is the encoding negotiated with hello
+	enc wireEncoding
+	// attachments holds images sent with attach until a chat claims them
+	attachments map[string]*attachment
+	// approvals are sensitive tool calls waiting for the device
+	approvals map[string]chan bool
+}
+
+func NewSession(id, deviceID string, pc *webrtc.PeerConnection, dc *webrtc.DataChannel) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		ID:        id,
+		DeviceID:  deviceID,
+		StartedAt: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		held:      make(map[*RequestStream]struct{}),
+		slots:     make(map[string]int),
+		pinned:    make(map[string]*webrtc.DataChannel),
+		cancels:   make(map[string]context.CancelCauseFunc),
+		pending:   newResumeBuffer(),
+	}
+	s.attachLocked(pc, dc, nil)
+	return s
+}
+
+// SessionInfo is the admin view of a session
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	DeviceID  string    `json:"device_id"`
+	StartedAt time.Time `json:"started_at"`
+	E2E       bool      `json:"e2e"`
+	Inflight  int       `json:"inflight"`
+	Detached  bool      `json:"detached"`
+	Encoding  string    `json:"encoding"`
+	// BufferedBytes is queued in the DataChannel; ResumeBytes is kept
+	// until the client acknowledges it
+	BufferedBytes uint64 `json:"buffered_bytes"`
+	ResumeBytes   int    `json:"resume_bytes"`
+	Coalesced     int64  `json:"coalesced"`
+	Pauses        int64  `json:"pauses"`
+	// StreamChannels is the number of open stream channels
+	StreamChannels int `json:"stream_channels"`
+}
+
+func (s *Session) Info() SessionInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info := SessionInfo{
+		ID:          s.ID,
+		DeviceID:    s.DeviceID,
+		StartedAt:   s.StartedAt,
+		E2E:         s.e2e,
+		Inflight:    s.inflight,
+		Detached:    s.dc == nil,
+		Encoding:    s.enc.String(),
+		ResumeBytes: s.pending.bytes,
+		Coalesced:   s.flow.coalesced.Load(),
+		Pauses:      s.flow.pauses.Load(),
+
+		StreamChannels: len(s.pool),
+	}
+	for dc := range s.writable {
+		info.BufferedBytes += dc.BufferedAmount()
+	}
+	return info
+}
+
+func (s *Session) E2E() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.e2e
+}
+
+func (s *Session) SetE2E() {
+	s.mu.Lock()
+	s.e2e = true
+	s.mu.Unlock()
+}
+
+// SetEncoding switches the encoding of messages sent from now on
+func (s *Session) SetEncoding(enc wireEncoding) {
+	s.mu.Lock()
+	s.enc = enc
+	s.mu.Unlock()
+}
+
+// SendPlain sends without encryption, for the handshake and errors that
+// happen before or outside it
+func (s *Session) SendPlain(msg ServerMsg) error {
+	s.mu.RLock()
+	dc, enc := s.dc, s.enc
+	s.mu.RUnlock()
+	if dc == nil {
+		return nil
+	}
+	return sendPlain(dc, enc, msg)
+}
+
+// Send sends on the control channel, encrypted if the Noise session is
+// established. It is a no-op while the session has no transport.
+func (s *Session) Send(msg ServerMsg) error {
+	s.mu.RLock()
+	dc := s.dc
+	s.mu.RUnlock()
+	return s.sendOn(dc, msg)
+}
+
+// notifyShutdown tells the client the server is going away, once
+func (s *Session) notifyShutdown() {
+	s.mu.Lock()
+	already := s.notified
+	s.notified = true
+	s.mu.Unlock()
+	if !already {
+		s.Send(ServerMsg{Op: "error", Code: codeShutdown, Error: "server is shutting down"})
+	}
+}
+
+// Close cancels the session's generations and closes the PeerConnection
+func (s *Session) Close() {
+	s.cancel()
+	s.mu.Lock()
+	pc := s.pc
+	s.closed = true
+	s.mu.Unlock()
+	if pc != nil {
+		pc.Close()
+	}
+}
+
+// SessionRegistry tracks live sessions and their in-flight generations so
+// the server can drain them on shutdown
+type SessionRegistry struct {
+	mu          sync.Mutex
+	sessions    map[string]*Session
+	draining    bool
+	generations sync.WaitGroup
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{sessions: make(map[string]*Session)}
+}
+
+// Add registers a session; it fails once draining has started
+func (sr *SessionRegistry) Add(s *Session) bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.draining {
+		return false
+	}
+	sr.sessions[s.ID] = s
+	return true
+}
+
+func (sr *SessionRegistry) Remove(id string) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	delete(sr.sessions, id)
+}
+
+// end closes a session for good and forgets its Noise state
+func (sr *SessionRegistry) end(s *Session) {
+	s.Close()
+	if noiseManager != nil {
+		noiseManager.CloseSession(s.ID)
+	}
+	sr.Remove(s.ID)
+}
+
+// TransportClosed handles the loss of a session's PeerConnection. A session
+// holding a resumption ticket is kept for sessionResumeWindow with its
+// generations running; any other session ends. Closing a PeerConnection the
+// session has already moved away from does nothing.
+func (sr *SessionRegistry) TransportClosed(s *Session, pc *webrtc.PeerConnection) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.closed || s.pc != pc {
+		s.mu.Unlock()
+		return
+	}
+	s.attachLocked(nil, nil, nil)
+	s.epoch++
+	epoch := s.epoch
+	resumable := s.ticketGen > 0 && !sr.Draining()
+	s.mu.Unlock()
+
+	if !resumable {
+		sr.end(s)
+		return
+	}
+	logger.Info("session detached, waiting for resume", logKeySession, s.ID, "window", sessionResumeWindow)
+	time.AfterFunc(sessionResumeWindow, func() {
+		s.mu.RLock()
+		expired := s.epoch == epoch && s.dc == nil
+		s.mu.RUnlock()
+		if expired {
+			logger.Info("resume window expired", logKeySession, s.ID)
+			sr.end(s)
+		}
+	})
+}
+
+func (sr *SessionRegistry) Get(id string) *Session {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.sessions[id]
+}
+
+func (sr *SessionRegistry) List() []*Session {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	out := make([]*Session, 0, len(sr.sessions))
+	for _, s := range sr.sessions {
+		out = append(out, s)
+	}
+	return out
+}
+
+// CloseDevice closes every session belonging to a device and returns how
+// many were closed
+func (sr *SessionRegistry) CloseDevice(deviceID string) int {
+	n := 0
+	for _, s := range sr.List() {
+		if s.DeviceID == deviceID {
+			s.Send(ServerMsg{Op: "error", Code: codeClosed, Error: "session closed by administrator"})
+			sr.end(s)
+			n++
+		}
+	}
+	return n
+}
+
+func (sr *SessionRegistry) Draining() bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.draining
+}
+
+// BeginGeneration registers an in-flight generation on s. The returned
+// context is cancelled if the session closes or the drain deadline passes;
+// done must be called when the generation finishes.
+func (sr *SessionRegistry) BeginGeneration(s *Session) (ctx context.Context, done func(), ok bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.draining {
+		return nil, nil, false
+	}
+	sr.generations.Add(1)
+	s.mu.Lock()
+	s.inflight++
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	return ctx, func() {
+		cancel()
+		s.mu.Lock()
+		s.inflight--
+		s.mu.Unlock()
+		sr.generations.Done()
+	}, true
+}
+
+// Drain stops new sessions and generations, closes idle sessions, waits for
+// in-flight generations until ctx expires, then cancels the rest and closes
+// every session
+func (sr *SessionRegistry) Drain(ctx context.Context) {
+	sr.mu.Lock()
+	sr.draining = true
+	sr.mu.Unlock()
+
+	for _, s := range sr.List() {
+		s.mu.RLock()
+		idle := s.inflight == 0
+		s.mu.RUnlock()
+		if idle {
+			s.notifyShutdown()
+			s.Close()
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		sr.generations.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		logger.Warn("drain deadline reached, cancelling generations")
+		for _, s := range sr.List() {
+			s.cancel()
+		}
+		// Give cancelled generations a moment to send their done message
+		select {
+		case <-finished:
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	for _, s := range sr.List() {
+		s.notifyShutdown()
+		s.Close()
+	}
+}
+
+var sessions = NewSessionRegistry()
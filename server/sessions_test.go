@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForGenerations(t *testing.T) {
+	sr := NewSessionRegistry()
+	busy := NewSession("busy", "dev-1", nil, nil)
+	idle := NewSession("idle", "dev-2", nil, nil)
+	sr.Add(busy)
+	sr.Add(idle)
+
+	genCtx, done, ok := sr.BeginGeneration(busy)
+	if !ok {
+		t.Fatal("Expected generation to start")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		done()
+	}()
+
+	sr.Drain(context.Background())
+	if idle.ctx.Err() == nil || busy.ctx.Err() == nil {
+		t.Error("Expected every session to be closed after drain")
+	}
+	if genCtx.Err() == nil {
+		t.Error("Expected generation context to be released")
+	}
+	if sr.Add(NewSession("late", "dev-3", nil, nil)) {
+		t.Error("Sessions must not be added while draining")
+	}
+	if _, _, ok := sr.BeginGeneration(busy); ok {
+		t.Error("Generations must not start while draining")
+	}
+}
+
+func TestDrainCancelsAtDeadline(t *testing.T) {
+	sr := NewSessionRegistry()
+	s := NewSession("slow", "dev-1", nil, nil)
+	sr.Add(s)
+	genCtx, done, _ := sr.BeginGeneration(s)
+
+	// The generation stops as soon as it sees cancellation
+	go func() {
+		<-genCtx.Done()
+		done()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	sr.Drain(ctx)
+	if time.Since(start) > time.Second {
+		t.Errorf("Drain took too long: %v", time.Since(start))
+	}
+	if shutdownCode(genCtx) != codeShutdown {
+		t.Error("Cancelled generation should report the shutdown code")
+	}
+}
+
+func TestCloseDevice(t *testing.T) {
+	ks, err := OpenKeyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm, err := NewNoiseManager(false, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(prev *NoiseManager) { noiseManager = prev }(noiseManager)
+	noiseManager = nm
+	nm.StartSession("a", nil)
+
+	sr := NewSessionRegistry()
+	a := NewSession("a", "dev-1", nil, nil)
+	b := NewSession("b", "dev-2", nil, nil)
+	sr.Add(a)
+	sr.Add(b)
+	if n := sr.CloseDevice("dev-1"); n != 1 {
+		t.Fatalf("closed %d sessions, want 1", n)
+	}
+	if a.ctx.Err() == nil || b.ctx.Err() != nil {
+		t.Error("wrong session closed")
+	}
+	if sr.Get("a") != nil || len(sr.List()) != 1 {
+		t.Error("closed session still listed")
+	}
+	if _, ok := nm.sessions["a"]; ok {
+		t.Error("closed session kept its Noise state")
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signaling auth headers. A client proves pairing either with
+// "Authorization: Bearer <token>" or by signing the offer with its Ed25519
+// device key:
+//
+//	X-QuicPair-Device:    device ID
+//	X-QuicPair-Timestamp: unix seconds
+//	X-QuicPair-Signature: base64 Ed25519 signature over offerSigningInput
+const (
+	headerDevice    = "X-QuicPair-Device"
+	headerTimestamp = "X-QuicPair-Timestamp"
+	headerSignature = "X-QuicPair-Signature"
+
+	tokenPrefix       = "qp1"
+	tokenKeyName      = "signaling-token.key"
+	offerSkew         = 60 * time.Second
+	pairCodeTTL       = 5 * time.Minute
+	maxSignalingBody  = 64 << 10
+	authMaxFailures   = 5
+	authFailureWindow = 5 * time.Minute
+	authBaseBlock     = time.Minute
+	authMaxBlock      = 15 * time.Minute
+)
+
+var (
+	ErrNoCredentials = errors.New("missing pairing credentials")
+	ErrBadToken      = errors.New("invalid token")
+	ErrBadSignature  = errors.New("invalid offer signature")
+	ErrStaleOffer    = errors.New("offer timestamp outside allowed window")
+	ErrReplayedOffer = errors.New("offer signature already used")
+	ErrNoSigningKey  = errors.New("device has no signing key")
+	ErrBadPairCode   = errors.New("invalid or expired pairing code")
+)
+
+// offerSigningInput is the byte string a device signs for an offer
+func offerSigningInput(deviceID, timestamp, sdp string) []byte {
+	return []byte("quicpair-offer\n" + deviceID + "\n" + timestamp + "\n" + sdp)
+}
+
+// SignalingAuth verifies pairing credentials on signaling requests
+type SignalingAuth struct {
+	tokenKey []byte
+	devices  *DeviceRegistry
+
+	mu        sync.Mutex
+	seenSigs  map[string]time.Time
+	pairCodes map[string]time.Time
+	failures  map[string]*authFailures
+	// pairWaiters are notified when a code is redeemed, for "pair"
+	pairWaiters map[string]chan Device
+}
+
+type authFailures struct {
+	count        int
+	first        time.Time
+	blocks       int
+	blockedUntil time.Time
+}
+
+// expired reports whether the failures no longer count and no block is
+// remembered for escalation, so the entry can be forgotten
+func (f *authFailures) expired(now time.Time) bool {
+	return now.Sub(f.first) > authFailureWindow && now.Sub(f.blockedUntil) >= authFailureWindow
+}
+
+func NewSignalingAuth(tokenKey []byte, devices *DeviceRegistry) *SignalingAuth {
+	return &SignalingAuth{
+		tokenKey:    tokenKey,
+		devices:     devices,
+		seenSigs:    make(map[string]time.Time),
+		pairCodes:   make(map[string]time.Time),
+		failures:    make(map[string]*authFailures),
+		pairWaiters: make(map[string]chan Device),
+	}
+}
+
+// IssueToken returns the bearer token for a device. Tokens are an HMAC of the
+// device ID, so they need no storage and die with the device's revocation.
+func (sa *SignalingAuth) IssueToken(deviceID string) string {
+	return tokenPrefix + "." + deviceID + "." + base64.RawURLEncoding.EncodeToString(sa.tokenMAC(deviceID))
+}
+
+func (sa *SignalingAuth) tokenMAC(deviceID string) []byte {
+	mac := hmac.New(sha256.New, sa.tokenKey)
+	mac.Write([]byte(tokenPrefix + "." + deviceID))
+	return mac.Sum(nil)
+}
+
+// verifyToken returns the device ID encoded in a valid token
+func (sa *SignalingAuth) verifyToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenPrefix {
+		return "", ErrBadToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, sa.tokenMAC(parts[1])) {
+		return "", ErrBadToken
+	}
+	return parts[1], nil
+}
+
+// Authenticate checks the request's credentials against the offer SDP and
+// returns the paired device
+func (sa *SignalingAuth) Authenticate(r *http.Request, sdp string) (*Device, error) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		deviceID, err := sa.verifyToken(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			return nil, err
+		}
+		return sa.devices.Active(deviceID)
+	}
+
+	deviceID := r.Header.Get(headerDevice)
+	if deviceID == "" {
+		return nil, ErrNoCredentials
+	}
+	device, err := sa.devices.Active(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	pub := device.signingKey()
+	if pub == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	ts := r.Header.Get(headerTimestamp)
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrStaleOffer
+	}
+	if d := time.Since(time.Unix(unix, 0)); d > offerSkew || d < -offerSkew {
+		return nil, ErrStaleOffer
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get(headerSignature))
+	if err != nil || !ed25519.Verify(pub, offerSigningInput(deviceID, ts, sdp), sig) {
+		return nil, ErrBadSignature
+	}
+
+	// A signature is only good once inside its validity window
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	now := time.Now()
+	for k, exp := range sa.seenSigs {
+		if now.After(exp) {
+			delete(sa.seenSigs, k)
+		}
+	}
+	key := string(sig)
+	if _, seen := sa.seenSigs[key]; seen {
+		return nil, ErrReplayedOffer
+	}
+	sa.seenSigs[key] = now.Add(2 * offerSkew)
+	return device, nil
+}
+
+// Blocked reports whether a remote host is rate-limited and for how long
+func (sa *SignalingAuth) Blocked(host string) (time.Duration, bool) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	f, ok := sa.failures[host]
+	if !ok {
+		return 0, false
+	}
+	if wait := time.Until(f.blockedUntil); wait > 0 {
+		return wait, true
+	}
+	return 0, false
+}
+
+// Fail records a failed attempt. Each block after authMaxFailures doubles
+// in length up to authMaxBlock.
+func (sa *SignalingAuth) Fail(host string) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	now := time.Now()
+	for k, old := range sa.failures {
+		if k != host && old.expired(now) {
+			delete(sa.failures, k)
+		}
+	}
+	f, ok := sa.failures[host]
+	if !ok || now.Sub(f.first) > authFailureWindow {
+		blocks := 0
+		if ok && now.Sub(f.blockedUntil) < authFailureWindow {
+			blocks = f.blocks
+		}
+		f = &authFailures{first: now, blocks: blocks}
+		sa.failures[host] = f
+	}
+	f.count++
+	if f.count >= authMaxFailures {
+		block := authBaseBlock << f.blocks
+		if block > authMaxBlock || block <= 0 {
+			block = authMaxBlock
+		}
+		f.blockedUntil = now.Add(block)
+		f.blocks++
+		f.count = 0
+		f.first = now
+	}
+}
+
+// Succeed clears the failure history of a host
+func (sa *SignalingAuth) Succeed(host string) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	delete(sa.failures, host)
+}
+
+// NewPairCode issues a one-time code for the pairing QR
+func (sa *SignalingAuth) NewPairCode() (string, time.Time) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	code := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(pairCodeTTL)
+
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	for k, exp := range sa.pairCodes {
+		if time.Now().After(exp) {
+			delete(sa.pairCodes, k)
+			delete(sa.pairWaiters, k)
+		}
+	}
+	sa.pairCodes[code] = expires
+	sa.pairWaiters[code] = make(chan Device, 1)
+	return code, expires
+}
+
+// WaitPaired returns a channel that receives the device paired with code,
+// or nil if the code is unknown
+func (sa *SignalingAuth) WaitPaired(code string) <-chan Device {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	return sa.pairWaiters[code]
+}
+
+func (sa *SignalingAuth) notifyPaired(code string, d Device) {
+	sa.mu.Lock()
+	ch := sa.pairWaiters[code]
+	delete(sa.pairWaiters, code)
+	sa.mu.Unlock()
+	if ch != nil {
+		ch <- d
+	}
+}
+
+// redeemPairCode consumes a code; it can only be used once
+func (sa *SignalingAuth) redeemPairCode(code string) error {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	for k, exp := range sa.pairCodes {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(code)) == 1 {
+			delete(sa.pairCodes, k)
+			if time.Now().After(exp) {
+				return ErrBadPairCode
+			}
+			return nil
+		}
+	}
+	return ErrBadPairCode
+}
+
+var signalingAuth *SignalingAuth
+
+func initSignalingAuth() {
+	key, err := keyStore.Load(tokenKeyName)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, 32)
+		rand.Read(key)
+		err = keyStore.Save(tokenKeyName, key)
+	}
+	if err != nil {
+		fatal("failed to load signaling token key", "error", err)
+	}
+	signalingAuth = NewSignalingAuth(key, deviceRegistry)
+}
+
+// authenticateSignaling checks a signaling request whose signature covers
+// signed, writing the error response on failure. Unpaired clients get a
+// per-host device ID when allowUnpaired is set.
+func authenticateSignaling(w http.ResponseWriter, r *http.Request, signed string) (string, bool) {
+	host := remoteHost(r)
+	if wait, blocked := signalingAuth.Blocked(host); blocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+		return "", false
+	}
+	device, err := signalingAuth.Authenticate(r, signed)
+	if err != nil && !(errors.Is(err, ErrNoCredentials) && allowUnpaired()) {
+		signalingAuth.Fail(host)
+		auditLog.Record(auditSignalingAuthFailed, map[string]string{
+			"peer":   host,
+			"reason": err.Error(),
+			"path":   r.URL.Path,
+		})
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+	if device == nil {
+		return "unpaired:" + host, true
+	}
+	signalingAuth.Succeed(host)
+	deviceRegistry.Touch(device.ID)
+	return device.ID, true
+}
+
+// allowUnpaired lets development builds skip signaling auth
+func allowUnpaired() bool {
+	return cfg().Dev.Enabled && cfg().Dev.AllowUnpaired
+}
+
+// handlePairingStart issues a one-time pairing code for the local Mac app,
+// returning it with the pairing payload to render as a QR code
+func handlePairingStart(addr string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p := currentPairingPayload(addr)
+		p.PairCode, p.PairCodeExpires = signalingAuth.NewPairCode()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// handlePairingComplete is called by the phone after scanning the QR. It
+// redeems the pairing code, registers the device and returns its token.
+func handlePairingComplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host := remoteHost(r)
+	if wait, blocked := signalingAuth.Blocked(host); blocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+		return
+	}
+
+	var req struct {
+		PairCode   string `json:"pair_code"`
+		DeviceName string `json:"device_name"`
+		SigningKey []byte `json:"signing_key,omitempty"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSignalingBody)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := signalingAuth.redeemPairCode(req.PairCode); err != nil {
+		signalingAuth.Fail(host)
+		auditLog.Record(auditSignalingAuthFailed, map[string]string{"peer": host, "reason": err.Error(), "path": r.URL.Path})
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	device, err := deviceRegistry.Pair(req.DeviceName, req.SigningKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	signalingAuth.Succeed(host)
+	signalingAuth.notifyPaired(req.PairCode, *device)
+	auditLog.Record(auditDevicePaired, map[string]string{
+		"device":          device.ID,
+		"name":            device.Name,
+		"peer":            host,
+		"has_signing_key": fmt.Sprint(device.SigningKey != ""),
+	})
+	logger.Info("device paired", "device", device.ID, logKeyPeer, host)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"device_id": device.ID,
+		"token":     signalingAuth.IssueToken(device.ID),
+	})
+}
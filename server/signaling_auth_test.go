@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestSignalingAuth(t *testing.T) (*SignalingAuth, *DeviceRegistry) {
+	devices, err := OpenDeviceRegistry(filepath.Join(t.TempDir(), "devices.json"))
+	if err != nil {
+		t.Fatalf("Failed to open device registry: %v", err)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return NewSignalingAuth(key, devices), devices
+}
+
+func TestSignalingTokenAuth(t *testing.T) {
+	sa, devices := newTestSignalingAuth(t)
+	device, _ := devices.Pair("iPhone", nil)
+	token := sa.IssueToken(device.ID)
+
+	req := httptest.NewRequest("POST", "/signaling/offer", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	got, err := sa.Authenticate(req, "v=0")
+	if err != nil || got.ID != device.ID {
+		t.Fatalf("Expected token to authenticate %s, got %v", device.ID, err)
+	}
+
+	// Forged token for another device
+	req.Header.Set("Authorization", "Bearer "+token[:len(token)-2]+"xx")
+	if _, err := sa.Authenticate(req, "v=0"); err != ErrBadToken {
+		t.Fatalf("Expected ErrBadToken, got %v", err)
+	}
+
+	// Revoked devices lose access even with a valid token
+	devices.Revoke(device.ID)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if _, err := sa.Authenticate(req, "v=0"); err != ErrDeviceRevoked {
+		t.Fatalf("Expected ErrDeviceRevoked, got %v", err)
+	}
+
+	// No credentials at all
+	if _, err := sa.Authenticate(httptest.NewRequest("POST", "/signaling/offer", nil), "v=0"); err != ErrNoCredentials {
+		t.Fatalf("Expected ErrNoCredentials, got %v", err)
+	}
+}
+
+func TestSignedOfferAuth(t *testing.T) {
+	sa, devices := newTestSignalingAuth(t)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	device, err := devices.Pair("iPhone", pub)
+	if err != nil {
+		t.Fatalf("Failed to pair: %v", err)
+	}
+
+	sdp := "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\n"
+	signed := func(ts time.Time, body string) *http.Request {
+		stamp := strconv.FormatInt(ts.Unix(), 10)
+		sig := ed25519.Sign(priv, offerSigningInput(device.ID, stamp, body))
+		req := httptest.NewRequest("POST", "/signaling/offer", nil)
+		req.Header.Set(headerDevice, device.ID)
+		req.Header.Set(headerTimestamp, stamp)
+		req.Header.Set(headerSignature, base64.StdEncoding.EncodeToString(sig))
+		return req
+	}
+
+	req := signed(time.Now(), sdp)
+	if _, err := sa.Authenticate(req, sdp); err != nil {
+		t.Fatalf("Expected signed offer to authenticate: %v", err)
+	}
+	if _, err := sa.Authenticate(req, sdp); err != ErrReplayedOffer {
+		t.Fatalf("Expected ErrReplayedOffer, got %v", err)
+	}
+	if _, err := sa.Authenticate(signed(time.Now(), sdp), sdp+"a=tampered\r\n"); err != ErrBadSignature {
+		t.Fatalf("Expected ErrBadSignature for modified SDP, got %v", err)
+	}
+	if _, err := sa.Authenticate(signed(time.Now().Add(-5*time.Minute), sdp), sdp); err != ErrStaleOffer {
+		t.Fatalf("Expected ErrStaleOffer, got %v", err)
+	}
+}
+
+func TestSignalingRateLimit(t *testing.T) {
+	sa, _ := newTestSignalingAuth(t)
+	host := "192.168.1.50"
+
+	for i := 0; i < authMaxFailures-1; i++ {
+		sa.Fail(host)
+	}
+	if _, blocked := sa.Blocked(host); blocked {
+		t.Fatal("Blocked before reaching the failure limit")
+	}
+	sa.Fail(host)
+	if wait, blocked := sa.Blocked(host); !blocked || wait > authBaseBlock {
+		t.Fatalf("Expected block of at most %v, got %v (%v)", authBaseBlock, wait, blocked)
+	}
+	if _, blocked := sa.Blocked("192.168.1.51"); blocked {
+		t.Fatal("Other hosts must not be blocked")
+	}
+
+	sa.Succeed(host)
+	if _, blocked := sa.Blocked(host); blocked {
+		t.Fatal("Expected success to clear the block")
+	}
+
+	// Hosts whose window and block have both passed are forgotten
+	long := time.Now().Add(-2 * authFailureWindow)
+	sa.failures["192.168.1.52"] = &authFailures{count: 1, first: long}
+	sa.failures["192.168.1.53"] = &authFailures{first: long, blocks: 1, blockedUntil: time.Now()}
+	sa.Fail(host)
+	if _, ok := sa.failures["192.168.1.52"]; ok {
+		t.Error("Expected expired failures to be evicted")
+	}
+	if _, ok := sa.failures["192.168.1.53"]; !ok {
+		t.Error("A recent block must be kept for escalation")
+	}
+}
+
+func TestPairCodeSingleUse(t *testing.T) {
+	sa, _ := newTestSignalingAuth(t)
+	code, _ := sa.NewPairCode()
+	if err := sa.redeemPairCode(code); err != nil {
+		t.Fatalf("Expected code to redeem: %v", err)
+	}
+	if err := sa.redeemPairCode(code); err != ErrBadPairCode {
+		t.Fatalf("Expected second use to fail, got %v", err)
+	}
+}
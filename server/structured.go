@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// A chat's format is "json" or a JSON schema. It is passed to Ollama's
+// structured outputs and the final answer is checked against it. An answer
+// that does not conform is retried once with the validation error; if that
+// fails too the client gets an error with codeSchemaMismatch.
+const (
+	codeBadFormat      = "bad_format"
+	codeSchemaMismatch = "schema_mismatch"
+	// schemaRetryPrompt asks the model to correct a non-conforming answer
+	schemaRetryPrompt = "Your answer did not match the required JSON schema: %v. Reply again with only JSON that matches the schema."
+)
+
+var ErrSchemaMismatch = errors.New("output does not match schema")
+
+// outputFormat is a compiled chat format
+type outputFormat struct {
+	// raw is sent to Ollama as format
+	raw interface{}
+	// schema is nil when any JSON will do
+	schema *jsonschema.Schema
+}
+
+// compileFormat accepts "json" or a schema object; nil means no format
+func compileFormat(f interface{}) (*outputFormat, error) {
+	switch f := f.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if f != "json" {
+			return nil, fmt.Errorf("format must be \"json\" or a JSON schema, got %q", f)
+		}
+		return &outputFormat{raw: f}, nil
+	case map[string]interface{}:
+		b, err := json.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+		c := jsonschema.NewCompiler()
+		// Only refs within the schema itself; never files or the network
+		c.LoadURL = func(s string) (io.ReadCloser, error) {
+			return nil, fmt.Errorf("external $ref %q not allowed", s)
+		}
+		if err := c.AddResource("format.json", bytes.NewReader(b)); err != nil {
+			return nil, fmt.Errorf("invalid format schema: %w", err)
+		}
+		schema, err := c.Compile("format.json")
+		if err != nil {
+			return nil, fmt.Errorf("invalid format schema: %w", err)
+		}
+		return &outputFormat{raw: f, schema: schema}, nil
+	}
+	return nil, fmt.Errorf("format must be \"json\" or a JSON schema, got %T", f)
+}
+
+// check validates a complete answer
+func (f *outputFormat) check(output string) error {
+	dec := json.NewDecoder(bytes.NewReader([]byte(output)))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("%w: not JSON: %v", ErrSchemaMismatch, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("%w: trailing data after JSON", ErrSchemaMismatch)
+	}
+	if f.schema == nil {
+		return nil
+	}
+	if err := f.schema.Validate(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrSchemaMismatch, err)
+	}
+	return nil
+}
+
+// structuredChat serves an /api/chat proxy request that has a format. The
+// answer is fetched without streaming so it can be checked, and retried
+// once, before the client sees it. A final mismatch returns the last
+// response together with an error wrapping ErrSchemaMismatch.
+func structuredChat(ctx context.Context, ollamaURL string, body map[string]interface{}, format *outputFormat) (map[string]interface{}, *OllamaFinal, error) {
+	body["stream"] = false
+	client := newEgressClient(2 * time.Minute)
+	var final *OllamaFinal
+	for attempt := 0; ; attempt++ {
+		b, _ := json.Marshal(body)
+		req, err := http.NewRequestWithContext(ctx, "POST", ollamaURL+"/api/chat", bytes.NewReader(b))
+		if err != nil {
+			return nil, final, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, final, err
+		}
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, final, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, final, fmt.Errorf("ollama returned status %d", resp.StatusCode)
+		}
+		var result map[string]interface{}
+		var parsed struct {
+			Message ChatMessage `json:"message"`
+			OllamaFinal
+		}
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return nil, final, err
+		}
+		json.Unmarshal(raw, &parsed)
+		final = final.add(&parsed.OllamaFinal)
+
+		mismatch := format.check(parsed.Message.Content)
+		if mismatch == nil || attempt > 0 {
+			return result, final, mismatch
+		}
+		msgs, _ := body["messages"].([]interface{})
+		body["messages"] = append(msgs, parsed.Message, ChatMessage{Role: "user", Content: fmt.Sprintf(schemaRetryPrompt, mismatch)})
+	}
+}
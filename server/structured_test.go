@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var personSchema = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"name", "age"},
+	"properties": map[string]interface{}{
+		"name": map[string]interface{}{"type": "string"},
+		"age":  map[string]interface{}{"type": "integer"},
+	},
+}
+
+func TestOutputFormatCheck(t *testing.T) {
+	f, err := compileFormat(personSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.check(`{"name": "Ada", "age": 36}`); err != nil {
+		t.Errorf("valid answer rejected: %v", err)
+	}
+	for _, out := range []string{`{"name": "Ada"}`, `{"name": "Ada", "age": "36"}`, `Sure! {"name": "Ada"}`, `{} {}`} {
+		if err := f.check(out); !errors.Is(err, ErrSchemaMismatch) {
+			t.Errorf("%s: expected ErrSchemaMismatch, got %v", out, err)
+		}
+	}
+
+	if f, err := compileFormat("json"); err != nil || f.check(`[1, 2]`) != nil {
+		t.Errorf("json format: %v", err)
+	}
+	for _, bad := range []interface{}{"yaml", 42, map[string]interface{}{"type": 7}, map[string]interface{}{"$ref": "file:///etc/hosts"}} {
+		if _, err := compileFormat(bad); err == nil {
+			t.Errorf("format %v accepted", bad)
+		}
+	}
+	local := map[string]interface{}{
+		"$defs": map[string]interface{}{"n": map[string]interface{}{"type": "integer"}},
+		"$ref":  "#/$defs/n",
+	}
+	if f, err := compileFormat(local); err != nil || f.check("3") != nil || f.check(`"3"`) == nil {
+		t.Errorf("in-document ref: %v", err)
+	}
+	if f, err := compileFormat(nil); f != nil || err != nil {
+		t.Error("missing format should mean none")
+	}
+}
+
+func TestFormatFromCBOR(t *testing.T) {
+	data, err := cborEnc.Marshal(map[string]interface{}{"op": "chat", "format": personSchema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cm ClientMsg
+	if _, err := decodeClientMsg(data, &cm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compileFormat(cm.Format); err != nil {
+		t.Errorf("schema sent as CBOR not accepted: %v", err)
+	}
+}
+
+func TestStructuredChatRetriesOnce(t *testing.T) {
+	answers := []string{`{"name": "Ada"}`, `{"name": "Ada", "age": 36}`}
+	var bodies []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":    map[string]string{"role": "assistant", "content": answers[len(bodies)-1]},
+			"done":       true,
+			"eval_count": 5,
+		})
+	}))
+	defer srv.Close()
+	f, _ := compileFormat(personSchema)
+
+	body := map[string]interface{}{"model": "m", "messages": []interface{}{map[string]interface{}{"role": "user", "content": "who?"}}, "format": personSchema}
+	result, final, err := structuredChat(context.Background(), srv.URL, body, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 || bodies[0]["stream"] != false || len(bodies[1]["messages"].([]interface{})) != 3 {
+		t.Errorf("expected one retry with the failed answer and a correction, got %v", bodies)
+	}
+	if result["message"].(map[string]interface{})["content"] != answers[1] || final.EvalCount != 10 {
+		t.Errorf("unexpected result %v, %+v", result, final)
+	}
+
+	answers = []string{`{}`, `{}`}
+	bodies = nil
+	body["messages"] = []interface{}{}
+	if _, _, err := structuredChat(context.Background(), srv.URL, body, f); !errors.Is(err, ErrSchemaMismatch) || len(bodies) != 2 {
+		t.Errorf("expected a mismatch after one retry, got %v after %d calls", err, len(bodies))
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS modes selected with TLS_MODE
+const (
+	tlsModeSelfSigned = "self-signed"
+	tlsModeFiles      = "files"
+	tlsModeACME       = "acme"
+	tlsModeOff        = "off"
+)
+
+const (
+	tlsCertName     = "tls.crt"
+	tlsKeyName      = "tls.key"
+	selfSignedTTL   = 365 * 24 * time.Hour
+	selfSignedRenew = 30 * 24 * time.Hour
+)
+
+// TLSState describes the active TLS identity
+type TLSState struct {
+	Mode string
+	// Fingerprint is the base64 SHA-256 of the leaf's SubjectPublicKeyInfo.
+	// Self-signed renewals reuse the key, so the pin survives them.
+	Fingerprint string
+	Config      *tls.Config
+	// challenge answers ACME TLS-ALPN-01 validation; set in acme mode
+	challenge *tls.Config
+}
+
+var tlsState = &TLSState{Mode: tlsModeOff}
+
+// initTLS builds the TLS configuration from tls.mode. The default is "off"
+// so existing plain-http clients and a reverse proxy such as Caddy keep
+// working; set self-signed to have the server terminate TLS itself. Plain
+// http on anything but loopback is warned about at every start.
+func initTLS() {
+	c := cfg().TLS
+	mode := c.Mode
+	var err error
+	switch mode {
+	case tlsModeSelfSigned:
+		tlsState, err = selfSignedTLS(keyStore)
+	case tlsModeFiles:
+		tlsState, err = fileTLS(c.CertFile, c.KeyFile)
+	case tlsModeACME:
+		tlsState, err = acmeTLS(c.ACMEDomains, c.ACMEEmail)
+	case tlsModeOff:
+		tlsState = &TLSState{Mode: tlsModeOff}
+		if listensOnLoopback(cfg().Listen) {
+			logger.Info("TLS is disabled; serving plain http on loopback for a local proxy")
+			return
+		}
+		logger.Warn("INSECURE: TLS is disabled on a network listener; offers and pairing tokens travel in cleartext. "+
+			"Set tls.mode: self-signed, or listen on loopback behind a TLS proxy", "listen", cfg().Listen)
+		return
+	default:
+		err = fmt.Errorf("unknown tls.mode %q", mode)
+	}
+	if err != nil {
+		fatal("failed to initialize TLS", "mode", mode, "error", err)
+	}
+	logger.Info("TLS ready", "mode", tlsState.Mode, "fingerprint", tlsState.Fingerprint)
+}
+
+// listensOnLoopback reports whether addr only accepts loopback connections
+func listensOnLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// selfSignedTLS loads the persisted certificate or creates one. The private
+// key is generated once and kept in the key store.
+func selfSignedTLS(ks *KeyStore) (*TLSState, error) {
+	key, err := loadOrCreateTLSKey(ks)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM, err := ks.Load(tlsCertName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var leaf *x509.Certificate
+	if certPEM != nil {
+		if block, _ := pem.Decode(certPEM); block != nil {
+			leaf, _ = x509.ParseCertificate(block.Bytes)
+		}
+	}
+	if leaf == nil || time.Until(leaf.NotAfter) < selfSignedRenew || !hostsCovered(leaf) {
+		der, err := createSelfSigned(key)
+		if err != nil {
+			return nil, err
+		}
+		certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if err := ks.Save(tlsCertName, certPEM); err != nil {
+			return nil, err
+		}
+		leaf, _ = x509.ParseCertificate(der)
+		logger.Info("generated self-signed TLS certificate", "not_after", leaf.NotAfter)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLSState{
+		Mode:        tlsModeSelfSigned,
+		Fingerprint: spkiFingerprint(leaf),
+		Config:      &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}},
+	}, nil
+}
+
+func loadOrCreateTLSKey(ks *KeyStore) (*ecdsa.PrivateKey, error) {
+	keyPEM, err := ks.Load(tlsKeyName)
+	if err == nil {
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, errors.New("invalid TLS key in key store")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.Save(tlsKeyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func createSelfSigned(key *ecdsa.PrivateKey) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	dnsNames, ips := certHosts()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "QuicPair", Organization: []string{"QuicPair"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedTTL),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+	return x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+}
+
+// certHosts returns the names and local addresses the certificate covers
+func certHosts() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		h = strings.TrimSuffix(h, ".local")
+		names = append(names, h, h+".local")
+	}
+
+	var ips []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && isLocalIP(ipnet.IP) {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		ips = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	return names, ips
+}
+
+// hostsCovered reports whether the certificate still lists every local
+// address, so a new DHCP lease triggers a reissue with the same key
+func hostsCovered(leaf *x509.Certificate) bool {
+	_, ips := certHosts()
+	for _, ip := range ips {
+		found := false
+		for _, c := range leaf.IPAddresses {
+			if c.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func fileTLS(certFile, keyFile string) (*TLSState, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls.cert_file and tls.key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &TLSState{
+		Mode:        tlsModeFiles,
+		Fingerprint: spkiFingerprint(leaf),
+		Config:      &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}},
+	}, nil
+}
+
+// acmeTLS obtains certificates with ACME. The CA validates with TLS-ALPN-01
+// on port 443 from the internet, which the strict-local listener would drop,
+// so challenges are answered on a separate listener (serveACMEChallenges).
+// It is meant for deployments without Caddy in front. Certificates rotate,
+// so there is no stable pin and clients rely on the public CA instead.
+func acmeTLS(domains []string, email string) (*TLSState, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("tls.acme_domains is required")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(filepath.Join(keyStore.Dir(), "acme")),
+		Email:      email,
+		// The CA is the one deliberate exception to the egress guard
+		Client: &acme.Client{
+			DirectoryURL: autocert.DefaultACMEDirectory,
+			HTTPClient:   &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+		},
+	}
+	tc := m.TLSConfig()
+	tc.MinVersion = tls.VersionTLS12
+	challenge := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}
+	return &TLSState{Mode: tlsModeACME, Config: tc, challenge: challenge}, nil
+}
+
+// serveACMEChallenges listens on addr for the CA's validation handshakes.
+// Only the acme-tls/1 protocol is offered and nothing is served after the
+// handshake, so it skips strict-local filtering without exposing the API.
+func serveACMEChallenges(addr string, tc *tls.Config) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("acme challenge listen failed", "addr", addr, "error", err)
+	}
+	logger.Info("answering acme challenges", "addr", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Error("acme challenge listener stopped", "error", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			tls.Server(conn, tc).Handshake()
+		}()
+	}
+}
+
+func spkiFingerprint(leaf *x509.Certificate) string {
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// PairingPayload is encoded into the pairing QR code shown on the Mac. The
+// phone pins TLSFingerprint and the Noise public key on first contact.
+type PairingPayload struct {
+	Version        int      `json:"v"`
+	Hosts          []string `json:"hosts"`
+	Port           string   `json:"port"`
+	Scheme         string   `json:"scheme"`
+	NoisePublicKey string   `json:"noise_pk"`
+	// Verifies the signature on the next key rotation announcement
+	NoiseSigningKey string `json:"noise_sign_pk"`
+	TLSFingerprint  string `json:"tls_spki_sha256,omitempty"`
+	// One-time code redeemed at /pairing/complete; only set by /pairing/start
+	PairCode        string    `json:"pair_code,omitempty"`
+	PairCodeExpires time.Time `json:"pair_code_expires,omitempty"`
+}
+
+func currentPairingPayload(addr string) PairingPayload {
+	_, port, _ := net.SplitHostPort(addr)
+	names, ips := certHosts()
+	hosts := names[1:]
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			hosts = append(hosts, ip.String())
+		}
+	}
+	scheme := "https"
+	if tlsState.Config == nil {
+		scheme = "http"
+	}
+	return PairingPayload{
+		Version:         1,
+		Hosts:           hosts,
+		Port:            port,
+		Scheme:          scheme,
+		NoisePublicKey:  noiseManager.GetPublicKey(),
+		NoiseSigningKey: noiseManager.SigningKey(),
+		TLSFingerprint:  tlsState.Fingerprint,
+	}
+}
+
+// handlePairingPayload serves the pairing payload to the local Mac app,
+// which renders it as a QR code
+func handlePairingPayload(addr string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentPairingPayload(addr))
+	}
+}
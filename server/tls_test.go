@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelfSignedTLSPersists(t *testing.T) {
+	ks, err := OpenKeyStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open key store: %v", err)
+	}
+
+	first, err := selfSignedTLS(ks)
+	if err != nil {
+		t.Fatalf("Failed to create self-signed cert: %v", err)
+	}
+	if first.Fingerprint == "" || first.Config == nil {
+		t.Fatal("Expected fingerprint and TLS config")
+	}
+
+	// A restart must present the same pin
+	second, err := selfSignedTLS(ks)
+	if err != nil {
+		t.Fatalf("Failed to reload self-signed cert: %v", err)
+	}
+	if first.Fingerprint != second.Fingerprint {
+		t.Fatalf("Fingerprint changed across restarts: %s != %s", first.Fingerprint, second.Fingerprint)
+	}
+
+	// Reissuing the certificate keeps the key and therefore the pin
+	ks.Delete(tlsCertName)
+	third, err := selfSignedTLS(ks)
+	if err != nil {
+		t.Fatalf("Failed to reissue self-signed cert: %v", err)
+	}
+	if first.Fingerprint != third.Fingerprint {
+		t.Fatal("Fingerprint changed after certificate reissue")
+	}
+}
+
+func TestListensOnLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8443":   true,
+		"[::1]:8443":       true,
+		"localhost:8443":   true,
+		":8443":            false,
+		"0.0.0.0:8443":     false,
+		"192.168.1.5:8443": false,
+		"bogus":            false,
+	} {
+		if got := listensOnLoopback(addr); got != want {
+			t.Errorf("%s: expected %v, got %v", addr, want, got)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// toolApprovalTimeout denies a sensitive call the device has not answered
+	toolApprovalTimeout = 60 * time.Second
+	// maxToolResultBytes caps what a tool hands back to the model
+	maxToolResultBytes = 64 << 10
+	codeUnknownTool    = "unknown_tool"
+)
+
+var ErrUnknownTool = errors.New("unknown tool")
+
+// Tool is a function the model may call during a chat. Sensitive tools run
+// only after the device approves the call.
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments
+	Parameters map[string]interface{}
+	Sensitive  bool
+	Run        func(ctx context.Context, args map[string]interface{}) (string, error)
+}
+
+// ToolInfo describes a tool to the client
+type ToolInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Sensitive   bool   `json:"sensitive,omitempty"`
+}
+
+// ToolEvent is sent on tool_call, before a tool runs, and on tool_result
+type ToolEvent struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+	// NeedsApproval asks the device for a tool_approval
+	NeedsApproval bool   `json:"needs_approval,omitempty"`
+	Result        string `json:"result,omitempty"`
+	Error         string `json:"error,omitempty"`
+	Denied        bool   `json:"denied,omitempty"`
+}
+
+// OllamaToolCall is a call in an assistant message of /api/chat
+type OllamaToolCall struct {
+	Function struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	} `json:"function"`
+}
+
+// ToolRegistry holds the tools a chat can offer the model
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: make(map[string]Tool)}
+}
+
+func (tr *ToolRegistry) Register(t Tool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.tools[t.Name] = t
+}
+
+func (tr *ToolRegistry) Get(name string) (Tool, bool) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	t, ok := tr.tools[name]
+	return t, ok
+}
+
+// List describes the registered tools, sorted by name
+func (tr *ToolRegistry) List() []ToolInfo {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	out := make([]ToolInfo, 0, len(tr.tools))
+	for _, t := range tr.tools {
+		out = append(out, ToolInfo{Name: t.Name, Description: t.Description, Sensitive: t.Sensitive})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Definitions returns the /api/chat tools entry for the named tools
+func (tr *ToolRegistry) Definitions(names []string) ([]map[string]interface{}, error) {
+	defs := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		t, ok := tr.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownTool, name)
+		}
+		defs = append(defs, map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        t.Name,
+				"description": t.Description,
+				"parameters":  t.Parameters,
+			},
+		})
+	}
+	return defs, nil
+}
+
+// Call runs one tool call of a chat, streaming tool_call and tool_result to
+// the client, and returns the tool message for the model. Failures and
+// denials go back to the model as the result so it can carry on.
+func (tr *ToolRegistry) Call(ctx context.Context, out *RequestStream, id string, call OllamaToolCall) ChatMessage {
+	name := call.Function.Name
+	ev := ToolEvent{ID: id, Name: name, Arguments: call.Function.Arguments}
+	t, ok := tr.Get(name)
+	if ok {
+		ev.NeedsApproval = t.Sensitive
+	}
+	out.Send(ServerMsg{Op: "tool_call", Tool: &ev})
+
+	result := ToolEvent{ID: id, Name: name}
+	switch {
+	case !ok:
+		result.Error = fmt.Sprintf("%v %q", ErrUnknownTool, name)
+	case t.Sensitive && !out.s.AwaitApproval(ctx, out.id, id):
+		result.Denied = true
+	default:
+		res, err := t.Run(ctx, call.Function.Arguments)
+		res = truncateUTF8(res, maxToolResultBytes)
+		result.Result = res
+		if err != nil {
+			result.Error = err.Error()
+		}
+	}
+	out.Send(ServerMsg{Op: "tool_result", Tool: &result})
+
+	content := result.Result
+	switch {
+	case result.Denied:
+		content = "The user denied this tool call."
+	case result.Error != "":
+		content = "error: " + result.Error
+	}
+	return ChatMessage{Role: "tool", Content: content, ToolName: name}
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a rune
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// AwaitApproval blocks until the device answers a tool_approval for the
+// call; no answer in time counts as a denial
+func (s *Session) AwaitApproval(ctx context.Context, requestID, callID string) bool {
+	key := requestID + "/" + callID
+	ch := make(chan bool, 1)
+	s.mu.Lock()
+	if s.approvals == nil {
+		s.approvals = make(map[string]chan bool)
+	}
+	s.approvals[key] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.approvals, key)
+		s.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(toolApprovalTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-ch:
+		return ok
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// Approve answers a pending approval; false if none is waiting
+func (s *Session) Approve(requestID, callID string, approved bool) bool {
+	s.mu.Lock()
+	ch, ok := s.approvals[requestID+"/"+callID]
+	s.mu.Unlock()
+	if ok {
+		select {
+		case ch <- approved:
+		default:
+		}
+	}
+	return ok
+}
+
+// httpTool posts the call's arguments as JSON to a local endpoint and
+// returns the response body
+func httpTool(tc HTTPToolConfig) Tool {
+	client := newEgressClient(10 * time.Second)
+	return Tool{
+		Name:        tc.Name,
+		Description: tc.Description,
+		Parameters:  tc.Parameters,
+		Sensitive:   tc.Sensitive,
+		Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+			body, _ := json.Marshal(args)
+			req, err := http.NewRequestWithContext(ctx, "POST", tc.URL, bytes.NewReader(body))
+			if err != nil {
+				return "", err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := client.Do(req)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			// One byte over the cap so Call trims a split rune
+			b, err := io.ReadAll(io.LimitReader(resp.Body, maxToolResultBytes+1))
+			if err != nil {
+				return "", err
+			}
+			if resp.StatusCode != http.StatusOK {
+				return "", fmt.Errorf("%s returned status %d", tc.Name, resp.StatusCode)
+			}
+			return string(b), nil
+		},
+	}
+}
+
+// activeTools is rebuilt from the tools section on reload
+var activeTools atomic.Pointer[ToolRegistry]
+
+func init() {
+	activeTools.Store(NewToolRegistry())
+}
+
+func toolRegistry() *ToolRegistry { return activeTools.Load() }
+
+// initTools registers the built-in tools and those in the config
+func initTools() {
+	tr := NewToolRegistry()
+	tr.Register(timeTool())
+	tr.Register(calculatorTool())
+	if roots := cfg().Tools.FileSearchRoots; len(roots) > 0 {
+		tr.Register(fileSearchTool(roots))
+	}
+	for _, tc := range cfg().Tools.HTTP {
+		tr.Register(httpTool(tc))
+	}
+	activeTools.Store(tr)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxSearchResults caps the matches file_search returns
+	maxSearchResults = 20
+	// maxSearchFileBytes skips larger files when searching contents
+	maxSearchFileBytes = 1 << 20
+)
+
+func timeTool() Tool {
+	return Tool{
+		Name:        "time",
+		Description: "Current date and time, optionally in an IANA time zone",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"timezone": map[string]interface{}{"type": "string", "description": "e.g. Europe/Berlin"},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+			now := time.Now()
+			if tz, _ := args["timezone"].(string); tz != "" {
+				loc, err := time.LoadLocation(tz)
+				if err != nil {
+					return "", fmt.Errorf("unknown time zone %q", tz)
+				}
+				now = now.In(loc)
+			}
+			return now.Format("Monday, 2006-01-02T15:04:05Z07:00 (MST)"), nil
+		},
+	}
+}
+
+func calculatorTool() Tool {
+	return Tool{
+		Name:        "calculator",
+		Description: "Evaluate an arithmetic expression with + - * / %, parentheses, sqrt, abs, pow and the constants pi and e",
+		Parameters: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"expression"},
+			"properties": map[string]interface{}{
+				"expression": map[string]interface{}{"type": "string"},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+			expr, _ := args["expression"].(string)
+			v, err := calculate(expr)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatFloat(v, 'g', -1, 64), nil
+		},
+	}
+}
+
+var errBadExpression = errors.New("unsupported expression")
+
+// calculate parses expr as a Go expression and evaluates only arithmetic
+func calculate(expr string) (float64, error) {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errBadExpression, err)
+	}
+	return evalExpr(e)
+}
+
+func evalExpr(e ast.Expr) (float64, error) {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.INT && e.Kind != token.FLOAT {
+			return 0, errBadExpression
+		}
+		return strconv.ParseFloat(e.Value, 64)
+	case *ast.Ident:
+		switch e.Name {
+		case "pi":
+			return math.Pi, nil
+		case "e":
+			return math.E, nil
+		}
+		return 0, fmt.Errorf("%w: unknown name %s", errBadExpression, e.Name)
+	case *ast.ParenExpr:
+		return evalExpr(e.X)
+	case *ast.UnaryExpr:
+		x, err := evalExpr(e.X)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.ADD:
+			return x, nil
+		case token.SUB:
+			return -x, nil
+		}
+	case *ast.BinaryExpr:
+		x, err := evalExpr(e.X)
+		if err != nil {
+			return 0, err
+		}
+		y, err := evalExpr(e.Y)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.QUO, token.REM:
+			if y == 0 {
+				return 0, errors.New("division by zero")
+			}
+			if e.Op == token.REM {
+				return math.Mod(x, y), nil
+			}
+			return x / y, nil
+		}
+	case *ast.CallExpr:
+		fn, ok := e.Fun.(*ast.Ident)
+		if !ok {
+			return 0, errBadExpression
+		}
+		args := make([]float64, len(e.Args))
+		for i, a := range e.Args {
+			v, err := evalExpr(a)
+			if err != nil {
+				return 0, err
+			}
+			args[i] = v
+		}
+		switch {
+		case fn.Name == "sqrt" && len(args) == 1:
+			return math.Sqrt(args[0]), nil
+		case fn.Name == "abs" && len(args) == 1:
+			return math.Abs(args[0]), nil
+		case fn.Name == "pow" && len(args) == 2:
+			return math.Pow(args[0], args[1]), nil
+		}
+		return 0, fmt.Errorf("%w: unknown function %s/%d", errBadExpression, fn.Name, len(args))
+	}
+	return 0, errBadExpression
+}
+
+// fileSearchTool finds files under roots whose name or contents contain the
+// query. It reads files on the Mac, so every call needs approval. Symlinks
+// and hidden entries are skipped so the search cannot leave the roots.
+func fileSearchTool(roots []string) Tool {
+	return Tool{
+		Name:        "file_search",
+		Description: "Search local files by name and content; returns matching paths and lines",
+		Sensitive:   true,
+		Parameters: map[string]interface{}{
+			"type":     "object",
+			"required": []string{"query"},
+			"properties": map[string]interface{}{
+				"query": map[string]interface{}{"type": "string"},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+			query, _ := args["query"].(string)
+			if strings.TrimSpace(query) == "" {
+				return "", errors.New("empty query")
+			}
+			matches := searchFiles(ctx, roots, strings.ToLower(query))
+			if len(matches) == 0 {
+				return "no matches", nil
+			}
+			return strings.Join(matches, "\n"), nil
+		},
+	}
+}
+
+func searchFiles(ctx context.Context, roots []string, query string) []string {
+	var matches []string
+	errDone := errors.New("done")
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if ctx.Err() != nil || len(matches) >= maxSearchResults {
+				return errDone
+			}
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			if strings.Contains(strings.ToLower(d.Name()), query) {
+				matches = append(matches, path)
+				return nil
+			}
+			if line, ok := grepFile(path, query); ok {
+				matches = append(matches, path+": "+line)
+			}
+			return nil
+		})
+		if err == errDone {
+			break
+		}
+	}
+	return matches
+}
+
+// grepFile returns the first line of a small text file containing query
+func grepFile(path, query string) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > maxSearchFileBytes {
+		return "", false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.ContainsRune(line, 0) {
+			return "", false
+		}
+		if strings.Contains(strings.ToLower(line), query) {
+			return strings.TrimSpace(truncateUTF8(line, 200)), true
+		}
+	}
+	return "", false
+}
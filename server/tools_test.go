@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalculate(t *testing.T) {
+	for expr, want := range map[string]float64{
+		"1 + 2*3":      7,
+		"(1+2)*3":      9,
+		"-4 / 2":       -2,
+		"7 % 4":        3,
+		"sqrt(16)":     4,
+		"pow(2, 10)":   1024,
+		"abs(-2.5)+pi": 2.5 + 3.141592653589793,
+	} {
+		if got, err := calculate(expr); err != nil || got != want {
+			t.Errorf("%s = %v, %v; want %v", expr, got, err, want)
+		}
+	}
+	for _, expr := range []string{"os.Exit(1)", `"a" + "b"`, "x * 2", "1 / 0", "f()"} {
+		if _, err := calculate(expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	s := strings.Repeat("a", 3) + "日本"
+	for n, want := range map[int]string{10: s, 9: s, 8: "aaa日", 6: "aaa日", 5: "aaa", 3: "aaa", 0: ""} {
+		if got := truncateUTF8(s, n); got != want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", s, n, got, want)
+		}
+	}
+}
+
+func TestFileSearchStaysInRoot(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("first line\nwhiteboard plan\n"), 0600)
+	os.Mkdir(filepath.Join(root, ".secret"), 0700)
+	os.WriteFile(filepath.Join(root, ".secret", "keys.txt"), []byte("whiteboard"), 0600)
+	os.WriteFile(filepath.Join(outside, "other.txt"), []byte("whiteboard"), 0600)
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skip(err)
+	}
+
+	got := searchFiles(context.Background(), []string{root}, "whiteboard")
+	if len(got) != 1 || !strings.HasSuffix(got[0], "notes.txt: whiteboard plan") {
+		t.Errorf("unexpected matches: %q", got)
+	}
+}
+
+func TestToolApproval(t *testing.T) {
+	s := NewSession("s1", "dev-1", nil, nil)
+	done := make(chan bool)
+	go func() { done <- s.AwaitApproval(context.Background(), "r1", "call_1") }()
+	for !s.Approve("r1", "call_1", true) {
+		time.Sleep(time.Millisecond)
+	}
+	if !<-done {
+		t.Error("approved call reported as denied")
+	}
+	if s.Approve("r1", "call_1", true) {
+		t.Error("approval accepted with nothing waiting")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if s.AwaitApproval(ctx, "r1", "call_2") {
+		t.Error("cancelled wait reported as approved")
+	}
+}
+
+func TestToolCallLoop(t *testing.T) {
+	old := settings.Load()
+	settings.Store(defaultConfig())
+	defer settings.Store(old)
+	initTools()
+
+	var rounds []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		rounds = append(rounds, req)
+		if len(rounds) == 1 {
+			w.Write([]byte(`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"calculator","arguments":{"expression":"6*7"}}}]},"done":true,"eval_count":3}` + "\n"))
+			return
+		}
+		w.Write([]byte(`{"message":{"content":"It is 42."},"done":false}` + "\n"))
+		w.Write([]byte(`{"message":{"content":""},"done":true,"eval_count":4}` + "\n"))
+	}))
+	defer srv.Close()
+
+	s := NewSession("s1", "dev-1", nil, nil)
+	tools, err := toolRegistry().Definitions([]string{"calculator"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	out := s.NewStream(ctx, "r1")
+	reply, final, err := ollamaChatRound(ctx, srv.URL, map[string]any{"tools": tools}, func(string) {})
+	if err != nil || len(reply.ToolCalls) != 1 || final.EvalCount != 3 {
+		t.Fatalf("round 1: %+v %+v %v", reply, final, err)
+	}
+	msg := toolRegistry().Call(ctx, out, "call_1", reply.ToolCalls[0])
+	if msg.Role != "tool" || msg.Content != "42" || msg.ToolName != "calculator" {
+		t.Errorf("tool message: %+v", msg)
+	}
+
+	var content string
+	reply, final2, err := ollamaChatRound(ctx, srv.URL, map[string]any{"messages": []ChatMessage{reply, msg}}, func(c string) { content += c })
+	if err != nil || content != "It is 42." || len(reply.ToolCalls) != 0 {
+		t.Fatalf("round 2: %q %v", content, err)
+	}
+	if total := final.add(final2); total.EvalCount != 7 {
+		t.Errorf("eval_count = %d, want 7", total.EvalCount)
+	}
+
+	if _, err := toolRegistry().Definitions([]string{"rm"}); !errors.Is(err, ErrUnknownTool) {
+		t.Errorf("expected ErrUnknownTool, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UsageStats is attached to the done message of every generation
+type UsageStats struct {
+	Model            string  `json:"model"`
+	TTFTMs           int64   `json:"ttft_ms"`
+	TotalMs          int64   `json:"total_ms"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TokensPerSec     float64 `json:"tokens_per_sec"`
+	LoadMs           int64   `json:"load_ms,omitempty"`
+}
+
+// OllamaFinal holds the accounting fields of Ollama's final stream object.
+// Durations are reported by Ollama in nanoseconds.
+type OllamaFinal struct {
+	Model           string `json:"model"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	EvalDuration    int64  `json:"eval_duration"`
+	LoadDuration    int64  `json:"load_duration"`
+}
+
+// Usage converts the final stream object into the figures sent to the client
+func (f *OllamaFinal) Usage(model string, start time.Time, ttft time.Duration) *UsageStats {
+	u := &UsageStats{
+		Model:   model,
+		TTFTMs:  ttft.Milliseconds(),
+		TotalMs: time.Since(start).Milliseconds(),
+	}
+	if f == nil {
+		return u
+	}
+	if f.Model != "" {
+		u.Model = f.Model
+	}
+	u.PromptTokens = f.PromptEvalCount
+	u.CompletionTokens = f.EvalCount
+	u.LoadMs = time.Duration(f.LoadDuration).Milliseconds()
+	if f.EvalDuration > 0 {
+		u.TokensPerSec = float64(f.EvalCount) / time.Duration(f.EvalDuration).Seconds()
+	}
+	return u
+}
+
+// usageTotals aggregates usage for one device or model
+type usageTotals struct {
+	Requests         int       `json:"requests"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	AvgTTFTMs        float64   `json:"avg_ttft_ms"`
+	AvgTokensPerSec  float64   `json:"avg_tokens_per_sec"`
+	LastUsed         time.Time `json:"last_used"`
+
+	ttftSum float64
+	tpsSum  float64
+}
+
+func (t *usageTotals) add(u *UsageStats) {
+	t.Requests++
+	t.PromptTokens += u.PromptTokens
+	t.CompletionTokens += u.CompletionTokens
+	t.ttftSum += float64(u.TTFTMs)
+	t.tpsSum += u.TokensPerSec
+	t.AvgTTFTMs = t.ttftSum / float64(t.Requests)
+	t.AvgTokensPerSec = t.tpsSum / float64(t.Requests)
+	t.LastUsed = time.Now()
+}
+
+// maxUsageDevices bounds the per-device totals; the least recently used
+// device is dropped to make room
+const maxUsageDevices = 1024
+
+// UsageTracker aggregates token usage per device and per model. Devices are
+// authenticated device IDs or API keys.
+type UsageTracker struct {
+	mu       sync.Mutex
+	byDevice map[string]*usageTotals
+	byModel  map[string]*usageTotals
+}
+
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{
+		byDevice: make(map[string]*usageTotals),
+		byModel:  make(map[string]*usageTotals),
+	}
+}
+
+func (ut *UsageTracker) Record(deviceID string, u *UsageStats) {
+	if u == nil {
+		return
+	}
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	if deviceID != "" {
+		if _, ok := ut.byDevice[deviceID]; !ok {
+			if len(ut.byDevice) >= maxUsageDevices {
+				ut.evictDeviceLocked()
+			}
+			ut.byDevice[deviceID] = &usageTotals{}
+		}
+		ut.byDevice[deviceID].add(u)
+	}
+
+	if _, ok := ut.byModel[u.Model]; !ok {
+		ut.byModel[u.Model] = &usageTotals{}
+	}
+	ut.byModel[u.Model].add(u)
+}
+
+func (ut *UsageTracker) evictDeviceLocked() {
+	oldest := ""
+	for id, t := range ut.byDevice {
+		if oldest == "" || t.LastUsed.Before(ut.byDevice[oldest].LastUsed) {
+			oldest = id
+		}
+	}
+	delete(ut.byDevice, oldest)
+}
+
+// Report returns a snapshot of the aggregated usage
+func (ut *UsageTracker) Report() map[string]interface{} {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	devices := make(map[string]usageTotals, len(ut.byDevice))
+	for k, v := range ut.byDevice {
+		devices[k] = *v
+	}
+	models := make(map[string]usageTotals, len(ut.byModel))
+	totalTokens := 0
+	for k, v := range ut.byModel {
+		models[k] = *v
+		totalTokens += v.PromptTokens + v.CompletionTokens
+	}
+
+	// Most used models first
+	top := make([]string, 0, len(models))
+	for k := range models {
+		top = append(top, k)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return models[top[i]].Requests > models[top[j]].Requests
+	})
+
+	return map[string]interface{}{
+		"by_device":    devices,
+		"by_model":     models,
+		"top_models":   top,
+		"total_tokens": totalTokens,
+	}
+}
+
+var usageTracker = NewUsageTracker()
+
+func handleUsageMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usageTracker.Report())
+}
+
+// add sums the counts of another round of the same chat into f
+func (f *OllamaFinal) add(g *OllamaFinal) *OllamaFinal {
+	if g == nil {
+		return f
+	}
+	if f == nil {
+		c := *g
+		return &c
+	}
+	f.Model = g.Model
+	f.PromptEvalCount += g.PromptEvalCount
+	f.EvalCount += g.EvalCount
+	f.EvalDuration += g.EvalDuration
+	f.LoadDuration += g.LoadDuration
+	return f
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOllamaFinalUsage(t *testing.T) {
+	line := []byte(`{"model":"qwen3:1.7b","done":true,"prompt_eval_count":12,"eval_count":100,"eval_duration":2000000000,"load_duration":5000000}`)
+
+	var final OllamaFinal
+	if err := json.Unmarshal(line, &final); err != nil {
+		t.Fatalf("Failed to parse final object: %v", err)
+	}
+
+	usage := final.Usage("qwen2.5:3b", time.Now().Add(-time.Second), 150*time.Millisecond)
+	if usage.Model != "qwen3:1.7b" {
+		t.Fatalf("Expected model reported by Ollama, got %q", usage.Model)
+	}
+	if usage.PromptTokens != 12 || usage.CompletionTokens != 100 {
+		t.Fatalf("Unexpected token counts: %+v", usage)
+	}
+	if usage.TokensPerSec != 50 {
+		t.Fatalf("Expected 50 tokens/sec, got %v", usage.TokensPerSec)
+	}
+	if usage.TTFTMs != 150 || usage.LoadMs != 5 {
+		t.Fatalf("Unexpected timings: %+v", usage)
+	}
+	if usage.TotalMs < 1000 {
+		t.Fatalf("Expected total latency >= 1000ms, got %d", usage.TotalMs)
+	}
+
+	// A stream that ended without a final object still reports timings
+	var missing *OllamaFinal
+	if u := missing.Usage("gemma3:270m", time.Now(), 0); u.Model != "gemma3:270m" {
+		t.Fatalf("Expected fallback model, got %q", u.Model)
+	}
+}
+
+func TestUsageTracker(t *testing.T) {
+	ut := NewUsageTracker()
+	ut.Record("192.168.1.20", &UsageStats{Model: "a", PromptTokens: 10, CompletionTokens: 20, TTFTMs: 100})
+	ut.Record("192.168.1.20", &UsageStats{Model: "b", PromptTokens: 1, CompletionTokens: 2, TTFTMs: 300})
+	ut.Record("192.168.1.21", &UsageStats{Model: "a", PromptTokens: 5, CompletionTokens: 5, TTFTMs: 200})
+
+	report := ut.Report()
+	if report["total_tokens"] != 43 {
+		t.Fatalf("Expected 43 total tokens, got %v", report["total_tokens"])
+	}
+
+	devices := report["by_device"].(map[string]usageTotals)
+	if d := devices["192.168.1.20"]; d.Requests != 2 || d.AvgTTFTMs != 200 {
+		t.Fatalf("Unexpected device totals: %+v", d)
+	}
+
+	top := report["top_models"].([]string)
+	if len(top) != 2 || top[0] != "a" {
+		t.Fatalf("Expected model a first, got %v", top)
+	}
+}
+
+func TestUsageTrackerBounded(t *testing.T) {
+	ut := NewUsageTracker()
+	ut.Record("", &UsageStats{Model: "a", CompletionTokens: 1})
+	if len(ut.byDevice) != 0 || ut.byModel["a"] == nil {
+		t.Fatal("Expected anonymous usage to count only towards the model")
+	}
+	for i := 0; i < maxUsageDevices; i++ {
+		ut.Record(fmt.Sprintf("dev-%d", i), &UsageStats{Model: "a"})
+	}
+	ut.byDevice["dev-0"].LastUsed = time.Now().Add(-time.Hour)
+	ut.Record("dev-new", &UsageStats{Model: "a"})
+	if len(ut.byDevice) != maxUsageDevices || ut.byDevice["dev-0"] != nil || ut.byDevice["dev-new"] == nil {
+		t.Error("Expected the least recently used device to make room")
+	}
+}
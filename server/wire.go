@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// wireEncoding is how ClientMsg and ServerMsg are serialized on the
+// DataChannel. Sessions start with JSON; a client switches its session to
+// CBOR with the hello op. Incoming messages are accepted in either encoding
+// so clients can migrate one message at a time. The CBOR schema is
+// docs/datachannel.cddl.
+type wireEncoding int
+
+const (
+	encodingJSON wireEncoding = iota
+	encodingCBOR
+)
+
+func (e wireEncoding) String() string {
+	if e == encodingCBOR {
+		return "cbor"
+	}
+	return "json"
+}
+
+var ErrBadMessage = errors.New("malformed message")
+
+var (
+	// CBOR maps use the JSON field names; times are RFC 3339 strings as in
+	// JSON, and byte fields are byte strings instead of base64. Free-form
+	// maps such as a chat format decode with string keys, as from JSON.
+	cborEnc, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	cborDec, _ = cbor.DecOptions{
+		DupMapKey:      cbor.DupMapKeyEnforcedAPF,
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+)
+
+// chooseEncoding picks the first encoding the client offers that the server
+// supports, falling back to JSON
+func chooseEncoding(offered []string) wireEncoding {
+	for _, name := range offered {
+		switch name {
+		case "cbor":
+			return encodingCBOR
+		case "json":
+			return encodingJSON
+		}
+	}
+	return encodingJSON
+}
+
+// decodeClientMsg detects the encoding: a JSON message is an object, so its
+// first byte is '{' (after whitespace); anything else is taken as CBOR
+func decodeClientMsg(data []byte, cm *ClientMsg) (wireEncoding, error) {
+	if t := bytes.TrimLeft(data, " \t\r\n"); len(t) > 0 && t[0] == '{' {
+		if err := json.Unmarshal(data, cm); err != nil {
+			return encodingJSON, ErrBadMessage
+		}
+		return encodingJSON, nil
+	}
+	if err := cborDec.Unmarshal(data, cm); err != nil {
+		return encodingCBOR, ErrBadMessage
+	}
+	return encodingCBOR, nil
+}
+
+func encodeServerMsg(enc wireEncoding, msg ServerMsg) ([]byte, error) {
+	if enc == encodingCBOR {
+		return cborEnc.Marshal(msg)
+	}
+	return json.Marshal(msg)
+}
+
+// sendPlain sends without encryption: JSON as a text message, CBOR as
+// binary
+func sendPlain(dc *webrtc.DataChannel, enc wireEncoding, msg ServerMsg) error {
+	data, err := encodeServerMsg(enc, msg)
+	if err != nil {
+		return err
+	}
+	if enc == encodingCBOR {
+		return dc.Send(data)
+	}
+	return dc.SendText(string(data))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestDecodeClientMsgEncodings(t *testing.T) {
+	var cm ClientMsg
+	enc, err := decodeClientMsg([]byte(` {"op":"noise_init","noise_init":"AQID"}`), &cm)
+	if err != nil || enc != encodingJSON || !bytes.Equal(cm.NoiseInit, []byte{1, 2, 3}) {
+		t.Fatalf("json: %v %v %+v", enc, err, cm)
+	}
+
+	// Byte fields are raw byte strings in CBOR
+	data, _ := cbor.Marshal(map[string]interface{}{"op": "noise_init", "noise_init": []byte{1, 2, 3}, "acks": map[string]int{"r1": 4}})
+	cm = ClientMsg{}
+	enc, err = decodeClientMsg(data, &cm)
+	if err != nil || enc != encodingCBOR || !bytes.Equal(cm.NoiseInit, []byte{1, 2, 3}) || cm.Acks["r1"] != 4 {
+		t.Fatalf("cbor: %v %v %+v", enc, err, cm)
+	}
+
+	for _, bad := range [][]byte{[]byte(`{"op":`), {0xff, 0x00}} {
+		if _, err := decodeClientMsg(bad, &cm); err != ErrBadMessage {
+			t.Errorf("decode(%x) = %v", bad, err)
+		}
+	}
+}
+
+func TestServerMsgCBORFieldNames(t *testing.T) {
+	data, err := encodeServerMsg(encodingCBOR, ServerMsg{Op: "delta", Content: "hi", RequestID: "r1", Seq: 2, NoiseResponse: []byte{9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := cbor.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["op"] != "delta" || m["content"] != "hi" || m["request_id"] != "r1" || !bytes.Equal(m["noise_response"].([]byte), []byte{9}) {
+		t.Errorf("cbor map = %v", m)
+	}
+	if _, ok := m["error"]; ok {
+		t.Error("empty fields should be omitted")
+	}
+}
+
+func TestChooseEncoding(t *testing.T) {
+	for _, c := range []struct {
+		offered []string
+		want    wireEncoding
+	}{
+		{nil, encodingJSON},
+		{[]string{"protobuf", "cbor", "json"}, encodingCBOR},
+		{[]string{"json", "cbor"}, encodingJSON},
+	} {
+		if got := chooseEncoding(c.offered); got != c.want {
+			t.Errorf("chooseEncoding(%v) = %v", c.offered, got)
+		}
+	}
+}